@@ -130,15 +130,34 @@ func makeBuildMessage(d *buildState) *buildMessage {
 	return &m
 }
 
+// A musicError is an error at a specific location in a song file.
+type musicError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
 type musicMessage struct {
 	*song.Compiled
-	Error string `json:"error,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Errors []musicError `json:"errors,omitempty"`
 }
 
 func makeMusicMessage(d *watcher.SongState) *musicMessage {
 	var m musicMessage
 	if d.Err != nil {
 		m.Error = d.Err.Error()
+		if errs, ok := d.Err.(song.ErrorList); ok {
+			for _, e := range errs {
+				m.Errors = append(m.Errors, musicError{
+					File:    e.File,
+					Line:    e.Line,
+					Column:  e.Column,
+					Message: e.Err.Error(),
+				})
+			}
+		}
 	} else {
 		m.Compiled = d.Compiled
 	}
@@ -0,0 +1,224 @@
+package instrument
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"moria.us/js13k/build/embed"
+)
+
+// A Param is a decoded node parameter.
+type Param struct {
+	Type *ParamType
+	// Args are the encoded arguments.
+	Args []uint8
+}
+
+// An Instruction is a decoded bytecode instruction.
+type Instruction struct {
+	// Pos is the offset of the instruction in the bytecode.
+	Pos int
+	Op  uint8
+	// Count is the number of times a repeat block runs, for OpRepeat.
+	Count int
+	// Node is the type of node to create, and Params are its parameters, in
+	// the same order as Node.Params. Node is nil if the instruction does not
+	// create a node.
+	Node   *NodeType
+	Params []Param
+}
+
+var errOverrun = errors.New("program overrun")
+
+type reader struct {
+	code []byte
+	pos  int
+}
+
+func (r *reader) read(n int) ([]byte, error) {
+	if len(r.code)-r.pos < n {
+		return nil, errOverrun
+	}
+	d := r.code[r.pos : r.pos+n]
+	r.pos += n
+	for _, x := range d {
+		if x >= embed.NumValues {
+			return nil, fmt.Errorf("value out of range: %d", x)
+		}
+	}
+	return d, nil
+}
+
+func (r *reader) instruction() (*Instruction, error) {
+	in := Instruction{Pos: r.pos}
+	d, err := r.read(1)
+	if err != nil {
+		return nil, err
+	}
+	in.Op = d[0]
+	switch in.Op {
+	case OpRepeat:
+		d, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		in.Count = int(d[0]) + 1
+	case OpEndRepeat, OpPop:
+	default:
+		t := nodeTypeForOpcode(in.Op)
+		if t == nil {
+			return nil, fmt.Errorf("invalid opcode: %d", in.Op)
+		}
+		in.Node = t
+		for range t.Params {
+			d, err := r.read(1)
+			if err != nil {
+				return nil, err
+			}
+			if int(d[0]) >= len(ParamTypes) {
+				return nil, fmt.Errorf("invalid parameter type: %d", d[0])
+			}
+			pt := ParamTypes[d[0]]
+			args, err := r.read(len(pt.Values))
+			if err != nil {
+				return nil, err
+			}
+			in.Params = append(in.Params, Param{pt, args})
+		}
+	}
+	return &in, nil
+}
+
+// Disassemble decodes the instructions in a program. It returns an error if
+// an instruction is invalid or truncated, but does not check the structure of
+// the program. See Validate.
+func Disassemble(code []byte) ([]*Instruction, error) {
+	r := reader{code: code}
+	var ins []*Instruction
+	for r.pos < len(code) {
+		pos := r.pos
+		in, err := r.instruction()
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: %v", pos, err)
+		}
+		ins = append(ins, in)
+	}
+	return ins, nil
+}
+
+// Validate checks that a program will run without errors in the synthesizer:
+// every instruction is valid, repeat blocks are balanced and not nested, and
+// nodes are only popped from the node stack when it is not empty.
+func Validate(code []byte) error {
+	ins, err := Disassemble(code)
+	if err != nil {
+		return err
+	}
+	var depth, repeatDepth int
+	var inRepeat bool
+	for _, in := range ins {
+		switch {
+		case in.Op == OpRepeat:
+			if inRepeat {
+				return fmt.Errorf("offset %d: nested repeat", in.Pos)
+			}
+			inRepeat = true
+			repeatDepth = depth
+		case in.Op == OpEndRepeat:
+			if !inRepeat {
+				return fmt.Errorf("offset %d: end without repeat", in.Pos)
+			}
+			inRepeat = false
+			depth = repeatDepth
+		case in.Op == OpPop:
+			if depth == 0 {
+				return fmt.Errorf("offset %d: pop with empty node stack", in.Pos)
+			}
+			depth--
+		case !in.Node.Source:
+			depth++
+		}
+	}
+	if inRepeat {
+		return errors.New("unterminated repeat")
+	}
+	return nil
+}
+
+// formatNumber formats a number with three significant digits.
+func formatNumber(x float64) string {
+	if x == 0 || math.IsInf(x, 0) || math.IsNaN(x) {
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	d := 2 - int(math.Floor(math.Log10(math.Abs(x))))
+	if d < 0 {
+		d = 0
+	}
+	scale := math.Pow(10, float64(d))
+	return strconv.FormatFloat(math.Round(x*scale)/scale, 'f', -1, 64)
+}
+
+// formatArg returns a parameter argument as text, with units. The units of
+// random values depend on the parameter they are used for.
+func formatArg(e ValueEncoding, x uint8, pname string) string {
+	v := e.Decode(x)
+	switch e {
+	case GainValue:
+		return formatNumber(20*math.Log10(v)) + " dB"
+	case TimeValue:
+		return formatNumber(v) + " s"
+	case FrequencyValue:
+		return formatNumber(v) + " Hz"
+	case DetuneValue:
+		if pname == "detune" {
+			return formatNumber(v) + " cents"
+		}
+	case DecibelValue:
+		return formatNumber(v) + " dB"
+	}
+	return formatNumber(v)
+}
+
+// format returns the parameter as text, with decoded argument values.
+func (p Param) format(pname string) string {
+	var b strings.Builder
+	b.WriteString(p.Type.Name)
+	b.WriteByte('(')
+	for i, x := range p.Args {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(formatArg(p.Type.Values[i], x, pname))
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// String returns the instruction as text, in the same form as an instrument
+// file, but with decoded argument values and units. Parameters with default
+// values are omitted.
+func (in *Instruction) String() string {
+	switch in.Op {
+	case OpRepeat:
+		return "repeat " + strconv.Itoa(in.Count)
+	case OpEndRepeat:
+		return "end"
+	case OpPop:
+		return "pop"
+	}
+	var b strings.Builder
+	b.WriteString(in.Node.Name)
+	for i, p := range in.Params {
+		if p.Type.Code == ParamTypes[0].Code {
+			continue
+		}
+		b.WriteByte(' ')
+		b.WriteString(in.Node.Params[i])
+		b.WriteByte('=')
+		b.WriteString(p.format(in.Node.Params[i]))
+	}
+	return b.String()
+}
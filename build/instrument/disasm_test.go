@@ -0,0 +1,83 @@
+package instrument
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestValidateFile(t *testing.T) {
+	data, err := ioutil.ReadFile("../../music/instruments.def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insts, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inst := range insts {
+		if err := Validate(inst.Code); err != nil {
+			t.Errorf("%s: %v", inst.Name, err)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	const text = `@instrument Test
+gain gain=GADSR(min, 0.7, 0.2, 0.05)
+lowpass frequency=FConst(400) q=DBConst(4)
+repeat 3
+  pan pan=PanConst(-0.5)
+  square frequency=Note(-12) detune=RandomBipolar(10)
+end
+pop
+`
+	insts, err := Parse([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := Disassemble(insts[0].Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, in := range ins {
+		lines = append(lines, in.String())
+	}
+	out := strings.Join(lines, "\n")
+	expect := `gain gain=GADSR(0.00931 s, 0.708 s, -14 dB, 0.0495 s)
+lowpass frequency=FConst(406 Hz) q=DBConst(4 dB)
+repeat 3
+pan pan=PanConst(-0.5)
+square frequency=Note(-12) detune=RandomBipolar(9.91 cents)
+end
+pop`
+	if out != expect {
+		t.Errorf("got:\n%s\nexpect:\n%s", out, expect)
+	}
+}
+
+func TestValidateErrors(t *testing.T) {
+	cases := []struct {
+		code []byte
+		err  string
+	}{
+		{[]byte{OpGain, 1}, "overrun"},
+		{[]byte{OpGain, 10}, "invalid parameter type"},
+		{[]byte{OpGain, 1, 125}, "out of range"},
+		{[]byte{11}, "invalid opcode"},
+		{[]byte{OpRepeat, 1, OpRepeat, 1}, "nested repeat"},
+		{[]byte{OpEndRepeat}, "end without repeat"},
+		{[]byte{OpRepeat, 1, OpGain, 0}, "unterminated repeat"},
+		{[]byte{OpSquare, 0, 0, OpPop}, "empty node stack"},
+		{[]byte{OpGain, 0, OpRepeat, 1, OpPop, OpEndRepeat, OpPop, OpPop}, "offset 7: pop"},
+	}
+	for _, c := range cases {
+		err := Validate(c.code)
+		if err == nil {
+			t.Errorf("%v: no error", c.code)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: got error %q, expect %q", c.code, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Package instrument compiles instrument definitions to the bytecode which the
+// synthesizer runs, in audio.synth.js.
+package instrument
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"moria.us/js13k/build/embed"
+)
+
+// Exponent for exponential scales. Numbers encoded as N are decoded as
+// exponent**N, multiplied by a scale factor.
+const exponent = 0.94
+
+// A ValueEncoding converts numbers to and from encoded parameter values.
+type ValueEncoding interface {
+	// Encode returns the encoded value for a number, or an error if the number
+	// is out of range.
+	Encode(x float64) (uint8, error)
+	// Decode returns the number for an encoded value.
+	Decode(x uint8) float64
+}
+
+// An ExpScale encodes values on an exponential scale.
+type ExpScale struct {
+	Name  string
+	Scale float64
+}
+
+func (e *ExpScale) Encode(x float64) (uint8, error) {
+	// Ties round to even, which the previous Python compiler did.
+	v := math.RoundToEven(math.Log(x/e.Scale) / math.Log(exponent))
+	if !(0 <= v && v < embed.NumValues) {
+		return 0, fmt.Errorf("%s out of range: %v", e.Name, x)
+	}
+	return uint8(v), nil
+}
+
+func (e *ExpScale) Decode(x uint8) float64 {
+	return e.Scale * math.Pow(exponent, float64(x))
+}
+
+// A LinScale encodes values on a linear scale. If the scale is bipolar, zero
+// is encoded as the middle value, otherwise zero is encoded as zero.
+type LinScale struct {
+	Name    string
+	Scale   float64
+	Bipolar bool
+}
+
+func (e *LinScale) zero() int {
+	if e.Bipolar {
+		return (embed.NumValues - 1) >> 1
+	}
+	return 0
+}
+
+func (e *LinScale) Encode(x float64) (uint8, error) {
+	v := math.RoundToEven(x/e.Scale) + float64(e.zero())
+	if !(0 <= v && v < embed.NumValues) {
+		return 0, fmt.Errorf("%s out of range: %v", e.Name, x)
+	}
+	return uint8(v), nil
+}
+
+func (e *LinScale) Decode(x uint8) float64 {
+	return e.Scale * float64(int(x)-e.zero())
+}
+
+// Value encodings for parameters.
+var (
+	GainValue      = &ExpScale{"gain", 1}
+	TimeValue      = &ExpScale{"time", 20}
+	FrequencyValue = &ExpScale{"frequency", 20e3}
+	DetuneValue    = &ExpScale{"detune", 99.0 / 2}
+	DecibelValue   = &LinScale{"decibels", 1, true}
+	IntValue       = &LinScale{"int", 1, true}
+	PanValue       = &LinScale{"pan", 1.0 / 60, true}
+)
+
+// A Value is an argument to a parameter.
+type Value struct {
+	// If IsRaw is true, Raw is the encoded value, and is passed through
+	// without encoding. Otherwise, X is encoded.
+	IsRaw bool
+	Raw   uint8
+	X     float64
+}
+
+// Raw values for the extremes of a value encoding. For exponential scales,
+// Min is the smallest nonzero value, and is often used as an approximation of
+// zero.
+var (
+	Min = Value{IsRaw: true, Raw: embed.NumValues - 1}
+	Max = Value{IsRaw: true, Raw: 0}
+)
+
+// Number returns a value which encodes a number.
+func Number(x float64) Value {
+	return Value{X: x}
+}
+
+// A ParamType is a way to calculate the value of a node parameter.
+type ParamType struct {
+	Name string
+	// Code is the encoding of the parameter type in the bytecode.
+	Code uint8
+	// Values are the encodings of the type's arguments.
+	Values []ValueEncoding
+}
+
+// Encode returns the bytecode for a parameter with the given arguments.
+func (t *ParamType) Encode(args ...Value) ([]byte, error) {
+	if len(args) != len(t.Values) {
+		return nil, fmt.Errorf("%s got %d arguments, expect %d", t.Name, len(args), len(t.Values))
+	}
+	code := make([]byte, 1+len(args))
+	code[0] = t.Code
+	for i, a := range args {
+		if a.IsRaw {
+			if a.Raw >= embed.NumValues {
+				return nil, fmt.Errorf("%s: raw value out of range: %d", t.Name, a.Raw)
+			}
+			code[i+1] = a.Raw
+			continue
+		}
+		x, err := t.Values[i].Encode(a.X)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", t.Name, err)
+		}
+		code[i+1] = x
+	}
+	return code, nil
+}
+
+// Parameter types, indexed by code.
+var ParamTypes = []*ParamType{
+	{"Default", 0, nil},
+	{"GConst", 1, []ValueEncoding{GainValue}},
+	{"TConst", 2, []ValueEncoding{TimeValue}},
+	{"FConst", 3, []ValueEncoding{FrequencyValue}},
+	{"DBConst", 4, []ValueEncoding{DecibelValue}},
+	{"PanConst", 5, []ValueEncoding{PanValue}},
+	{"GADSR", 6, []ValueEncoding{TimeValue, TimeValue, GainValue, TimeValue}},
+	{"FADSR", 7, []ValueEncoding{
+		FrequencyValue, FrequencyValue, TimeValue, TimeValue, GainValue, TimeValue}},
+	{"Note", 8, []ValueEncoding{IntValue}},
+	{"RandomBipolar", 9, []ValueEncoding{DetuneValue}},
+}
+
+// ParamTypeNamed returns the parameter type with the given name, or nil if
+// there is no such type.
+func ParamTypeNamed(name string) *ParamType {
+	for _, t := range ParamTypes {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Instruction opcodes.
+const (
+	OpRepeat = iota
+	OpEndRepeat
+	OpPop
+	OpGain
+	OpPan
+	OpLowpass
+	OpHighpass
+	OpBandpass
+	OpSquare
+	OpSawtooth
+	OpTriangle
+)
+
+// A NodeType is a kind of audio node which a program can create.
+type NodeType struct {
+	Name   string
+	Opcode uint8
+	// Params are the names of the node's parameters, in the order they appear
+	// in the bytecode.
+	Params []string
+	// Source is true for nodes which generate audio. Other nodes process the
+	// audio from the nodes after them, until they are popped from the node
+	// stack.
+	Source bool
+}
+
+var (
+	filterParams     = []string{"frequency", "detune", "q"}
+	oscillatorParams = []string{"frequency", "detune"}
+)
+
+// NodeTypes contains all node types, in order of opcode.
+var NodeTypes = []*NodeType{
+	{"gain", OpGain, []string{"gain"}, false},
+	{"pan", OpPan, []string{"pan"}, false},
+	{"lowpass", OpLowpass, filterParams, false},
+	{"highpass", OpHighpass, filterParams, false},
+	{"bandpass", OpBandpass, filterParams, false},
+	{"square", OpSquare, oscillatorParams, true},
+	{"sawtooth", OpSawtooth, oscillatorParams, true},
+	{"triangle", OpTriangle, oscillatorParams, true},
+}
+
+// nodeTypeForOpcode returns the node type with the given opcode, or nil if the
+// opcode is not a node.
+func nodeTypeForOpcode(op uint8) *NodeType {
+	for _, t := range NodeTypes {
+		if t.Opcode == op {
+			return t
+		}
+	}
+	return nil
+}
+
+// NodeTypeNamed returns the node type with the given name, or nil if there is
+// no such type.
+func NodeTypeNamed(name string) *NodeType {
+	for _, t := range NodeTypes {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// A Program builds the bytecode for an instrument.
+type Program struct {
+	code     []byte
+	inRepeat bool
+}
+
+// Node adds a node to the program. Parameters are given as bytecode, from
+// ParamType.Encode, and parameters which are not given use their default
+// value.
+func (p *Program) Node(t *NodeType, params map[string][]byte) error {
+	for name := range params {
+		var ok bool
+		for _, pname := range t.Params {
+			if name == pname {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s has no parameter %q", t.Name, name)
+		}
+	}
+	p.code = append(p.code, t.Opcode)
+	for _, name := range t.Params {
+		if code, ok := params[name]; ok {
+			p.code = append(p.code, code...)
+		} else {
+			p.code = append(p.code, ParamTypes[0].Code)
+		}
+	}
+	return nil
+}
+
+// Pop removes the top node from the node stack.
+func (p *Program) Pop() {
+	p.code = append(p.code, OpPop)
+}
+
+// Repeat starts a block of nodes which is repeated the given number of times.
+// Repeats cannot be nested.
+func (p *Program) Repeat(count int) error {
+	if p.inRepeat {
+		return errors.New("cannot nest repeats")
+	}
+	if count < 2 || embed.NumValues < count {
+		return fmt.Errorf("invalid repeat count: %d", count)
+	}
+	p.inRepeat = true
+	p.code = append(p.code, OpRepeat, uint8(count-1))
+	return nil
+}
+
+// EndRepeat ends a repeat block.
+func (p *Program) EndRepeat() error {
+	if !p.inRepeat {
+		return errors.New("end without repeat")
+	}
+	p.inRepeat = false
+	p.code = append(p.code, OpEndRepeat)
+	return nil
+}
+
+// Code returns the program's bytecode.
+func (p *Program) Code() ([]byte, error) {
+	if p.inRepeat {
+		return nil, errors.New("unterminated repeat")
+	}
+	return p.code, nil
+}
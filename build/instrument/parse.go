@@ -0,0 +1,216 @@
+package instrument
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// An Instrument is a compiled instrument program.
+type Instrument struct {
+	Name string
+	// Line is the line where the instrument starts in the file.
+	Line int
+	Code []byte
+}
+
+// An Error is an error at a specific line in an instrument file.
+type Error struct {
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// parseValue parses a parameter argument, either a number or one of the
+// names "min" and "max".
+func parseValue(text string) (Value, error) {
+	switch text {
+	case "min":
+		return Min, nil
+	case "max":
+		return Max, nil
+	}
+	x, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return Value{}, fmt.Errorf("invalid value: %q", text)
+	}
+	return Number(x), nil
+}
+
+// parseParam parses a parameter, like "GADSR(min, 0.7, 0.2, 0.05)", and
+// returns its bytecode.
+func parseParam(text string) ([]byte, error) {
+	i := strings.IndexByte(text, '(')
+	if i == -1 || !strings.HasSuffix(text, ")") {
+		return nil, fmt.Errorf("invalid parameter: %q", text)
+	}
+	name := strings.TrimSpace(text[:i])
+	t := ParamTypeNamed(name)
+	if t == nil {
+		return nil, fmt.Errorf("unknown parameter type: %q", name)
+	}
+	var args []Value
+	if atext := strings.TrimSpace(text[i+1 : len(text)-1]); atext != "" {
+		for _, a := range strings.Split(atext, ",") {
+			v, err := parseValue(strings.TrimSpace(a))
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, v)
+		}
+	}
+	return t.Encode(args...)
+}
+
+// parseNode parses the parameters for a node, like
+// "frequency=Note(0) detune=RandomBipolar(10)", and adds it to the program.
+func parseNode(p *Program, t *NodeType, text string) error {
+	params := make(map[string][]byte)
+	for {
+		text = strings.TrimLeft(text, " \t")
+		if text == "" {
+			break
+		}
+		i := strings.IndexByte(text, '=')
+		if i == -1 {
+			return fmt.Errorf("expected name=value: %q", text)
+		}
+		name := text[:i]
+		text = text[i+1:]
+		i = strings.IndexByte(text, ')')
+		if i == -1 {
+			return fmt.Errorf("missing ')' for parameter %q", name)
+		}
+		if _, ok := params[name]; ok {
+			return fmt.Errorf("duplicate parameter: %q", name)
+		}
+		code, err := parseParam(text[:i+1])
+		if err != nil {
+			return err
+		}
+		params[name] = code
+		text = text[i+1:]
+		if text != "" && text[0] != ' ' && text[0] != '\t' {
+			return fmt.Errorf("expected space after parameter %q", name)
+		}
+	}
+	return p.Node(t, params)
+}
+
+// parseLine parses one line of an instrument definition and adds it to the
+// program.
+func parseLine(p *Program, text string) error {
+	var arg string
+	name := text
+	if i := strings.IndexAny(text, " \t"); i != -1 {
+		name = text[:i]
+		arg = strings.TrimLeft(text[i:], " \t")
+	}
+	switch name {
+	case "repeat":
+		count, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid repeat count: %q", arg)
+		}
+		return p.Repeat(count)
+	case "end":
+		if arg != "" {
+			return errors.New("unexpected text after end")
+		}
+		return p.EndRepeat()
+	case "pop":
+		if arg != "" {
+			return errors.New("unexpected text after pop")
+		}
+		p.Pop()
+		return nil
+	}
+	t := NodeTypeNamed(name)
+	if t == nil {
+		return fmt.Errorf("unknown node type: %q", name)
+	}
+	return parseNode(p, t, arg)
+}
+
+// Parse parses and compiles an instrument file. The file contains a list of
+// instruments, each starting with a line "@instrument <name>" and followed by
+// one node per line. Lines starting with ';' are comments.
+//
+//	@instrument Pluck
+//	gain gain=GADSR(min, 0.9, min, 0.9)
+//	bandpass frequency=FADSR(600, 1800, min, 0.3, min, 0.3)
+//	square frequency=Note(0)
+//
+// Nodes may also be grouped in a block from "repeat <count>" to "end", and
+// "pop" removes the last node from the node stack. Instruments are returned
+// in the order they appear in the file. The error, if any, is an *Error.
+func Parse(data []byte) ([]*Instrument, error) {
+	var insts []*Instrument
+	var cur *Instrument
+	var prog *Program
+	finish := func() error {
+		if cur == nil {
+			return nil
+		}
+		code, err := prog.Code()
+		if err != nil {
+			return err
+		}
+		if len(code) == 0 {
+			return fmt.Errorf("instrument %q is empty", cur.Name)
+		}
+		cur.Code = code
+		insts = append(insts, cur)
+		return nil
+	}
+	names := make(map[string]bool)
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		lineno := i + 1
+		text := strings.Trim(line, " \t\r")
+		if text == "" || text[0] == ';' {
+			continue
+		}
+		if !utf8.ValidString(text) {
+			return nil, &Error{lineno, errors.New("invalid UTF-8")}
+		}
+		if text[0] == '@' {
+			if err := finish(); err != nil {
+				return nil, &Error{cur.Line, err}
+			}
+			kind := text[1:]
+			var name string
+			if i := strings.IndexAny(kind, " \t"); i != -1 {
+				kind, name = kind[:i], strings.TrimSpace(kind[i:])
+			}
+			if kind != "instrument" {
+				return nil, &Error{lineno, fmt.Errorf("unknown section: %q", kind)}
+			}
+			if name == "" {
+				return nil, &Error{lineno, errors.New("missing instrument name")}
+			}
+			if names[name] {
+				return nil, &Error{lineno, fmt.Errorf("duplicate instrument name: %q", name)}
+			}
+			names[name] = true
+			cur = &Instrument{Name: name, Line: lineno}
+			prog = new(Program)
+			continue
+		}
+		if cur == nil {
+			return nil, &Error{lineno, errors.New("expected @instrument before data")}
+		}
+		if err := parseLine(prog, text); err != nil {
+			return nil, &Error{lineno, err}
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, &Error{cur.Line, err}
+	}
+	return insts, nil
+}
@@ -0,0 +1,81 @@
+package instrument
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Bytecode for music/instruments.def, as produced by the Python compiler
+// which it replaced.
+var expectInstruments = []struct {
+	name, code string
+}{
+	{"Bass", "AwZ8NhphBQc/LWE8fGEABEIFBz8tYTx8YQAEQgkIPgA="},
+	{"Dance Bass", "AwZ7PBpWBQdWE3xKGkoABD4DAQsICDIABAUgCQg+CRoCBAVcCQg+CRo="},
+	{"Soft Lead", "AwZhPxMoBQc5E00/EzAABDgFBzkTTT8TMAAEOAAEBAlKCQg+CRoB"},
+	{"Pluck", "AwZ8MnwyBwc5J3xEfEQAAAgIPgA="},
+	{"Keys", "AwZ8PHw8BQc8Fnw/Gj8ABEIFBzwWfD8aPwAEQgMBCwkIPgAEBSAICEoJGgIEBVwICEoJGg=="},
+}
+
+func TestParseFile(t *testing.T) {
+	data, err := ioutil.ReadFile("../../music/instruments.def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insts, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) != len(expectInstruments) {
+		t.Fatalf("got %d instruments, expect %d", len(insts), len(expectInstruments))
+	}
+	for i, x := range expectInstruments {
+		inst := insts[i]
+		if inst.Name != x.name {
+			t.Errorf("instrument %d: name is %q, expect %q", i, inst.Name, x.name)
+		}
+		code, err := base64.StdEncoding.DecodeString(x.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(inst.Code, code) {
+			t.Errorf("%s: code is %v, expect %v", x.name, inst.Code, code)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		text string
+		err  string
+	}{
+		{"gain", "expected @instrument"},
+		{"@sound A\ngain", "unknown section"},
+		{"@instrument\ngain", "missing instrument name"},
+		{"@instrument A\ngain\n@instrument A\ngain", "line 3: duplicate instrument"},
+		{"@instrument A\n", "line 1: instrument \"A\" is empty"},
+		{"@instrument A\noscillator", "unknown node type"},
+		{"@instrument A\ngain frequency=Note(0)", "no parameter"},
+		{"@instrument A\ngain gain=GConst(0.5) gain=GConst(1)", "duplicate parameter"},
+		{"@instrument A\ngain gain=Const(0.5)", "unknown parameter type"},
+		{"@instrument A\ngain gain=GADSR(min, 0.5)", "got 2 arguments"},
+		{"@instrument A\ngain gain=GConst(2)", "gain out of range"},
+		{"@instrument A\ngain gain=GConst(x)", "invalid value"},
+		{"@instrument A\ngain gain=GConst(0.5", "missing ')'"},
+		{"@instrument A\nrepeat 1\ngain\nend", "invalid repeat count"},
+		{"@instrument A\nrepeat 2\nrepeat 2\ngain\nend\nend", "cannot nest"},
+		{"@instrument A\nrepeat 2\ngain", "line 1: unterminated repeat"},
+		{"@instrument A\ngain\nend", "end without repeat"},
+	}
+	for _, c := range cases {
+		_, err := Parse([]byte(c.text))
+		if err == nil {
+			t.Errorf("%q: no error", c.text)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %q, expect %q", c.text, err, c.err)
+		}
+	}
+}
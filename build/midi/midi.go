@@ -111,6 +111,13 @@ func (e Event) IsMeta() bool {
 	return e.Status == 0xff
 }
 
+// IsSysEx returns true if this is a SysEx event, with status 0xf0, or an escape
+// event, with status 0xf7. The event's data, not including the length, is in
+// VData. For a SysEx event, VData does not include the initial 0xf0 byte.
+func (e Event) IsSysEx() bool {
+	return e.Status == 0xf0 || e.Status == 0xf7
+}
+
 func (e Event) String() string {
 	switch EventType(e.Status) >> 4 {
 	case NoteOff:
@@ -131,9 +138,14 @@ func (e Event) String() string {
 	case PitchBend:
 		return fmt.Sprintf("pitchBend ch.%d %d", e.Status&15, uint32(e.Data[0])<<7|uint32(e.Data[1]))
 	default:
-		if e.Status == 0xff {
+		switch e.Status {
+		case 0xff:
 			return fmt.Sprintf("meta %d %q", e.Data[0], e.VData)
-		} else {
+		case 0xf0:
+			return fmt.Sprintf("sysEx % x", e.VData)
+		case 0xf7:
+			return fmt.Sprintf("escape % x", e.VData)
+		default:
 			return "<invalid>"
 		}
 	}
@@ -168,7 +180,7 @@ func (e Event) ParseMeta() (Meta, error) {
 		}
 		return Tempo(
 			(uint32(e.VData[0]) << 16) |
-				(uint32(e.VData[1]) << 7) |
+				(uint32(e.VData[1]) << 8) |
 				uint32(e.VData[2])), nil
 	case 0x58:
 		if len(e.VData) != 4 {
@@ -188,7 +200,7 @@ func (e Event) ParseMeta() (Meta, error) {
 			SharpsFlats: int8(e.VData[0]),
 			IsMinor:     e.VData[1],
 		}, nil
-	case 0x7f:
+	case 0x2f:
 		if len(e.VData) != 0 {
 			return nil, errors.New("invalid end event")
 		}
@@ -217,7 +229,10 @@ const (
 	PitchBend     EventType = 14
 )
 
-var errInvalidTrackData = errors.New("invalid track data")
+var (
+	errInvalidTrackData = errors.New("invalid track data")
+	errTruncatedEvent   = errors.New("truncated event")
+)
 
 func (t *EventStream) readVar() (uint32, error) {
 	var q uint32
@@ -264,7 +279,7 @@ func (t *EventStream) Next() (e Event, err error) {
 	if len(t.data) == 0 {
 		return e, errInvalidTrackData
 	}
-	if delta > ^e.Time {
+	if delta > ^t.time {
 		return e, errInvalidTrackData
 	}
 	e.Time = t.time + delta
@@ -294,47 +309,46 @@ func (t *EventStream) Next() (e Event, err error) {
 		elen = 1
 	case PitchBend:
 		elen = 2
-	case 15:
-		if ctl == 255 {
+	default:
+		// Meta, SysEx, and escape events contain variable-length data, and
+		// cancel running status.
+		switch ctl {
+		case 0xff:
 			if len(t.data) < 1 {
-				return
-			}
-			mt := t.data[0]
-			t.data = t.data[1:]
-			n, err := t.readVar()
-			if err != nil {
-				return e, err
+				return e, errTruncatedEvent
 			}
-			if int(n) > len(t.data) {
-				return e, errInvalidTrackData
+			e.Data[0] = t.data[0]
+			if e.Data[0]&0x80 != 0 {
+				return e, fmt.Errorf("invalid meta event type: 0x%02x", e.Data[0])
 			}
-			t.status = 0
-			e.Status = 255
-			e.Data[0] = mt
+			t.data = t.data[1:]
+		case 0xf0, 0xf7:
+		default:
+			return e, fmt.Errorf("invalid status: 0x%02x", ctl)
+		}
+		n, err := t.readVar()
+		if err != nil {
+			return e, err
+		}
+		if int64(n) > int64(len(t.data)) {
+			return e, errTruncatedEvent
+		}
+		t.status = 0
+		e.Status = ctl
+		if n != 0 {
 			e.VData = t.data[:n]
 			t.data = t.data[n:]
-			return e, nil
 		}
-	default:
-		panic("invalid status")
+		return e, nil
 	}
 	if len(t.data) < elen {
-		return
+		return e, errTruncatedEvent
 	}
-	switch elen {
-	case 1:
-		e.Data[0] = t.data[0]
-		if e.Data[0]&0x80 != 0 {
+	for i := 0; i < elen; i++ {
+		e.Data[i] = t.data[i]
+		if e.Data[i]&0x80 != 0 {
 			return e, errInvalidTrackData
 		}
-	case 2:
-		e.Data[0] = t.data[0]
-		e.Data[1] = t.data[1]
-		if e.Data[0]&0x80 != 0 || e.Data[1]&0x80 != 0 {
-			return e, errInvalidTrackData
-		}
-	default:
-		panic("bad length: " + strconv.Itoa(elen))
 	}
 	t.data = t.data[elen:]
 	t.status = ctl
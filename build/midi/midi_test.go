@@ -0,0 +1,111 @@
+package midi
+
+import (
+	"reflect"
+	"testing"
+)
+
+// metaEvent returns a meta event at the given time.
+func metaEvent(t *testing.T, time uint32, m Meta) Event {
+	t.Helper()
+	e, err := MetaEvent(time, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// encodeEvents returns a track containing the given events.
+func encodeEvents(t *testing.T, events []Event) Track {
+	t.Helper()
+	tr, err := EncodeTrack(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestNextSysEx(t *testing.T) {
+	data := Track{
+		// GM system on.
+		0x00, 0xf0, 0x05, 0x7e, 0x7f, 0x09, 0x01, 0xf7,
+		0x00, 0x90, 60, 100,
+		// Escape, containing a MIDI clock message.
+		0x10, 0xf7, 0x01, 0xf8,
+		0x10, 0x90, 60, 0,
+		0x00, 0xff, 0x2f, 0x00,
+	}
+	events, err := data.readAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Event{
+		{Time: 0, Status: 0xf0, VData: []byte{0x7e, 0x7f, 0x09, 0x01, 0xf7}},
+		{Time: 0, Status: 0x90, Data: [2]uint8{60, 100}},
+		{Time: 16, Status: 0xf7, VData: []byte{0xf8}},
+		{Time: 32, Status: 0x90, Data: [2]uint8{60, 0}},
+		{Time: 32, Status: 0xff, Data: [2]uint8{0x2f, 0}},
+	}
+	if !reflect.DeepEqual(events, expect) {
+		t.Errorf("got events:\n%v\nexpect:\n%v", events, expect)
+	}
+	if !events[0].IsSysEx() || !events[2].IsSysEx() || events[1].IsSysEx() {
+		t.Error("IsSysEx is incorrect")
+	}
+	tr, err := EncodeTrack(expect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tr) != string(data) {
+		t.Errorf("EncodeTrack: got % x, expect % x", []byte(tr), []byte(data))
+	}
+}
+
+func TestNextErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		data Track
+	}{
+		{"sysex after running status", Track{0x00, 0x90, 60, 100, 0x00, 0xf0, 0x01, 0xf7, 0x00, 60, 0}},
+		{"system message", Track{0x00, 0xf8}},
+		{"meta type", Track{0x00, 0xff, 0x80, 0x00}},
+		{"data byte", Track{0x00, 0x90, 60, 0x80}},
+		{"no status", Track{0x00, 60, 100}},
+		{"time overflow", Track{0x8f, 0xff, 0xff, 0xff, 0x7f, 0x90, 60, 100, 0x8f, 0xff, 0xff, 0xff, 0x7f, 0x90, 60, 0}},
+	}
+	for _, c := range cases {
+		if _, err := c.data.readAll(); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+	// Every truncated track is an error, and does not panic.
+	full := Track{
+		0x00, 0xff, 0x03, 0x04, 'L', 'e', 'a', 'd',
+		0x00, 0xf0, 0x03, 0x43, 0x10, 0xf7,
+		0x00, 0xc0, 0x05,
+		0x00, 0x90, 60, 100,
+		0x81, 0x00, 0x80, 60, 0,
+		0x00, 0xf7, 0x02, 0xf3, 0x01,
+		0x00, 0xff, 0x2f, 0x00,
+	}
+	if _, err := full.readAll(); err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n < len(full); n++ {
+		events, err := full[:n].readAll()
+		if err == nil && !(len(events) != 0 && n == eventEnd(full, len(events))) {
+			t.Errorf("data[:%d]: no error", n)
+		}
+	}
+}
+
+// eventEnd returns the offset of the end of the first n events in a track.
+func eventEnd(t Track, n int) int {
+	evs := t.Events()
+	for i := 0; i < n; i++ {
+		if _, err := evs.Next(); err != nil {
+			return -1
+		}
+	}
+	return len(t) - len(evs.data)
+}
@@ -0,0 +1,111 @@
+package midi
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// A Song is a group of tracks in a MIDI file which play together. The first
+// track is the conductor track, which contains the tempo, time signature, and
+// other global events. The conductor track may also contain notes.
+type Song struct {
+	TickDivision uint16
+	Tracks       []Track
+}
+
+// readAll returns all events in a track.
+func (t Track) readAll() ([]Event, error) {
+	var events []Event
+	evs := t.Events()
+	for {
+		e, err := evs.Next()
+		if err != nil {
+			if err == io.EOF {
+				return events, nil
+			}
+			return nil, err
+		}
+		events = append(events, e)
+	}
+}
+
+// splitChannels splits a track into a conductor track, which contains the
+// events which do not belong to a channel, followed by a track for each channel
+// which has events, in channel order. The channel tracks are named after their
+// channel, counting from one.
+func splitChannels(t Track) ([]Track, error) {
+	events, err := t.readAll()
+	if err != nil {
+		return nil, err
+	}
+	var end uint32
+	if n := len(events); n != 0 {
+		end = events[n-1].Time
+	}
+	var conductor []Event
+	var channels [16][]Event
+	for _, e := range events {
+		if e.Status >= 0xf0 {
+			conductor = append(conductor, e)
+		} else {
+			ch := e.Status & 15
+			channels[ch] = append(channels[ch], e)
+		}
+	}
+	ct, err := EncodeTrack(conductor)
+	if err != nil {
+		return nil, err
+	}
+	tracks := []Track{ct}
+	for ch, events := range channels {
+		if len(events) == 0 {
+			continue
+		}
+		name, err := MetaEvent(0, TrackName("Channel "+strconv.Itoa(ch+1)))
+		if err != nil {
+			return nil, err
+		}
+		eot, err := MetaEvent(end, End{})
+		if err != nil {
+			return nil, err
+		}
+		events = append([]Event{name}, events...)
+		events = append(events, eot)
+		t, err := EncodeTrack(events)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, nil
+}
+
+// Songs returns the songs in a MIDI file, so files in any format can be used
+// the same way. A format 1 file contains one song, with the tracks in the file.
+// A format 0 file contains one song, with its single track split into a
+// conductor track and one track for each channel. In a format 2 file, each
+// track is a separate pattern, and each pattern is a song, split like a format
+// 0 file.
+func (f *File) Songs() ([]*Song, error) {
+	switch f.Head.Format {
+	case 0:
+		if len(f.Tracks) != 1 {
+			return nil, fmt.Errorf("format 0 MIDI file has %d tracks, expected 1", len(f.Tracks))
+		}
+	case 1:
+		return []*Song{{TickDivision: f.Head.TickDivision, Tracks: f.Tracks}}, nil
+	case 2:
+	default:
+		return nil, fmt.Errorf("unknown MIDI file format: %d", f.Head.Format)
+	}
+	var songs []*Song
+	for i, t := range f.Tracks {
+		tracks, err := splitChannels(t)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %v", i, err)
+		}
+		songs = append(songs, &Song{TickDivision: f.Head.TickDivision, Tracks: tracks})
+	}
+	return songs, nil
+}
@@ -0,0 +1,117 @@
+package midi
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSongsFormat0(t *testing.T) {
+	tr := encodeEvents(t, []Event{
+		metaEvent(t, 0, TrackName("Song")),
+		metaEvent(t, 0, Tempo(500000)),
+		{Time: 0, Status: 0x92, Data: [2]uint8{60, 100}},
+		{Time: 0, Status: 0x90, Data: [2]uint8{48, 100}},
+		{Time: 96, Status: 0x82, Data: [2]uint8{60, 0}},
+		metaEvent(t, 96, Tempo(400000)),
+		{Time: 192, Status: 0x80, Data: [2]uint8{48, 0}},
+		metaEvent(t, 200, End{}),
+	})
+	for _, format := range []uint16{0, 2} {
+		f := File{
+			Head:   Head{Format: format, TickDivision: 96},
+			Tracks: []Track{tr},
+		}
+		songs, err := f.Songs()
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if len(songs) != 1 {
+			t.Fatalf("format %d: got %d songs, expect 1", format, len(songs))
+		}
+		sn := songs[0]
+		if sn.TickDivision != 96 {
+			t.Errorf("format %d: tick division is %d, expect 96", format, sn.TickDivision)
+		}
+		expect := [][]Event{
+			{
+				metaEvent(t, 0, TrackName("Song")),
+				metaEvent(t, 0, Tempo(500000)),
+				metaEvent(t, 96, Tempo(400000)),
+				metaEvent(t, 200, End{}),
+			},
+			{
+				metaEvent(t, 0, TrackName("Channel 1")),
+				{Time: 0, Status: 0x90, Data: [2]uint8{48, 100}},
+				{Time: 192, Status: 0x80, Data: [2]uint8{48, 0}},
+				metaEvent(t, 200, End{}),
+			},
+			{
+				metaEvent(t, 0, TrackName("Channel 3")),
+				{Time: 0, Status: 0x92, Data: [2]uint8{60, 100}},
+				{Time: 96, Status: 0x82, Data: [2]uint8{60, 0}},
+				metaEvent(t, 200, End{}),
+			},
+		}
+		if len(sn.Tracks) != len(expect) {
+			t.Fatalf("format %d: got %d tracks, expect %d", format, len(sn.Tracks), len(expect))
+		}
+		for i, tr := range sn.Tracks {
+			events, err := tr.readAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(events, expect[i]) {
+				t.Errorf("format %d: track %d:\ngot:    %v\nexpect: %v", format, i, events, expect[i])
+			}
+		}
+	}
+}
+
+func TestSongsFormat0Bytes(t *testing.T) {
+	// A format 0 track as written by other programs, ending with a standard
+	// end-of-track event.
+	data := Track{
+		0x00, 0xff, 0x51, 0x03, 0x07, 0xa1, 0x20,
+		0x00, 0x91, 60, 100,
+		0x00, 0x99, 36, 100,
+		0x60, 0x81, 60, 0,
+		0x00, 0x89, 36, 0,
+		0x00, 0xff, 0x2f, 0x00,
+	}
+	f := File{
+		Head:   Head{Format: 0, TickDivision: 96},
+		Tracks: []Track{data},
+	}
+	songs, err := f.Songs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 1 {
+		t.Fatalf("got %d songs, expect 1", len(songs))
+	}
+	tracks := songs[0].Tracks
+	if len(tracks) != 3 {
+		t.Fatalf("got %d tracks, expect 3", len(tracks))
+	}
+	for i, tr := range tracks {
+		if !bytes.HasSuffix(tr, []byte{0xff, 0x2f, 0x00}) {
+			t.Errorf("track %d: got % x, expect it to end with ff 2f 00", i, []byte(tr))
+		}
+		events, err := tr.readAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := events[len(events)-1]
+		if m, err := last.ParseMeta(); err != nil || m != (End{}) || last.Time != 96 {
+			t.Errorf("track %d: last event is %v at %d, expect End at 96", i, m, last.Time)
+		}
+	}
+	m, err := songs[0].TempoMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := m.Seconds(96); s != 0.5 {
+		t.Errorf("end is at %v seconds, expect 0.5", s)
+	}
+}
@@ -0,0 +1,213 @@
+package midi
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// DefaultTempo is the tempo of a MIDI file with no tempo events, 120 quarter
+// notes per minute.
+const DefaultTempo Tempo = 500000
+
+// DefaultTimeSignature is the time signature of a MIDI file with no time
+// signature events, 4/4.
+var DefaultTimeSignature = TimeSignature{
+	Numerator:         4,
+	DenominatorLog2:   2,
+	MetronomeInterval: 24,
+	QuarterNote:       8,
+}
+
+// A TempoChange is a tempo event in a tempo map.
+type TempoChange struct {
+	Time     uint32 // Time of the change, in ticks.
+	Tempo    Tempo
+	seconds  float64
+	quarters float64
+}
+
+// A MeterChange is a time signature event in a tempo map.
+type MeterChange struct {
+	Time          uint32 // Time of the change, in ticks.
+	TimeSignature TimeSignature
+	Measure       int // Index of the first measure with this time signature.
+	quarters      float64
+}
+
+// beatLength returns the length of a beat, in quarter notes.
+func (c *MeterChange) beatLength() float64 {
+	return 4 / float64(uint32(1)<<c.TimeSignature.DenominatorLog2)
+}
+
+// A Position is a musical position in a MIDI file.
+type Position struct {
+	Measure int     // Measure, counting from zero.
+	Beat    float64 // Beat within the measure, counting from zero.
+}
+
+// String returns the position as "measure:beat", counting from one.
+func (p Position) String() string {
+	beat := math.Round(p.Beat*1e6) / 1e6
+	return strconv.Itoa(p.Measure+1) + ":" + strconv.FormatFloat(beat+1, 'f', -1, 64)
+}
+
+// A TempoMap contains the tempo and time signature changes in a MIDI song, and
+// converts times in ticks to seconds and musical positions. The first tempo
+// and meter change are always at time 0. Both metrical and timecode tick
+// divisions are supported.
+type TempoMap struct {
+	TickDivision uint16
+	Tempos       []TempoChange
+	Meters       []MeterChange
+
+	ticksPerQuarter float64 // Zero for timecode.
+	ticksPerSecond  float64 // Zero for metrical divisions.
+}
+
+// IsTimecode returns true if the tick division is an SMPTE timecode, measuring
+// ticks per second rather than ticks per quarter note.
+func (m *TempoMap) IsTimecode() bool {
+	return m.TickDivision&0x8000 != 0
+}
+
+// NewTempoMap returns the tempo map for a song with the given tick division
+// and conductor track. If the track has no tempo or time signature at the
+// start, the defaults are used. If there are multiple changes at the same
+// time, the last one is used.
+func NewTempoMap(division uint16, conductor Track) (*TempoMap, error) {
+	m := TempoMap{TickDivision: division}
+	if m.IsTimecode() {
+		var fps float64
+		switch -int8(division >> 8) {
+		case 24:
+			fps = 24
+		case 25:
+			fps = 25
+		case 29:
+			fps = 30000.0 / 1001
+		case 30:
+			fps = 30
+		default:
+			return nil, fmt.Errorf("invalid timecode frame rate: %d", -int8(division>>8))
+		}
+		tpf := division & 0xff
+		if tpf == 0 {
+			return nil, errors.New("invalid timecode: 0 ticks per frame")
+		}
+		m.ticksPerSecond = fps * float64(tpf)
+	} else {
+		if division == 0 {
+			return nil, errors.New("invalid tick division: 0")
+		}
+		m.ticksPerQuarter = float64(division)
+	}
+	events, err := conductor.readAll()
+	if err != nil {
+		return nil, err
+	}
+	m.Tempos = []TempoChange{{Tempo: DefaultTempo}}
+	m.Meters = []MeterChange{{TimeSignature: DefaultTimeSignature}}
+	for _, e := range events {
+		if !e.IsMeta() || (e.Data[0] != 0x51 && e.Data[0] != 0x58) {
+			continue
+		}
+		me, err := e.ParseMeta()
+		if err != nil {
+			return nil, err
+		}
+		switch me := me.(type) {
+		case Tempo:
+			if me == 0 {
+				return nil, errors.New("invalid tempo: 0")
+			}
+			c := TempoChange{Time: e.Time, Tempo: me}
+			if n := len(m.Tempos); m.Tempos[n-1].Time == e.Time {
+				m.Tempos[n-1] = c
+			} else {
+				m.Tempos = append(m.Tempos, c)
+			}
+		case TimeSignature:
+			if me.Numerator == 0 || me.DenominatorLog2 > 8 {
+				return nil, fmt.Errorf("invalid time signature: %d/2^%d", me.Numerator, me.DenominatorLog2)
+			}
+			c := MeterChange{Time: e.Time, TimeSignature: me}
+			if n := len(m.Meters); m.Meters[n-1].Time == e.Time {
+				m.Meters[n-1] = c
+			} else {
+				m.Meters = append(m.Meters, c)
+			}
+		}
+	}
+	for i := 1; i < len(m.Tempos); i++ {
+		c, prev := &m.Tempos[i], &m.Tempos[i-1]
+		c.seconds = m.segmentSeconds(prev, c.Time)
+		c.quarters = m.segmentQuarters(prev, c.Time)
+	}
+	for i := 1; i < len(m.Meters); i++ {
+		c, prev := &m.Meters[i], &m.Meters[i-1]
+		c.quarters = m.quarters(c.Time)
+		// A change in the middle of a measure starts a new measure.
+		n := (c.quarters - prev.quarters) / (prev.beatLength() * float64(prev.TimeSignature.Numerator))
+		c.Measure = prev.Measure + int(math.Ceil(n-1e-9))
+	}
+	return &m, nil
+}
+
+// TempoMap returns the tempo map for the song, from its conductor track.
+func (sn *Song) TempoMap() (*TempoMap, error) {
+	if len(sn.Tracks) == 0 {
+		return nil, errors.New("song has no tracks")
+	}
+	return NewTempoMap(sn.TickDivision, sn.Tracks[0])
+}
+
+// tempoAt returns the tempo change in effect at the given time.
+func (m *TempoMap) tempoAt(time uint32) *TempoChange {
+	i := sort.Search(len(m.Tempos), func(i int) bool { return m.Tempos[i].Time > time })
+	return &m.Tempos[i-1]
+}
+
+// segmentSeconds returns the time in seconds, given the tempo change in effect.
+func (m *TempoMap) segmentSeconds(c *TempoChange, time uint32) float64 {
+	if m.ticksPerSecond != 0 {
+		return float64(time) / m.ticksPerSecond
+	}
+	return c.seconds + float64(time-c.Time)/m.ticksPerQuarter*float64(c.Tempo)*1e-6
+}
+
+// segmentQuarters returns the time in quarter notes, given the tempo change in
+// effect.
+func (m *TempoMap) segmentQuarters(c *TempoChange, time uint32) float64 {
+	if m.ticksPerSecond != 0 {
+		return c.quarters + (m.segmentSeconds(c, time)-c.seconds)*1e6/float64(c.Tempo)
+	}
+	return float64(time) / m.ticksPerQuarter
+}
+
+// quarters returns the number of quarter notes from the start to the given
+// time.
+func (m *TempoMap) quarters(time uint32) float64 {
+	return m.segmentQuarters(m.tempoAt(time), time)
+}
+
+// Seconds converts a time in ticks to seconds.
+func (m *TempoMap) Seconds(time uint32) float64 {
+	return m.segmentSeconds(m.tempoAt(time), time)
+}
+
+// Position converts a time in ticks to a musical position.
+func (m *TempoMap) Position(time uint32) Position {
+	i := sort.Search(len(m.Meters), func(i int) bool { return m.Meters[i].Time > time })
+	c := &m.Meters[i-1]
+	beats := (m.quarters(time) - c.quarters) / c.beatLength()
+	num := float64(c.TimeSignature.Numerator)
+	measures := math.Floor(beats/num + 1e-9)
+	beat := beats - measures*num
+	if beat < 0 {
+		beat = 0
+	}
+	return Position{Measure: c.Measure + int(measures), Beat: beat}
+}
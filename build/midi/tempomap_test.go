@@ -0,0 +1,88 @@
+package midi
+
+import (
+	"math"
+	"testing"
+)
+
+type tempoMapCase struct {
+	time     uint32
+	seconds  float64
+	position string
+}
+
+func checkTempoMap(t *testing.T, m *TempoMap, cases []tempoMapCase) {
+	t.Helper()
+	for _, c := range cases {
+		if s := m.Seconds(c.time); math.Abs(s-c.seconds) > 1e-9 {
+			t.Errorf("Seconds(%d) = %v, expect %v", c.time, s, c.seconds)
+		}
+		if p := m.Position(c.time).String(); p != c.position {
+			t.Errorf("Position(%d) = %s, expect %s", c.time, p, c.position)
+		}
+	}
+}
+
+func TestTempoMap(t *testing.T) {
+	tr := encodeEvents(t, []Event{
+		metaEvent(t, 0, TimeSignature{3, 2, 24, 8}),
+		metaEvent(t, 0, Tempo(1000000)),
+		// Three measures of 3/4 at 60 quarter notes per minute.
+		metaEvent(t, 3*3*96, Tempo(500000)),
+		// Change in the middle of the fifth measure.
+		metaEvent(t, 4*3*96+96, TimeSignature{6, 3, 36, 8}),
+	})
+	m, err := NewTempoMap(96, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.IsTimecode() {
+		t.Error("IsTimecode() = true")
+	}
+	checkTempoMap(t, m, []tempoMapCase{
+		{0, 0, "1:1"},
+		{48, 0.5, "1:1.5"},
+		{3*96 + 24, 3.25, "2:1.25"},
+		{9 * 96, 9, "4:1"},
+		{10 * 96, 9.5, "4:2"},
+		{12*96 + 48, 10.75, "5:1.5"},
+		{13 * 96, 11, "6:1"},
+		{13*96 + 48, 11.25, "6:2"},
+		{13*96 + 6*48, 12.5, "7:1"},
+	})
+}
+
+func TestTempoMapDefault(t *testing.T) {
+	m, err := NewTempoMap(480, encodeEvents(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTempoMap(t, m, []tempoMapCase{
+		{0, 0, "1:1"},
+		{480, 0.5, "1:2"},
+		{8 * 480, 4, "3:1"},
+	})
+}
+
+func TestTempoMapTimecode(t *testing.T) {
+	tr := encodeEvents(t, []Event{
+		metaEvent(t, 0, Tempo(500000)),
+		// One measure of 4/4 at 120 quarter notes per minute.
+		metaEvent(t, 2*25*40, Tempo(250000)),
+	})
+	// 25 frames per second, 40 ticks per frame.
+	m, err := NewTempoMap(uint16(0x10000-25<<8|40), tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsTimecode() {
+		t.Error("IsTimecode() = false")
+	}
+	checkTempoMap(t, m, []tempoMapCase{
+		{0, 0, "1:1"},
+		{500, 0.5, "1:2"},
+		{2000, 2, "2:1"},
+		{2500, 2.5, "2:3"},
+		{3000, 3, "3:1"},
+	})
+}
@@ -0,0 +1,163 @@
+package midi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// maxVar is the largest value which can be stored as a variable-length
+// quantity, which is at most four bytes long.
+const maxVar = 1<<28 - 1
+
+// appendVar appends a variable-length quantity to a buffer. The quantity must
+// not be larger than maxVar.
+func appendVar(b []byte, q uint32) []byte {
+	var tmp [5]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(q & 0x7f)
+	for q >>= 7; q != 0; q >>= 7 {
+		i--
+		tmp[i] = byte(q&0x7f) | 0x80
+	}
+	return append(b, tmp[i:]...)
+}
+
+// MetaEvent returns an event containing a meta event at the given time.
+func MetaEvent(time uint32, m Meta) (Event, error) {
+	e := Event{Time: time, Status: 0xff}
+	switch m := m.(type) {
+	case Text:
+		e.Data[0] = 0x01
+		e.VData = copyBytes(m)
+	case Copyright:
+		e.Data[0] = 0x02
+		e.VData = copyBytes(m)
+	case TrackName:
+		e.Data[0] = 0x03
+		e.VData = copyBytes(m)
+	case InstrumentName:
+		e.Data[0] = 0x04
+		e.VData = copyBytes(m)
+	case ChannelPrefix:
+		if m > 15 {
+			return e, fmt.Errorf("invalid channel prefix: %d", m)
+		}
+		e.Data[0] = 0x20
+		e.VData = []byte{byte(m)}
+	case Tempo:
+		if m == 0 || m > 0xffffff {
+			return e, fmt.Errorf("tempo out of range: %d", m)
+		}
+		e.Data[0] = 0x51
+		e.VData = []byte{byte(m >> 16), byte(m >> 8), byte(m)}
+	case TimeSignature:
+		e.Data[0] = 0x58
+		e.VData = []byte{m.Numerator, m.DenominatorLog2, m.MetronomeInterval, m.QuarterNote}
+	case KeySignature:
+		e.Data[0] = 0x59
+		e.VData = []byte{byte(m.SharpsFlats), m.IsMinor}
+	case End:
+		e.Data[0] = 0x2f
+	default:
+		return e, fmt.Errorf("unknown meta event: %v", m)
+	}
+	return e, nil
+}
+
+// dataLength returns the number of data bytes for a channel message with the
+// given status.
+func dataLength(status uint8) int {
+	switch EventType(status >> 4) {
+	case ProgramChange, ChannelTouch:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// EncodeTrack encodes a sequence of events as a track. The events must be in
+// order by time. Channel messages use running status. If the last event is not
+// an End event, one is added at the time of the last event.
+func EncodeTrack(events []Event) (Track, error) {
+	var b []byte
+	var time uint32
+	var status uint8
+	var ended bool
+	for i, e := range events {
+		if ended {
+			return nil, errors.New("events after end of track")
+		}
+		if e.Time < time {
+			return nil, fmt.Errorf("event %d: out of order", i)
+		}
+		if e.Time-time > maxVar {
+			return nil, fmt.Errorf("event %d: delta time too large: %d", i, e.Time-time)
+		}
+		if len(e.VData) > maxVar {
+			return nil, fmt.Errorf("event %d: data too long", i)
+		}
+		b = appendVar(b, e.Time-time)
+		time = e.Time
+		switch {
+		case e.Status == 0xff:
+			if e.Data[0]&0x80 != 0 {
+				return nil, fmt.Errorf("event %d: invalid meta event type: %d", i, e.Data[0])
+			}
+			b = append(b, 0xff, e.Data[0])
+			b = appendVar(b, uint32(len(e.VData)))
+			b = append(b, e.VData...)
+			// The reader does not continue running status after a meta or
+			// SysEx event.
+			status = 0
+			ended = e.Data[0] == 0x2f
+		case e.IsSysEx():
+			b = append(b, e.Status)
+			b = appendVar(b, uint32(len(e.VData)))
+			b = append(b, e.VData...)
+			status = 0
+		case 0x80 <= e.Status && e.Status < 0xf0:
+			if e.Status != status {
+				b = append(b, e.Status)
+				status = e.Status
+			}
+			n := dataLength(e.Status)
+			for _, x := range e.Data[:n] {
+				if x&0x80 != 0 {
+					return nil, fmt.Errorf("event %d: invalid data: %v", i, e)
+				}
+			}
+			b = append(b, e.Data[:n]...)
+		default:
+			return nil, fmt.Errorf("event %d: unsupported status: 0x%02x", i, e.Status)
+		}
+	}
+	if !ended {
+		b = appendVar(b, 0)
+		b = append(b, 0xff, 0x2f, 0)
+	}
+	return Track(b), nil
+}
+
+// appendChunk appends a chunk with the given ID and data to a buffer.
+func appendChunk(b []byte, id string, data []byte) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	b = append(b, id...)
+	b = append(b, n[:]...)
+	return append(b, data...)
+}
+
+// Encode returns the contents of a MIDI file. The track count in the header
+// is ignored, and the number of tracks is written instead.
+func (f *File) Encode() []byte {
+	var h [6]byte
+	binary.BigEndian.PutUint16(h[0:], f.Head.Format)
+	binary.BigEndian.PutUint16(h[2:], uint16(len(f.Tracks)))
+	binary.BigEndian.PutUint16(h[4:], f.Head.TickDivision)
+	b := appendChunk(nil, "MThd", h[:])
+	for _, t := range f.Tracks {
+		b = appendChunk(b, "MTrk", t)
+	}
+	return b
+}
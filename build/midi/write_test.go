@@ -0,0 +1,160 @@
+package midi
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAppendVar(t *testing.T) {
+	cases := []struct {
+		value  uint32
+		expect []byte
+	}{
+		{0, []byte{0x00}},
+		{0x40, []byte{0x40}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0x81, 0x00}},
+		{0x2000, []byte{0xc0, 0x00}},
+		{0x3fff, []byte{0xff, 0x7f}},
+		{0x4000, []byte{0x81, 0x80, 0x00}},
+		{maxVar, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, c := range cases {
+		b := appendVar(nil, c.value)
+		if !bytes.Equal(b, c.expect) {
+			t.Errorf("appendVar(0x%x) = % x, expect % x", c.value, b, c.expect)
+		}
+		s := EventStream{data: b}
+		if q, err := s.readVar(); err != nil || q != c.value {
+			t.Errorf("readVar(% x) = 0x%x, %v, expect 0x%x", b, q, err, c.value)
+		}
+	}
+}
+
+func TestRunningStatus(t *testing.T) {
+	tr, err := EncodeTrack([]Event{
+		{Time: 0, Status: 0x90, Data: [2]uint8{60, 100}},
+		{Time: 0, Status: 0x90, Data: [2]uint8{64, 100}},
+		{Time: 96, Status: 0x80, Data: [2]uint8{60, 0}},
+		{Time: 96, Status: 0x80, Data: [2]uint8{64, 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []byte{
+		0x00, 0x90, 60, 100,
+		0x00, 64, 100,
+		0x60, 0x80, 60, 0,
+		0x00, 64, 0,
+		0x00, 0xff, 0x2f, 0x00,
+	}
+	if !bytes.Equal(tr, expect) {
+		t.Errorf("got % x, expect % x", []byte(tr), expect)
+	}
+}
+
+func TestEncodeEnd(t *testing.T) {
+	note := Event{Time: 0, Status: 0x90, Data: [2]uint8{60, 100}}
+	end, err := MetaEvent(96, End{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, events := range [][]Event{{note}, {note, end}} {
+		tr, err := EncodeTrack(events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(tr); n < 3 || !bytes.Equal(tr[n-3:], []byte{0xff, 0x2f, 0x00}) {
+			t.Errorf("%d events: track is % x, expect it to end with ff 2f 00", len(events), []byte(tr))
+		}
+		got, err := tr.readAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, err := got[len(got)-1].ParseMeta(); err != nil || m != (End{}) {
+			t.Errorf("%d events: last event is %v, %v, expect End", len(events), m, err)
+		}
+	}
+}
+
+func TestEncodeLongDelta(t *testing.T) {
+	for _, time := range []uint32{maxVar + 1, 0xffffffff} {
+		_, err := EncodeTrack([]Event{
+			{Time: 0, Status: 0x90, Data: [2]uint8{60, 100}},
+			{Time: time, Status: 0x80, Data: [2]uint8{60, 0}},
+		})
+		if err == nil {
+			t.Errorf("time %d: no error", time)
+		}
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	var events []Event
+	for _, m := range []Meta{
+		TrackName("Lead"),
+		Tempo(500000),
+		TimeSignature{3, 2, 24, 8},
+		KeySignature{-3, 1},
+	} {
+		e, err := MetaEvent(0, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	events = append(events,
+		Event{Time: 0, Status: 0xf0, VData: []byte{0x7e, 0x7f, 0x09, 0x01, 0xf7}},
+		Event{Time: 0, Status: 0xc1, Data: [2]uint8{33, 0}},
+		Event{Time: 0, Status: 0xb1, Data: [2]uint8{7, 90}},
+		Event{Time: 0, Status: 0xb1, Data: [2]uint8{10, 32}},
+		Event{Time: 0, Status: 0x91, Data: [2]uint8{60, 100}},
+		Event{Time: 0, Status: 0x91, Data: [2]uint8{67, 80}},
+		Event{Time: 480, Status: 0x81, Data: [2]uint8{60, 64}},
+		Event{Time: 480, Status: 0x81, Data: [2]uint8{67, 64}},
+		Event{Time: 500, Status: 0xe1, Data: [2]uint8{0, 64}},
+		Event{Time: 20000, Status: 0xd1, Data: [2]uint8{50, 0}},
+		Event{Time: 20000, Status: 0x91, Data: [2]uint8{72, 127}},
+		Event{Time: 200000, Status: 0x91, Data: [2]uint8{72, 0}},
+	)
+	end, err := MetaEvent(200000, End{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = append(events, end)
+	tr, err := EncodeTrack(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := File{
+		Head:   Head{Format: 1, TickDivision: 480},
+		Tracks: []Track{tr, tr},
+	}
+	f2, err := Parse(f.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHead := Head{Format: 1, TrackCount: 2, TickDivision: 480}
+	if f2.Head != expectHead {
+		t.Errorf("head is %+v, expect %+v", f2.Head, expectHead)
+	}
+	if len(f2.Tracks) != 2 {
+		t.Fatalf("got %d tracks, expect 2", len(f2.Tracks))
+	}
+	got, err := f2.Tracks[1].readAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, events) {
+		t.Errorf("got events:\n%v\nexpect:\n%v", got, events)
+	}
+	m, err := got[1].ParseMeta()
+	if err != nil || m != Tempo(500000) {
+		t.Errorf("got tempo %v, %v, expect %v", m, err, Tempo(500000))
+	}
+	m, err = got[3].ParseMeta()
+	if err != nil || m != (KeySignature{-3, 1}) {
+		t.Errorf("got key signature %v, %v", m, err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"moria.us/js13k/build/midi"
+	"moria.us/js13k/build/song"
+)
+
+// MIDI controller numbers.
+const (
+	controllerVolume = 7
+	controllerPan    = 10
+)
+
+// percussionChannel is the General MIDI percussion channel, which exported
+// tracks do not use.
+const percussionChannel = 9
+
+// midiTicksPerQuarter returns the MIDI resolution for a song, in ticks per
+// quarter note, and the number of MIDI ticks in each of the song's divisions.
+// The resolution is a multiple of 96, so the notes can be extracted again with
+// the default grid.
+func midiTicksPerQuarter(division int) (tpq, scale int, err error) {
+	if division <= 0 {
+		return 0, 0, fmt.Errorf("invalid division: %d", division)
+	}
+	tpq = 96
+	for (4*tpq)%division != 0 {
+		tpq += 96
+	}
+	if tpq > 0x7fff {
+		return 0, 0, fmt.Errorf("division %d is too fine for MIDI", division)
+	}
+	return tpq, 4 * tpq / division, nil
+}
+
+// volumeController returns the value of the volume controller for a gain.
+func volumeController(gainDB float64) uint8 {
+	x := math.Round(127 * math.Pow(10, gainDB/40))
+	if x > 127 {
+		x = 127
+	}
+	return uint8(x)
+}
+
+// panController returns the value of the pan controller for a pan.
+func panController(pan float64) uint8 {
+	x := 64 + 64*pan
+	if pan > 0 {
+		x = 64 + 63*pan
+	}
+	x = math.Round(x)
+	if x < 0 {
+		x = 0
+	} else if x > 127 {
+		x = 127
+	}
+	return uint8(x)
+}
+
+// Order of MIDI events which happen at the same time.
+const (
+	orderMeta = iota
+	orderNoteOff
+	orderController
+	orderNoteOn
+)
+
+// An eventList is a list of MIDI events in a track, which are sorted before
+// they are written.
+type eventList struct {
+	events []midi.Event
+	order  []int
+}
+
+func (l *eventList) add(order int, e midi.Event) {
+	l.events = append(l.events, e)
+	l.order = append(l.order, order)
+}
+
+func (l *eventList) meta(time uint32, m midi.Meta) error {
+	e, err := midi.MetaEvent(time, m)
+	if err != nil {
+		return err
+	}
+	l.add(orderMeta, e)
+	return nil
+}
+
+func (l *eventList) Len() int { return len(l.events) }
+func (l *eventList) Less(i, j int) bool {
+	a, b := &l.events[i], &l.events[j]
+	if a.Time != b.Time {
+		return a.Time < b.Time
+	}
+	return l.order[i] < l.order[j]
+}
+func (l *eventList) Swap(i, j int) {
+	l.events[i], l.events[j] = l.events[j], l.events[i]
+	l.order[i], l.order[j] = l.order[j], l.order[i]
+}
+
+// encode sorts the events and encodes them as a track, ending at the given
+// time or after the last event.
+func (l *eventList) encode(end uint32) (midi.Track, error) {
+	sort.Stable(l)
+	if n := len(l.events); n != 0 && l.events[n-1].Time > end {
+		end = l.events[n-1].Time
+	}
+	if err := l.meta(end, midi.End{}); err != nil {
+		return nil, err
+	}
+	return midi.EncodeTrack(l.events)
+}
+
+// addAutomation adds controller events for a track's gain or pan automation,
+// with offset added to the value of each point. Ramps are approximated by an
+// event each time the controller value changes, checking once per division.
+func (l *eventList) addAutomation(sn *song.Song, points []song.AutomationPoint, initial, offset float64, isGain bool, channel uint8, scale int) {
+	control := uint8(controllerPan)
+	value := panController
+	if isGain {
+		control = controllerVolume
+		value = volumeController
+	}
+	last := value(initial)
+	emit := func(tick int, x float64) {
+		if v := value(x); v != last {
+			l.add(orderController, midi.Event{
+				Time:   uint32(tick * scale),
+				Status: uint8(midi.Controller)<<4 | channel,
+				Data:   [2]uint8{control, v},
+			})
+			last = v
+		}
+	}
+	prevTick, prev := 0, initial
+	for _, p := range points {
+		tick := sn.Tick(p.Measure, p.Offset)
+		value := p.Value + offset
+		if p.Ramp != song.RampStep {
+			for t := prevTick + 1; t < tick; t++ {
+				f := float64(t-prevTick) / float64(tick-prevTick)
+				if isGain && p.Ramp == song.RampLinear {
+					// Linear in amplitude.
+					a0, a1 := math.Pow(10, prev/20), math.Pow(10, value/20)
+					emit(t, 20*math.Log10(a0+(a1-a0)*f))
+				} else {
+					emit(t, prev+(value-prev)*f)
+				}
+			}
+		}
+		emit(tick, value)
+		prevTick, prev = tick, value
+	}
+}
+
+// midiTimeSignature returns the MIDI time signature event for a time
+// signature.
+func midiTimeSignature(t song.TimeSignature) midi.TimeSignature {
+	return midi.TimeSignature{
+		Numerator:         uint8(t.Numerator),
+		DenominatorLog2:   uint8(t.DenominatorLog2),
+		MetronomeInterval: uint8(96 >> t.DenominatorLog2),
+		QuarterNote:       8,
+	}
+}
+
+// midiTempo returns the MIDI tempo event for a tempo, in quarter notes per
+// minute.
+func midiTempo(tempo float64) midi.Tempo {
+	return midi.Tempo(math.Round(60e6 / tempo))
+}
+
+// songToMIDI converts a song to a format 1 MIDI file. The first track contains
+// the song's tempo and time signatures, and is followed by one track for each
+// track in the song, each on its own channel. Track gain, including the song's
+// gain, and pan are written as volume and pan controllers, and drum tracks are
+// written using the notes in the song's kit. Constant durations are not
+// represented, so notes last for their written duration.
+func songToMIDI(sn *song.Song) (*midi.File, error) {
+	tpq, scale, err := midiTicksPerQuarter(sn.Info.Division)
+	if err != nil {
+		return nil, err
+	}
+	length := sn.Info.Duration
+	if length == 0 {
+		for _, tr := range sn.Tracks {
+			var n int
+			for _, nn := range tr.Notes {
+				n += int(nn.Duration)
+			}
+			if n > length {
+				length = n
+			}
+		}
+	}
+	end := uint32(length * scale)
+	var conductor eventList
+	if err := conductor.meta(0, midi.TrackName(sn.Info.Name)); err != nil {
+		return nil, err
+	}
+	if err := conductor.meta(0, midiTimeSignature(sn.Info.Time)); err != nil {
+		return nil, err
+	}
+	if err := conductor.meta(0, midiTempo(sn.Info.Tempo)); err != nil {
+		return nil, err
+	}
+	for _, c := range sn.TempoMap {
+		time := uint32(sn.Tick(c.Measure, c.Offset) * scale)
+		if c.Time.Numerator != 0 {
+			if err := conductor.meta(time, midiTimeSignature(c.Time)); err != nil {
+				return nil, err
+			}
+		}
+		if c.Tempo != 0 {
+			if err := conductor.meta(time, midiTempo(c.Tempo)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ctrack, err := conductor.encode(end)
+	if err != nil {
+		return nil, err
+	}
+	f := midi.File{
+		Head:   midi.Head{Format: 1, TickDivision: uint16(tpq)},
+		Tracks: []midi.Track{ctrack},
+	}
+	for i, tr := range sn.Tracks {
+		channel := i
+		if channel >= percussionChannel {
+			channel++
+		}
+		if channel > 15 {
+			return nil, errors.New("too many tracks, MIDI files have only 15 channels for instruments")
+		}
+		ch := uint8(channel)
+		var l eventList
+		if err := l.meta(0, midi.TrackName(tr.Name)); err != nil {
+			return nil, err
+		}
+		if tr.Instrument != "" {
+			if err := l.meta(0, midi.InstrumentName(tr.Instrument)); err != nil {
+				return nil, err
+			}
+		}
+		controller := func(control, value uint8) {
+			l.add(orderController, midi.Event{
+				Status: uint8(midi.Controller)<<4 | ch,
+				Data:   [2]uint8{control, value},
+			})
+		}
+		gain := sn.Info.GainDB + tr.GainDB
+		controller(controllerVolume, volumeController(gain))
+		controller(controllerPan, panController(tr.Pan))
+		l.addAutomation(sn, tr.GainAutomation, gain, sn.Info.GainDB, true, ch, scale)
+		l.addAutomation(sn, tr.PanAutomation, tr.Pan, 0, false, ch, scale)
+		var tick int
+		for _, n := range tr.Notes {
+			start := tick
+			tick += int(n.Duration)
+			if n.IsRest {
+				continue
+			}
+			vel := n.Velocity
+			if vel == 0 {
+				vel = song.DefaultVelocity
+			}
+			var values []uint8
+			for _, v := range n.Value {
+				if v == 0 {
+					break
+				}
+				if tr.Drums {
+					if int(v) > len(sn.Kit) {
+						return nil, fmt.Errorf("track %q: invalid drum: %d", tr.Name, v)
+					}
+					v = sn.Kit[v-1].Value
+				}
+				var dup bool
+				for _, x := range values {
+					if x == v {
+						dup = true
+					}
+				}
+				if !dup {
+					values = append(values, v)
+				}
+			}
+			for _, v := range values {
+				if v > 127 {
+					return nil, fmt.Errorf("track %q: note out of range: %d", tr.Name, v)
+				}
+				l.add(orderNoteOn, midi.Event{
+					Time:   uint32(start * scale),
+					Status: uint8(midi.NoteOn)<<4 | ch,
+					Data:   [2]uint8{v, vel},
+				})
+				l.add(orderNoteOff, midi.Event{
+					Time:   uint32(tick * scale),
+					Status: uint8(midi.NoteOff)<<4 | ch,
+					Data:   [2]uint8{v, 0},
+				})
+			}
+		}
+		t, err := l.encode(end)
+		if err != nil {
+			return nil, fmt.Errorf("track %q: %v", tr.Name, err)
+		}
+		f.Tracks = append(f.Tracks, t)
+	}
+	return &f, nil
+}
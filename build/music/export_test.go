@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"moria.us/js13k/build/midi"
+	"moria.us/js13k/build/song"
+)
+
+const exportSong = `@info
+name: Export
+tempo: 120
+division: 16
+gain: -6
+
+@tempo
+
+2 tempo=90
+
+@kit
+kick: Drums c2
+hat: Drums f#2
+
+@track
+name: Lead
+instrument: Lead
+gain: -3
+pan: 0.5
+
+c4e4g4.4 d4.4> r4 e4.4 |
+c4.16                  |
+
+@automation
+
+2 gain=-12
+
+@track
+name: Beat
+kind: drums
+
+kick.4 hat.4 kick+hat.4 hat.4 |
+kick.8 r8                     |
+`
+
+// trackEvents returns the events in a MIDI track.
+func trackEvents(t *testing.T, tr midi.Track) []midi.Event {
+	t.Helper()
+	var events []midi.Event
+	evs := tr.Events()
+	for {
+		e, err := evs.Next()
+		if err != nil {
+			if err == io.EOF {
+				return events
+			}
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+}
+
+// exportFile exports a song to MIDI, and parses the encoded file. Checks that
+// every track ends with a standard end-of-track event, FF 2F 00.
+func exportFile(t *testing.T, sn *song.Song) *midi.File {
+	t.Helper()
+	f, err := songToMIDI(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = midi.Parse(f.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tr := range f.Tracks {
+		if !bytes.HasSuffix(tr, []byte{0xff, 0x2f, 0x00}) {
+			t.Errorf("track %d does not end with ff 2f 00: % x", i, []byte(tr))
+		}
+	}
+	return f
+}
+
+func TestExportMIDI(t *testing.T) {
+	sn, err := song.Parse([]byte(exportSong))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := exportFile(t, sn)
+	// 96 ticks per quarter note, and 24 ticks per division.
+	if f.Head.Format != 1 || f.Head.TickDivision != 96 {
+		t.Errorf("header is %+v, expect format 1 with 96 ticks per quarter note", f.Head)
+	}
+	if len(f.Tracks) != 3 {
+		t.Fatalf("got %d tracks, expect 3", len(f.Tracks))
+	}
+	const end = 2 * 16 * 24
+	meta := func(time uint32, m midi.Meta) midi.Event {
+		e, err := midi.MetaEvent(time, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	note := func(time uint32, on bool, ch, value, vel uint8) midi.Event {
+		status := uint8(midi.NoteOff)<<4 | ch
+		if on {
+			status = uint8(midi.NoteOn)<<4 | ch
+		}
+		return midi.Event{Time: time, Status: status, Data: [2]uint8{value, vel}}
+	}
+	controller := func(time uint32, ch, control, value uint8) midi.Event {
+		return midi.Event{Time: time, Status: uint8(midi.Controller)<<4 | ch, Data: [2]uint8{control, value}}
+	}
+
+	conductor := []midi.Event{
+		meta(0, midi.TrackName("Export")),
+		meta(0, midi.TimeSignature{Numerator: 4, DenominatorLog2: 2, MetronomeInterval: 24, QuarterNote: 8}),
+		meta(0, midi.Tempo(500000)),
+		meta(16*24, midi.Tempo(666667)),
+		meta(end, midi.End{}),
+	}
+	if events := trackEvents(t, f.Tracks[0]); !reflect.DeepEqual(events, conductor) {
+		t.Errorf("conductor track:\ngot:    %v\nexpect: %v", events, conductor)
+	}
+
+	// The lead track's gain includes the song's gain, and ramps from -9 dB to
+	// -18 dB over the first measure.
+	var lead, volume []midi.Event
+	for _, e := range trackEvents(t, f.Tracks[1]) {
+		if e.Status == uint8(midi.Controller)<<4 && e.Data[0] == controllerVolume {
+			volume = append(volume, e)
+		} else {
+			lead = append(lead, e)
+		}
+	}
+	expectLead := []midi.Event{
+		meta(0, midi.TrackName("Lead")),
+		meta(0, midi.InstrumentName("Lead")),
+		controller(0, 0, controllerPan, 96),
+		note(0, true, 0, 60, 100),
+		note(0, true, 0, 64, 100),
+		note(0, true, 0, 67, 100),
+		note(96, false, 0, 60, 0),
+		note(96, false, 0, 64, 0),
+		note(96, false, 0, 67, 0),
+		note(96, true, 0, 62, 127),
+		note(192, false, 0, 62, 0),
+		note(288, true, 0, 64, 100),
+		note(384, false, 0, 64, 0),
+		note(384, true, 0, 60, 100),
+		note(end, false, 0, 60, 0),
+		meta(end, midi.End{}),
+	}
+	if !reflect.DeepEqual(lead, expectLead) {
+		t.Errorf("lead track:\ngot:    %v\nexpect: %v", lead, expectLead)
+	}
+	if len(volume) < 3 {
+		t.Fatalf("got %d volume events, expect a ramp", len(volume))
+	}
+	if v := volume[0]; v.Time != 0 || v.Data[1] != volumeController(-9) {
+		t.Errorf("initial volume is %v, expect %d at 0", v, volumeController(-9))
+	}
+	if v := volume[len(volume)-1]; v.Time != 16*24 || v.Data[1] != volumeController(-18) {
+		t.Errorf("final volume is %v, expect %d at %d", v, volumeController(-18), 16*24)
+	}
+	for i, v := range volume[1:] {
+		if v.Time%24 != 0 || v.Time <= volume[i].Time || v.Data[1] >= volume[i].Data[1] {
+			t.Errorf("volume ramp is not decreasing once per division: %v", volume)
+			break
+		}
+	}
+
+	expectBeat := []midi.Event{
+		meta(0, midi.TrackName("Beat")),
+		controller(0, 1, controllerVolume, volumeController(-6)),
+		controller(0, 1, controllerPan, 64),
+		note(0, true, 1, 36, 100),
+		note(96, false, 1, 36, 0),
+		note(96, true, 1, 42, 100),
+		note(192, false, 1, 42, 0),
+		note(192, true, 1, 36, 100),
+		note(192, true, 1, 42, 100),
+		note(288, false, 1, 36, 0),
+		note(288, false, 1, 42, 0),
+		note(288, true, 1, 42, 100),
+		note(384, false, 1, 42, 0),
+		note(384, true, 1, 36, 100),
+		note(576, false, 1, 36, 0),
+		meta(end, midi.End{}),
+	}
+	if events := trackEvents(t, f.Tracks[2]); !reflect.DeepEqual(events, expectBeat) {
+		t.Errorf("drum track:\ngot:    %v\nexpect: %v", events, expectBeat)
+	}
+}
+
+func TestExportChannels(t *testing.T) {
+	sn := song.Song{
+		Info: song.Info{Name: "Channels", Tempo: 120, Time: song.TimeSignature{Numerator: 4, DenominatorLog2: 2}, Division: 4},
+	}
+	for i := 0; i < 15; i++ {
+		sn.Tracks = append(sn.Tracks, &song.Track{
+			Instrument: "Lead",
+			Notes:      []song.Note{{Value: [song.ChordSize]uint8{60}, Duration: 4}},
+		})
+	}
+	f := exportFile(t, &sn)
+	for i, tr := range f.Tracks[1:] {
+		expect := uint8(i)
+		if i >= 9 {
+			// Skip the percussion channel.
+			expect++
+		}
+		for _, e := range trackEvents(t, tr) {
+			if !e.IsMeta() && e.Status&15 != expect {
+				t.Errorf("track %d: event %v, expect channel %d", i, e, expect)
+				break
+			}
+		}
+	}
+	sn.Tracks = append(sn.Tracks, sn.Tracks[0])
+	if _, err := songToMIDI(&sn); err == nil || !strings.Contains(err.Error(), "too many tracks") {
+		t.Errorf("16 tracks: got error %v, expect too many tracks", err)
+	}
+}
+
+// TestExportExtract checks that notes exported to MIDI are the same when
+// extracted again.
+func TestExportExtract(t *testing.T) {
+	flagGrid = 48
+	flagMinRest = 1
+	flagRepeat = false
+	sn, err := song.Parse([]byte(exportSong))
+	if err != nil {
+		t.Fatal(err)
+	}
+	songs, err := exportFile(t, sn).Songs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tr := range sn.Tracks {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		if err := writeTrackNotes(w, songs[0], tr.Name); err != nil {
+			t.Fatalf("track %q: %v", tr.Name, err)
+		}
+		w.Flush()
+		// The grid is 1/48, three times the song's division.
+		text := "@info\nname: Extracted\ntempo: 120\ndivision: 48\n\n@track\n\n" + buf.String()
+		esn, err := song.Parse([]byte(text))
+		if err != nil {
+			t.Fatalf("track %q: %v\n%s", tr.Name, err, text)
+		}
+		var expect []song.Note
+		for _, n := range tr.Notes {
+			n.Duration *= 3
+			if tr.Drums && !n.IsRest {
+				var value [song.ChordSize]uint8
+				for j, v := range n.Value {
+					if v != 0 {
+						value[j] = sn.Kit[v-1].Value
+					}
+				}
+				n.Value = value
+			}
+			expect = append(expect, n)
+		}
+		if got := esn.Tracks[0].Notes; !reflect.DeepEqual(got, expect) {
+			t.Errorf("track %d %q: extracted\n%s\ngot notes:    %v\nexpect notes: %v", i, tr.Name, buf.String(), got, expect)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/hex"
 	"encoding/json"
@@ -9,16 +10,20 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"moria.us/js13k/build/instrument"
 	"moria.us/js13k/build/midi"
 	"moria.us/js13k/build/song"
+	"moria.us/js13k/build/synth"
 )
 
 var workingDirectory string
@@ -38,6 +43,25 @@ func readMIDI(name string) (*midi.File, error) {
 	return midi.Parse(data)
 }
 
+// flagMIDISong is the index of the song to use in a format 2 MIDI file.
+var flagMIDISong int
+
+// readMIDISong reads a MIDI file and returns the song selected by flagMIDISong.
+func readMIDISong(name string) (*midi.Song, error) {
+	f, err := readMIDI(name)
+	if err != nil {
+		return nil, err
+	}
+	songs, err := f.Songs()
+	if err != nil {
+		return nil, err
+	}
+	if flagMIDISong < 0 || len(songs) <= flagMIDISong {
+		return nil, fmt.Errorf("no song exists numbered %d", flagMIDISong)
+	}
+	return songs[flagMIDISong], nil
+}
+
 func trackName(tr midi.Track) (string, error) {
 	ev := tr.Events()
 	for {
@@ -56,16 +80,16 @@ func trackName(tr midi.Track) (string, error) {
 	}
 }
 
-func findTrack(f *midi.File, name string) (midi.Track, error) {
+func findTrack(sn *midi.Song, name string) (midi.Track, error) {
 	nn, err := strconv.ParseUint(name, 10, strconv.IntSize-1)
 	if err == nil {
 		n := int(nn)
-		if n >= len(f.Tracks) {
+		if n >= len(sn.Tracks) {
 			return nil, fmt.Errorf("no track exists numbered %d", n)
 		}
-		return f.Tracks[n], nil
+		return sn.Tracks[n], nil
 	}
-	for i, tr := range f.Tracks {
+	for i, tr := range sn.Tracks {
 		tname, err := trackName(tr)
 		if err != nil {
 			logrus.Errorf("error in track %d: %v", i, err)
@@ -80,50 +104,40 @@ func findTrack(f *midi.File, name string) (midi.Track, error) {
 
 type global struct {
 	ticksPerQuarter uint32
-	tempo           midi.Tempo
 	timeSignature   midi.TimeSignature
-	keySignature    midi.KeySignature
+	tempoMap        *midi.TempoMap
 }
 
-func getGlobal(f *midi.File) (g global, err error) {
-	if f.Head.Format != 1 {
-		return g, errors.New("not a format 1 MIDI file")
+func getGlobal(sn *midi.Song) (g global, err error) {
+	m, err := sn.TempoMap()
+	if err != nil {
+		return g, fmt.Errorf("in global track: %v", err)
 	}
-	ticks := f.Head.TickDivision
-	if ticks&0x8000 != 0 {
+	if m.IsTimecode() {
 		return g, errors.New("this MIDI file uses timecode, which is not supported")
 	}
-	g.ticksPerQuarter = uint32(ticks)
-	if len(f.Tracks) == 0 {
-		return g, errors.New("no tracks in MIDI file")
-	}
-	evs := f.Tracks[0].Events()
-	for {
-		e, err := evs.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return g, fmt.Errorf("in global track: %v", err)
-		}
-		if m, err := e.ParseMeta(); err == nil {
-			switch m := m.(type) {
-			case midi.Tempo:
-				g.tempo = m
-			case midi.TimeSignature:
-				g.timeSignature = m
-			case midi.KeySignature:
-				g.keySignature = m
-			}
+	g.ticksPerQuarter = uint32(sn.TickDivision)
+	g.timeSignature = m.Meters[0].TimeSignature
+	g.tempoMap = m
+	return g, nil
+}
+
+// warnChanges logs a warning for each tempo or time signature change before
+// the given time, since notes are extracted with the initial tempo and time
+// signature.
+func (g *global) warnChanges(end uint32) {
+	for _, c := range g.tempoMap.Tempos[1:] {
+		if c.Time < end {
+			logrus.Warnf("tempo changes to %.4g at %v, which must be added to the song's tempo section",
+				60e6/float64(c.Tempo), g.tempoMap.Position(c.Time))
 		}
 	}
-	if g.tempo == 0 {
-		return g, errors.New("no tempo")
-	}
-	if g.timeSignature == (midi.TimeSignature{}) {
-		return g, errors.New("no time signature")
+	for _, c := range g.tempoMap.Meters[1:] {
+		if c.Time < end {
+			logrus.Warnf("time signature changes to %d/%d at %v, so bar lines after it will be wrong",
+				c.TimeSignature.Numerator, 1<<c.TimeSignature.DenominatorLog2, g.tempoMap.Position(c.Time))
+		}
 	}
-	return g, nil
 }
 
 func (g *global) ticksPerMeasure() (uint32, error) {
@@ -175,13 +189,22 @@ var listTracks = cobra.Command{
 		if err != nil {
 			return err
 		}
-		for i, tr := range f.Tracks {
-			name, err := trackName(tr)
-			if err != nil {
-				logrus.Errorf("error in track %d: %v", i, err)
-				continue
+		songs, err := f.Songs()
+		if err != nil {
+			return err
+		}
+		for i, sn := range songs {
+			if len(songs) > 1 {
+				fmt.Printf("Song %d:\n", i)
+			}
+			for j, tr := range sn.Tracks {
+				name, err := trackName(tr)
+				if err != nil {
+					logrus.Errorf("error in track %d: %v", j, err)
+					continue
+				}
+				fmt.Printf("Track %d: %q\n", j, name)
 			}
-			fmt.Printf("Track %d: %q\n", i, name)
 		}
 		return nil
 	},
@@ -193,14 +216,18 @@ var dumpTrack = cobra.Command{
 	RunE: func(_ *cobra.Command, args []string) error {
 		midiFile := args[0]
 		trackName := args[1]
-		f, err := readMIDI(midiFile)
+		sn, err := readMIDISong(midiFile)
 		if err != nil {
 			return err
 		}
-		tr, err := findTrack(f, trackName)
+		tr, err := findTrack(sn, trackName)
 		if err != nil {
 			return err
 		}
+		tm, err := sn.TempoMap()
+		if err != nil {
+			return fmt.Errorf("in global track: %v", err)
+		}
 		evs := tr.Events()
 		for {
 			e, err := evs.Next()
@@ -210,6 +237,7 @@ var dumpTrack = cobra.Command{
 				}
 				return err
 			}
+			fmt.Printf("%-10v %9.3fs  ", tm.Position(e.Time), tm.Seconds(e.Time))
 			if e.IsMeta() {
 				m, err := e.ParseMeta()
 				if err != nil {
@@ -231,9 +259,10 @@ var dumpTrack = cobra.Command{
 const chordSize = 8
 
 type note struct {
-	start uint32
-	end   uint32
-	value [chordSize]uint8
+	start    uint32
+	end      uint32
+	value    [chordSize]uint8
+	velocity uint8
 }
 
 // chordSize returns the number of notes in the chord.
@@ -296,6 +325,11 @@ func (w *noteWriter) write(n note) {
 		b.WriteByte('.')
 		v = b.String()
 	}
+	// The velocity is written after the first duration only.
+	var vel string
+	if n.velocity != 0 && n.velocity != song.DefaultVelocity {
+		vel = "v" + strconv.Itoa(int(n.velocity))
+	}
 	for w.time < n.end {
 		bend := w.barstart + w.barlen
 		if w.hasline {
@@ -305,11 +339,14 @@ func (w *noteWriter) write(n note) {
 		v = "~"
 		if bend > n.end {
 			w.out.WriteString(strconv.FormatUint(uint64(n.end-w.time), 10))
+			w.out.WriteString(vel)
 			w.time = n.end
 			w.hasline = true
 			break
 		}
 		w.out.WriteString(strconv.FormatUint(uint64(bend-w.time), 10))
+		w.out.WriteString(vel)
+		vel = ""
 		w.out.WriteString(" |\n")
 		w.time = bend
 		w.hasline = false
@@ -327,99 +364,140 @@ var extractNotes = cobra.Command{
 	RunE: func(_ *cobra.Command, args []string) error {
 		midiFile := args[0]
 		trackName := args[1]
-		f, err := readMIDI(midiFile)
-		if err != nil {
-			return err
-		}
-		g, err := getGlobal(f)
+		sn, err := readMIDISong(midiFile)
 		if err != nil {
 			return err
 		}
-		grid, err := g.gridTicks()
-		if err != nil {
-			return err
-		}
-		tr, err := findTrack(f, trackName)
-		if err != nil {
+		out := bufio.NewWriter(os.Stdout)
+		if err := writeTrackNotes(out, sn, trackName); err != nil {
 			return err
 		}
-		ns, err := tr.ParseNotes()
-		if err != nil {
-			return err
+		return out.Flush()
+	},
+}
+
+// writeTrackNotes writes the notes in a MIDI track as song note data,
+// quantized to the grid, one measure per line.
+func writeTrackNotes(out *bufio.Writer, sn *midi.Song, trackName string) error {
+	g, err := getGlobal(sn)
+	if err != nil {
+		return err
+	}
+	grid, err := g.gridTicks()
+	if err != nil {
+		return err
+	}
+	tr, err := findTrack(sn, trackName)
+	if err != nil {
+		return err
+	}
+	ns, err := tr.ParseNotes()
+	if err != nil {
+		return err
+	}
+	if len(ns) == 0 {
+		return errors.New("no notes in track")
+	}
+	var end uint32
+	for _, n := range ns {
+		if t := n.Time + n.Duration; t > end {
+			end = t
 		}
-		if len(ns) == 0 {
-			return errors.New("no notes in track")
+	}
+	g.warnChanges(end)
+	measure, err := g.ticksPerMeasure()
+	if err != nil {
+		return err
+	}
+	gmeasure := measure / grid
+	logrus.Infoln("Measure size (ticks):", measure)
+	logrus.Infoln("Grid size (ticks):", grid)
+	// Extract quantized notes, combine into chords.
+	var nns []note
+	var lastStart uint32
+	for _, n := range ns {
+		if n.Value == 0 {
+			return errors.New("cannot use MIDI note 0")
 		}
-		measure, err := g.ticksPerMeasure()
-		if err != nil {
-			return err
+		t0 := (n.Time + grid/2) / grid
+		t1 := t0 + (n.Duration+grid-1)/grid
+		if t1 < t0+1 {
+			t1 = t0 + 1
 		}
-		gmeasure := measure / grid
-		logrus.Infoln("Measure size (ticks):", measure)
-		logrus.Infoln("Grid size (ticks):", grid)
-		// Extract quantized notes, combine into chords.
-		var nns []note
-		var lastStart uint32
-		for _, n := range ns {
-			if n.Value == 0 {
-				return errors.New("cannot use MIDI note 0")
-			}
-			t0 := (n.Time + grid/2) / grid
-			t1 := t0 + (n.Duration+grid-1)/grid
-			if t1 < t0+1 {
-				t1 = t0 + 1
-			}
-			if len(nns) != 0 && lastStart == t0 {
-				// Insert note into chord.
-				nn := nns[len(nns)-1]
-				if t1 > nn.end {
-					nn.end = t1
-				}
-				pos := -1
-				for i, v := range nn.value {
-					if v == 0 || v > n.Value {
-						pos = i
-						break
-					}
-				}
-				if pos == -1 {
-					return errors.New("too many notes in a chord")
-				}
-				copy(nn.value[pos+1:], nn.value[pos:])
-				nn.value[pos] = n.Value
-				nns[len(nns)-1] = nn
-			} else {
-				// New note.
-				nn := note{
-					start: t0,
-					end:   t1,
+		if len(nns) != 0 && lastStart == t0 {
+			// Insert note into chord.
+			nn := nns[len(nns)-1]
+			if t1 > nn.end {
+				nn.end = t1
+			}
+			if n.Velocity > nn.velocity {
+				nn.velocity = n.Velocity
+			}
+			pos := -1
+			for i, v := range nn.value {
+				if v == 0 || v > n.Value {
+					pos = i
+					break
 				}
-				nn.value[0] = n.Value
-				nns = append(nns, nn)
 			}
-			lastStart = t0
-		}
-		for i, n := range nns[:len(nns)-1] {
-			lim := nns[i+1].start
-			if lim <= n.start {
-				return errors.New("reverse sorted notes")
+			if pos == -1 {
+				return errors.New("too many notes in a chord")
 			}
-			if lim < n.end || lim-n.end < flagMinRest {
-				nns[i].end = lim
+			copy(nn.value[pos+1:], nn.value[pos:])
+			nn.value[pos] = n.Value
+			nns[len(nns)-1] = nn
+		} else {
+			// New note.
+			nn := note{
+				start:    t0,
+				end:      t1,
+				velocity: n.Velocity,
 			}
+			nn.value[0] = n.Value
+			nns = append(nns, nn)
 		}
-		w := noteWriter{
-			barlen: gmeasure,
-			out:    bufio.NewWriter(os.Stdout),
+		lastStart = t0
+	}
+	for i, n := range nns[:len(nns)-1] {
+		lim := nns[i+1].start
+		if lim <= n.start {
+			return errors.New("reverse sorted notes")
 		}
-		for _, n := range nns {
-			w.write(n)
+		if lim < n.end || lim-n.end < flagMinRest {
+			nns[i].end = lim
 		}
-		if w.hasline {
-			w.advance(w.barstart + w.barlen)
+	}
+	w := noteWriter{
+		barlen: gmeasure,
+		out:    out,
+	}
+	for _, n := range nns {
+		w.write(n)
+	}
+	if w.hasline {
+		w.advance(w.barstart + w.barlen)
+	}
+	return nil
+}
+
+// reportErrors logs each error in a list of song errors, so they can all be
+// fixed at once, and returns an error with the number of errors. If file is not
+// empty, it is used as the file name for errors that do not have one.
+func reportErrors(file string, err error) error {
+	errs, ok := err.(song.ErrorList)
+	if !ok {
+		return err
+	}
+	for _, e := range errs {
+		if e.File == "" {
+			e.File = file
 		}
-		return w.out.Flush()
-	},
+		logrus.Error(e)
+	}
+	if len(errs) == 1 {
+		return errors.New("1 error")
+	}
+	return fmt.Errorf("%d errors", len(errs))
 }
 
 var convert = cobra.Command{
@@ -431,9 +509,9 @@ var convert = cobra.Command{
 		if err != nil {
 			return err
 		}
-		sn, err := song.Parse(data)
+		sn, err := song.ParseAll(data)
 		if err != nil {
-			return err
+			return reportErrors(args[0], err)
 		}
 		jdata := json.NewEncoder(os.Stdout)
 		jdata.SetIndent("", "  ")
@@ -441,7 +519,54 @@ var convert = cobra.Command{
 	},
 }
 
-var flagOutput string
+var flagExportOutput string
+
+var exportMIDI = cobra.Command{
+	Use:  "export-midi <song>",
+	Args: cobra.ExactArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		fname := argToFilePath(args[0])
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		sn, err := song.ParseAll(data)
+		if err != nil {
+			return reportErrors(args[0], err)
+		}
+		f, err := songToMIDI(sn)
+		if err != nil {
+			return fmt.Errorf("%s: %v", args[0], err)
+		}
+		out := strings.TrimSuffix(fname, filepath.Ext(fname)) + ".mid"
+		if flagExportOutput != "" {
+			out = argToFilePath(flagExportOutput)
+		}
+		logrus.Infoln("Writing:", out)
+		return ioutil.WriteFile(out, f.Encode(), 0666)
+	},
+}
+
+var (
+	flagOutput string
+	flagSizes  bool
+)
+
+// writeSizes writes a report of how much each part of the music contributes to
+// the size of the compiled data.
+func writeSizes(w io.Writer, c *song.Compiled) error {
+	sizes, total, err := c.Sizes()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprint(tw, "Kind\tName\tBytes\tDeflated\t\n")
+	for _, s := range sizes {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t\n", s.Part.Kind, s.Part.Name, s.Size, s.Deflated)
+	}
+	fmt.Fprintf(tw, "total\t\t%d\t%d\t\n", len(c.Data), total)
+	return tw.Flush()
+}
 
 var compile = cobra.Command{
 	Use:  "compile <songs.json>",
@@ -450,10 +575,19 @@ var compile = cobra.Command{
 		ctx := context.Background()
 		c, err := song.Compile(ctx, argToFilePath(args[0]))
 		if err != nil {
+			return reportErrors("", err)
+		}
+		if err := c.WriteJS(); err != nil {
 			return err
 		}
 		cd := c.Data
 		logrus.Infoln("Data size:", len(cd))
+		logrus.Infoln("Layout:", c.Layout)
+		if flagSizes {
+			if err := writeSizes(os.Stderr, c); err != nil {
+				return err
+			}
+		}
 		if flagOutput == "" {
 			data := cd
 			const lineBytes = 32
@@ -479,6 +613,447 @@ var compile = cobra.Command{
 	},
 }
 
+// readCompiled reads compiled music data, either as raw binary data or as the
+// hex dump written by the compile command.
+func readCompiled(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var hdata []byte
+	for _, c := range data {
+		switch {
+		case '0' <= c && c <= '9', 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+			hdata = append(hdata, c)
+		case c == ' ', c == '\t', c == '\n', c == '\r':
+		default:
+			return data, nil
+		}
+	}
+	out := make([]byte, hex.DecodedLen(len(hdata)))
+	if _, err := hex.Decode(out, hdata); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return out, nil
+}
+
+var (
+	flagDecompileSongs    string
+	flagDecompileDir      string
+	flagDecompileDivision int
+	flagDecompileTime     string
+)
+
+// decompiledSong converts a decoded song back into a song.
+func decompiledSong(dsn *song.DecodedSong, name string, instruments []string, tracks []string) (*song.Song, error) {
+	var num, denom int
+	if _, err := fmt.Sscanf(flagDecompileTime, "%d/%d", &num, &denom); err != nil ||
+		num <= 0 || denom <= 0 || denom&(denom-1) != 0 {
+		return nil, fmt.Errorf("invalid time signature: %q", flagDecompileTime)
+	}
+	var denomLog2 int
+	for 1<<denomLog2 < denom {
+		denomLog2++
+	}
+	division := flagDecompileDivision
+	if division <= 0 {
+		return nil, fmt.Errorf("invalid division: %d", division)
+	}
+	tempo := func(tickDuration int) float64 {
+		t := 240 / (song.BaseTickLength * float64(tickDuration) * float64(division))
+		return math.Round(t*1000) / 1000
+	}
+	sn := song.Song{
+		Info: song.Info{
+			Name:     name,
+			Tempo:    tempo(dsn.TickDuration),
+			Time:     song.TimeSignature{Numerator: num, DenominatorLog2: denomLog2},
+			Division: division,
+		},
+	}
+	// position returns the measure and offset of a tempo change or automation
+	// point, which must be on a beat.
+	position := func(tick int, what string) (measure, offset int, err error) {
+		barlen := division * num >> denomLog2
+		beatlen := division >> denomLog2
+		if barlen<<denomLog2 != division*num || beatlen<<denomLog2 != division {
+			return 0, 0, fmt.Errorf("division %d is not a whole number of divisions per beat", division)
+		}
+		offset = tick % barlen
+		if offset%beatlen != 0 {
+			return 0, 0, fmt.Errorf("%s at tick %d is not on a beat", what, tick)
+		}
+		return tick / barlen, offset, nil
+	}
+	for _, c := range dsn.TempoChanges {
+		measure, offset, err := position(c.Tick, "tempo change")
+		if err != nil {
+			return nil, err
+		}
+		sn.TempoMap = append(sn.TempoMap, song.TempoChange{
+			Measure: measure,
+			Offset:  offset,
+			Tempo:   tempo(c.TickDuration),
+		})
+	}
+	// automation converts decoded automation points back into points.
+	automation := func(points []song.DecodedAutomationPoint, round float64) ([]song.AutomationPoint, error) {
+		var r []song.AutomationPoint
+		for _, p := range points {
+			measure, offset, err := position(p.Tick, "automation point")
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, song.AutomationPoint{
+				Measure: measure,
+				Offset:  offset,
+				Value:   math.Round(p.Value*round) / round,
+				Ramp:    p.Ramp,
+			})
+		}
+		return r, nil
+	}
+	var length int
+	for i, dtr := range dsn.Tracks {
+		tr := song.Track{
+			Name:             fmt.Sprintf("Track %d", i+1),
+			Instrument:       instruments[dtr.Instrument],
+			GainDB:           math.Round(dtr.GainDB*100) / 100,
+			Pan:              math.Round(dtr.Pan*1000) / 1000,
+			ConstantDuration: dtr.ConstantDuration,
+			Notes:            dtr.Notes,
+		}
+		if i < len(tracks) {
+			tr.Name = tracks[i]
+		}
+		var err error
+		if tr.GainAutomation, err = automation(dtr.GainAutomation, 100); err != nil {
+			return nil, err
+		}
+		if tr.PanAutomation, err = automation(dtr.PanAutomation, 1000); err != nil {
+			return nil, err
+		}
+		var tlen int
+		for _, n := range tr.Notes {
+			tlen += int(n.Duration)
+		}
+		if tlen > length {
+			length = tlen
+		}
+		sn.Tracks = append(sn.Tracks, &tr)
+	}
+	if dsn.Duration != length {
+		sn.Info.Duration = dsn.Duration
+	}
+	return &sn, nil
+}
+
+var decompile = cobra.Command{
+	Use:  "decompile <data>",
+	Args: cobra.ExactArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		data, err := readCompiled(argToFilePath(args[0]))
+		if err != nil {
+			return err
+		}
+		d, err := song.Decode(data)
+		if err != nil {
+			return err
+		}
+		instruments := make([]string, len(d.Programs))
+		var songNames []string
+		var trackNames [][]string
+		if flagDecompileSongs != "" {
+			// Name instruments by matching their programs against the
+			// instruments used by the current songs. If the data is the same
+			// as the current songs, use the song and track names too.
+			c, err := song.Compile(context.Background(), argToFilePath(flagDecompileSongs))
+			if err != nil {
+				return reportErrors("", err)
+			}
+			cd, err := song.Decode(c.Data)
+			if err != nil {
+				return err
+			}
+			names := make(map[string]string)
+			for i, p := range cd.Programs {
+				names[string(p)] = c.SoundNames[i]
+			}
+			for i, p := range d.Programs {
+				instruments[i] = names[string(p)]
+			}
+			if bytes.Equal(c.Data, data) {
+				songNames = c.SongNames
+				trackNames = c.TrackNames
+			}
+		}
+		for i, name := range instruments {
+			if name == "" {
+				instruments[i] = fmt.Sprintf("Instrument %d", i+1)
+			}
+		}
+		dir := argToFilePath(flagDecompileDir)
+		for i, sn := range d.Songs {
+			name := fmt.Sprintf("Song %d", i+1)
+			var tracks []string
+			if i < len(songNames) {
+				name = songNames[i]
+				tracks = trackNames[i]
+			}
+			sn, err := decompiledSong(sn, name, instruments, tracks)
+			if err != nil {
+				return err
+			}
+			text, err := song.Format(sn)
+			if err != nil {
+				return fmt.Errorf("song %q: %v", name, err)
+			}
+			fname := filepath.Join(dir, fmt.Sprintf("%02d_%s.txt", i, fileName(name)))
+			logrus.Infoln("Writing:", fname)
+			if err := ioutil.WriteFile(fname, text, 0666); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var flagFormatWrite bool
+
+var format = cobra.Command{
+	Use:  "fmt <song>...",
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		for _, arg := range args {
+			fname := argToFilePath(arg)
+			data, err := ioutil.ReadFile(fname)
+			if err != nil {
+				return err
+			}
+			text, err := song.FormatText(data)
+			if err != nil {
+				return fmt.Errorf("%s: %v", arg, err)
+			}
+			if !flagFormatWrite {
+				if _, err := os.Stdout.Write(text); err != nil {
+					return err
+				}
+				continue
+			}
+			if bytes.Equal(data, text) {
+				continue
+			}
+			logrus.Infoln("Writing:", fname)
+			if err := ioutil.WriteFile(fname, text, 0666); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// findName returns the index of the named item in a list. The name may also be
+// the index itself.
+func findName(names []string, kind, name string) (int, error) {
+	nn, err := strconv.ParseUint(name, 10, strconv.IntSize-1)
+	if err == nil {
+		n := int(nn)
+		if n >= len(names) {
+			return 0, fmt.Errorf("no %s exists numbered %d", kind, n)
+		}
+		return n, nil
+	}
+	for i, iname := range names {
+		if iname == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no %s exists named %q", kind, name)
+}
+
+// fileName converts a song or track name to something suitable for use in a
+// filename.
+func fileName(name string) string {
+	var b strings.Builder
+	var sep bool
+	for _, c := range name {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			if sep && b.Len() != 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+			sep = false
+		} else {
+			sep = true
+		}
+	}
+	return b.String()
+}
+
+func writeWAV(name string, b *synth.Buffer) error {
+	fp, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := b.WriteWAV(fp); err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+var (
+	flagRenderDir   string
+	flagRenderSong  string
+	flagRenderTrack string
+	flagSplitTracks bool
+)
+
+var render = cobra.Command{
+	Use:  "render <songs.json>",
+	Args: cobra.ExactArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		ctx := context.Background()
+		c, err := song.Compile(ctx, argToFilePath(args[0]))
+		if err != nil {
+			return reportErrors("", err)
+		}
+		d, err := synth.Load(c.Data)
+		if err != nil {
+			return err
+		}
+		songs := make([]int, len(c.SongNames))
+		for i := range songs {
+			songs[i] = i
+		}
+		if flagRenderSong != "" {
+			n, err := findName(c.SongNames, "song", flagRenderSong)
+			if err != nil {
+				return err
+			}
+			songs = []int{n}
+		}
+		dir := argToFilePath(flagRenderDir)
+		r := synth.NewRenderer()
+		for _, i := range songs {
+			sn := d.Songs[i]
+			name := fmt.Sprintf("%02d_%s", i, fileName(c.SongNames[i]))
+			tnames := c.TrackNames[i]
+			var tracks []int
+			if flagRenderTrack != "" {
+				n, err := findName(tnames, "track", flagRenderTrack)
+				if err != nil {
+					return fmt.Errorf("song %q: %v", c.SongNames[i], err)
+				}
+				tracks = []int{n}
+			} else {
+				b, err := r.RenderSong(d, sn)
+				if err != nil {
+					return fmt.Errorf("song %q: %v", c.SongNames[i], err)
+				}
+				fname := filepath.Join(dir, name+".wav")
+				logrus.Infoln("Writing:", fname)
+				if err := writeWAV(fname, b); err != nil {
+					return err
+				}
+				if flagSplitTracks {
+					for j := range sn.Tracks {
+						tracks = append(tracks, j)
+					}
+				}
+			}
+			for _, j := range tracks {
+				// Every track starts at the same time, so the files for a
+				// song line up with each other when imported into an editor.
+				tsn := *sn
+				tsn.Tracks = []*synth.Track{sn.Tracks[j]}
+				b, err := r.RenderSong(d, &tsn)
+				if err != nil {
+					return fmt.Errorf("song %q: %v", c.SongNames[i], err)
+				}
+				fname := filepath.Join(dir, fmt.Sprintf("%s_%d_%s.wav", name, j, fileName(tnames[j])))
+				logrus.Infoln("Writing:", fname)
+				if err := writeWAV(fname, b); err != nil {
+					return err
+				}
+			}
+		}
+		if flagRenderSong != "" {
+			return nil
+		}
+		for i, x := range d.Sfx {
+			b, err := r.RenderSfx(d, x)
+			if err != nil {
+				return fmt.Errorf("sfx %q: %v", c.SfxNames[i], err)
+			}
+			fname := filepath.Join(dir, fmt.Sprintf("sfx_%02d_%s.wav", i, fileName(c.SfxNames[i])))
+			logrus.Infoln("Writing:", fname)
+			if err := writeWAV(fname, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var flagInstruments string
+
+var disasm = cobra.Command{
+	Use:  "disasm [<instrument>...]",
+	Args: cobra.ArbitraryArgs,
+	RunE: func(_ *cobra.Command, args []string) error {
+		filename := argToFilePath(flagInstruments)
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		insts, err := instrument.Parse(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		if len(args) != 0 {
+			named := make(map[string]*instrument.Instrument, len(insts))
+			for _, inst := range insts {
+				named[inst.Name] = inst
+			}
+			insts = nil
+			for _, name := range args {
+				inst := named[name]
+				if inst == nil {
+					return fmt.Errorf("no instrument named %q", name)
+				}
+				insts = append(insts, inst)
+			}
+		}
+		w := bufio.NewWriter(os.Stdout)
+		defer w.Flush()
+		for i, inst := range insts {
+			if i != 0 {
+				w.WriteByte('\n')
+			}
+			fmt.Fprintf(w, "%s: %d bytes\n", inst.Name, len(inst.Code))
+			ins, err := instrument.Disassemble(inst.Code)
+			if err != nil {
+				return fmt.Errorf("%s: %v", inst.Name, err)
+			}
+			var indent string
+			for _, in := range ins {
+				if in.Op == instrument.OpEndRepeat {
+					indent = ""
+				}
+				fmt.Fprintf(w, "%4d  %s%s\n", in.Pos, indent, in)
+				if in.Op == instrument.OpRepeat {
+					indent = "  "
+				}
+			}
+			if err := instrument.Validate(inst.Code); err != nil {
+				return fmt.Errorf("%s: %v", inst.Name, err)
+			}
+		}
+		return nil
+	},
+}
+
 var root = cobra.Command{
 	Use:           "music",
 	Short:         "Music is a tool for generating JS13K music from MIDI files.",
@@ -487,13 +1062,33 @@ var root = cobra.Command{
 }
 
 func main() {
-	root.AddCommand(&listTracks, &dumpTrack, &extractNotes, &convert, &compile)
-	f := extractNotes.Flags()
+	root.AddCommand(&listTracks, &dumpTrack, &extractNotes, &convert, &exportMIDI, &compile, &render, &decompile, &format, &disasm)
+	f := dumpTrack.Flags()
+	f.IntVar(&flagMIDISong, "song", 0, "index of the song to use in a format 2 MIDI file")
+	f = extractNotes.Flags()
+	f.IntVar(&flagMIDISong, "song", 0, "index of the song to use in a format 2 MIDI file")
 	f.Uint32Var(&flagGrid, "grid", 48, "size of musical grid, default is 1/48 (32nd note triplets)")
 	f.Uint32Var(&flagMinRest, "min-rest", 1, "length of minimum size of rest, in grid divisions")
 	f.BoolVar(&flagRepeat, "repeat", false, "allow the use of ':' repeat symbols for repeated notes")
+	f = exportMIDI.Flags()
+	f.StringVarP(&flagExportOutput, "output", "o", "", "output MIDI file, default is the song file with a .mid extension")
 	f = compile.Flags()
 	f.StringVarP(&flagOutput, "output", "o", "", "output file for compiled songs")
+	f.BoolVar(&flagSizes, "sizes", false, "report the size of each section, song, track, instrument, and sound effect")
+	f = decompile.Flags()
+	f.StringVarP(&flagDecompileDir, "output", "o", ".", "output directory for song files")
+	f.StringVar(&flagDecompileSongs, "songs", "", "songs.json file, for instrument names")
+	f.IntVar(&flagDecompileDivision, "division", 16, "number of ticks per whole note")
+	f.StringVar(&flagDecompileTime, "time", "4/4", "time signature")
+	f = format.Flags()
+	f.BoolVarP(&flagFormatWrite, "write", "w", false, "write result to the source file instead of stdout")
+	f = render.Flags()
+	f.StringVarP(&flagRenderDir, "output", "o", ".", "output directory for WAV files")
+	f.StringVar(&flagRenderSong, "song", "", "only render the song with this name or index, and no sound effects")
+	f.StringVar(&flagRenderTrack, "track", "", "only render the track with this name or index")
+	f.BoolVar(&flagSplitTracks, "split-tracks", false, "also render each track to a separate file")
+	f = disasm.Flags()
+	f.StringVar(&flagInstruments, "instruments", filepath.Join("music", song.InstrumentsFile), "instrument file")
 	workingDirectory = os.Getenv("BUILD_WORKING_DIRECTORY")
 	if err := root.Execute(); err != nil {
 		logrus.Error(err)
@@ -110,6 +110,9 @@ func (p *Project) buildData(ctx context.Context) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if err := cd.WriteJS(); err != nil {
+		return "", err
+	}
 	s, err := embed.Encode(cd.Data)
 	if err != nil {
 		return "", fmt.Errorf("encode: %v", err)
@@ -0,0 +1,266 @@
+package song
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"moria.us/js13k/build/embed"
+)
+
+// A Ramp is the shape of the change in a parameter leading up to an automation
+// point.
+type Ramp int
+
+const (
+	// RampLinear changes the value linearly from the previous point.
+	RampLinear Ramp = iota
+	// RampStep keeps the previous value, and changes to the new value at the
+	// point.
+	RampStep
+	// RampExponential changes the value exponentially from the previous
+	// point. This is only allowed for gain, where it is linear in decibels.
+	RampExponential
+)
+
+var rampNames = [...]string{
+	RampLinear:      "linear",
+	RampStep:        "step",
+	RampExponential: "exp",
+}
+
+func (r Ramp) String() string {
+	if 0 <= r && int(r) < len(rampNames) {
+		return rampNames[r]
+	}
+	return fmt.Sprintf("Ramp(%d)", int(r))
+}
+
+func parseRamp(value string) (Ramp, error) {
+	for i, name := range rampNames {
+		if name == value {
+			return Ramp(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown ramp: %q", value)
+}
+
+// An AutomationPoint is a point where a track's gain or pan reaches a value.
+// The value changes between the previous point and this point according to the
+// ramp.
+type AutomationPoint struct {
+	// Measure is the measure containing the point, counting from zero.
+	Measure int
+	// Offset is the time within the measure, in divisions.
+	Offset int
+	// Value is the gain in decibels, like Track.GainDB, or the pan, like
+	// Track.Pan.
+	Value float64
+	Ramp  Ramp
+}
+
+// before returns true if the point comes before the point q.
+func (p *AutomationPoint) before(q *AutomationPoint) bool {
+	return p.Measure < q.Measure || p.Measure == q.Measure && p.Offset < q.Offset
+}
+
+// addAutomationPoint checks that an automation point comes after the last
+// point in the lane, and adds it.
+func addAutomationPoint(lane *[]AutomationPoint, p AutomationPoint) error {
+	if n := len(*lane); n != 0 && !(*lane)[n-1].before(&p) {
+		return errors.New("automation points are out of order")
+	}
+	*lane = append(*lane, p)
+	return nil
+}
+
+// parseAutomation parses a line in an @automation section and adds the points
+// to the track. The line contains a position, like a tempo change, followed by
+// a gain, a pan, or both, and an optional ramp, like "5:3 gain=-6 ramp=exp" or
+// "9 pan=-0.5".
+func (sn *Song) parseAutomation(tr *Track, text string) error {
+	fields := strings.Fields(text)
+	measure, offset, err := sn.parsePosition(fields[0])
+	if err != nil {
+		return err
+	}
+	if offset >= sn.barLength(measure) {
+		return errors.New("offset is past the end of the measure")
+	}
+	var gain, pan *AutomationPoint
+	var ramp Ramp
+	var hasRamp bool
+	for _, f := range fields[1:] {
+		i := strings.IndexByte(f, '=')
+		if i == -1 {
+			return fmt.Errorf("expected key=value: %q", f)
+		}
+		key, value := f[:i], f[i+1:]
+		switch key {
+		case "gain":
+			if gain != nil {
+				return errors.New("duplicate gain")
+			}
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			gain = &AutomationPoint{Value: n}
+		case "pan":
+			if pan != nil {
+				return errors.New("duplicate pan")
+			}
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			if n < -1 || 1 < n {
+				return errors.New("pan must be in the range [-1, +1]")
+			}
+			pan = &AutomationPoint{Value: n}
+		case "ramp":
+			if hasRamp {
+				return errors.New("duplicate ramp")
+			}
+			hasRamp = true
+			if ramp, err = parseRamp(value); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown key: %q", key)
+		}
+	}
+	if gain == nil && pan == nil {
+		return errors.New("expected gain or pan")
+	}
+	if pan != nil && ramp == RampExponential {
+		return errors.New("exponential ramps are only allowed for gain")
+	}
+	for _, x := range [...]struct {
+		p    *AutomationPoint
+		lane *[]AutomationPoint
+	}{{gain, &tr.GainAutomation}, {pan, &tr.PanAutomation}} {
+		if x.p == nil {
+			continue
+		}
+		x.p.Measure = measure
+		x.p.Offset = offset
+		x.p.Ramp = ramp
+		if err := addAutomationPoint(x.lane, *x.p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatAutomation returns the lines in the @automation section for a track.
+// Gain and pan points at the same position with the same ramp are written on
+// the same line.
+func formatAutomation(sn *Song, tr *Track) ([]string, error) {
+	var lines []string
+	gain, pan := tr.GainAutomation, tr.PanAutomation
+	for len(gain) != 0 || len(pan) != 0 {
+		var g, p *AutomationPoint
+		switch {
+		case len(pan) == 0:
+			g = &gain[0]
+		case len(gain) == 0:
+			p = &pan[0]
+		case gain[0].before(&pan[0]):
+			g = &gain[0]
+		case pan[0].before(&gain[0]):
+			p = &pan[0]
+		case gain[0].Ramp == pan[0].Ramp:
+			g, p = &gain[0], &pan[0]
+		default:
+			g = &gain[0]
+		}
+		x := g
+		if x == nil {
+			x = p
+		}
+		line, err := formatPosition(sn, x.Measure, x.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("automation point in measure %d: %v", x.Measure+1, err)
+		}
+		if g != nil {
+			line += " gain=" + formatNumber(g.Value)
+			gain = gain[1:]
+		}
+		if p != nil {
+			line += " pan=" + formatNumber(p.Value)
+			pan = pan[1:]
+		}
+		if x.Ramp != RampLinear {
+			line += " ramp=" + x.Ramp.String()
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// hasAutomation returns true if any track in the songs has automation.
+func hasAutomation(songs []*Song) bool {
+	for _, sn := range songs {
+		for _, tr := range sn.Tracks {
+			if len(tr.GainAutomation) != 0 || len(tr.PanAutomation) != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Automation point flags, stored with each point.
+const (
+	automationPanFlag   = 1
+	automationRampShift = 1
+)
+
+// encodeAutomation encodes the automation points for a track. The tempo map
+// must be valid.
+func encodeAutomation(sn *Song, tr *Track) ([]uint8, error) {
+	var data []uint8
+	for lane, points := range [...][]AutomationPoint{tr.GainAutomation, tr.PanAutomation} {
+		for i, p := range points {
+			if i > 0 && !points[i-1].before(&p) {
+				return nil, errors.New("automation points are out of order")
+			}
+			if p.Offset < 0 || p.Offset >= sn.barLength(p.Measure) {
+				return nil, fmt.Errorf("automation point in measure %d: invalid offset: %d", p.Measure+1, p.Offset)
+			}
+			tick := sn.measureStart(p.Measure) + p.Offset
+			if tick >= embed.NumValues*embed.NumValues {
+				return nil, fmt.Errorf("automation point too late: tick %d", tick)
+			}
+			if p.Ramp < RampLinear || RampExponential < p.Ramp {
+				return nil, fmt.Errorf("invalid ramp: %d", p.Ramp)
+			}
+			flags := int(p.Ramp) << automationRampShift
+			var value uint8
+			var err error
+			if lane == 0 {
+				value, err = encodeGain(sn.Info.GainDB + p.Value)
+			} else {
+				if p.Ramp == RampExponential {
+					return nil, errors.New("exponential ramps are only allowed for gain")
+				}
+				flags |= automationPanFlag
+				value, err = encodePan(p.Value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("automation point in measure %d: %v", p.Measure+1, err)
+			}
+			data = append(data,
+				uint8(tick/embed.NumValues),
+				uint8(tick%embed.NumValues),
+				uint8(flags),
+				value)
+		}
+	}
+	if len(data)/4 >= embed.NumValues {
+		return nil, errors.New("too many automation points")
+	}
+	return append([]uint8{uint8(len(data) / 4)}, data...), nil
+}
@@ -0,0 +1,140 @@
+package song
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const automationSong = `@info
+name: Swell
+tempo: 120
+division: 16
+
+@tempo
+
+3 time=3/4 tempo=100
+
+@track
+name: Pad
+instrument: Lead
+gain: -30
+pan: -1
+
+c4.16 | c4.16 | c4.12 | c4.12 |
+
+@automation
+
+2 gain=-6 ramp=exp
+2:3 pan=1
+3 gain=-6 pan=0 ramp=step
+4:2 gain=0
+`
+
+func TestParseAutomation(t *testing.T) {
+	sn, err := Parse([]byte(automationSong))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := sn.Tracks[0]
+	expectGain := []AutomationPoint{
+		{1, 0, -6, RampExponential},
+		{2, 0, -6, RampStep},
+		{3, 4, 0, RampLinear},
+	}
+	expectPan := []AutomationPoint{
+		{1, 8, 1, RampLinear},
+		{2, 0, 0, RampStep},
+	}
+	if !reflect.DeepEqual(tr.GainAutomation, expectGain) {
+		t.Errorf("gain automation is %v, expect %v", tr.GainAutomation, expectGain)
+	}
+	if !reflect.DeepEqual(tr.PanAutomation, expectPan) {
+		t.Errorf("pan automation is %v, expect %v", tr.PanAutomation, expectPan)
+	}
+	text, err := Format(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn2, err := Parse(text)
+	if err != nil {
+		t.Fatalf("Parse(Format()): %v\n%s", err, text)
+	}
+	if !reflect.DeepEqual(sn, sn2) {
+		t.Errorf("Parse(Format()) does not match original:\n%s", text)
+	}
+	checkRoundTrip(t, []*Song{sn}, nil)
+}
+
+func TestParseAutomationErrors(t *testing.T) {
+	cases := []struct {
+		old, new string
+		err      string
+	}{
+		{"2:3 pan=1", "2:3 pan=1 ramp=exp", "only allowed for gain"},
+		{"2:3 pan=1", "2:3 pan=2", "range"},
+		{"2:3 pan=1", "2:5 pan=1", "past the end"},
+		{"2:3 pan=1", "2:3 ramp=step", "expected gain or pan"},
+		{"2:3 pan=1", "2:3 pan=1 ramp=smooth", "unknown ramp"},
+		{"2:3 pan=1", "2:3 pan=1 volume=3", "unknown key"},
+		{"4:2 gain=0", "2:2 gain=0", "out of order"},
+		{"4:2 gain=0", "3 gain=0", "out of order"},
+		{"@automation\n", "@automation\nname: x\n", "unknown property"},
+		{"4:2 gain=0\n", "4:2 gain=0\n\n@automation\n\n4:3 gain=-3\n", "duplicate automation"},
+		{"@track\n", "@automation\n\n2 gain=0\n\n@track\n", "must come after a track"},
+	}
+	for _, c := range cases {
+		text := strings.Replace(automationSong, c.old, c.new, 1)
+		_, err := Parse([]byte(text))
+		if err == nil {
+			t.Errorf("%q: no error", c.new)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %q, expect %q", c.new, err, c.err)
+		}
+	}
+}
+
+// addRandomAutomation adds random automation to each track in a song.
+func addRandomAutomation(r *rand.Rand, sn *Song) {
+	for _, tr := range sn.Tracks {
+		var measure int
+		for r.Intn(4) != 0 {
+			measure += r.Intn(3)
+			p := AutomationPoint{
+				Measure: measure,
+				Offset:  r.Intn(sn.barLength(measure)),
+			}
+			if r.Intn(2) == 0 {
+				p.Value = float64(r.Intn(21)-10) / 10
+				p.Ramp = Ramp(r.Intn(2))
+				addAutomationPoint(&tr.PanAutomation, p)
+			} else {
+				p.Value = -float64(r.Intn(30))
+				p.Ramp = Ramp(r.Intn(3))
+				addAutomationPoint(&tr.GainAutomation, p)
+			}
+		}
+	}
+}
+
+func TestDecodeAutomation(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	songs := []*Song{randomSong(r, 0), randomSong(r, 1)}
+	for _, sn := range songs {
+		addRandomAutomation(r, sn)
+	}
+	for layout := 0; layout < numLayouts; layout++ {
+		c, err := compileLayout(testSounds(), songs, nil, layout)
+		if err != nil {
+			t.Fatal("compile:", err)
+		}
+		if c.Data[3] != byte(layout|layoutAutomation) {
+			t.Errorf("layout %d: header has layout %d", layout, c.Data[3])
+		}
+		checkDecode(t, c, songs, nil)
+		if t.Failed() {
+			t.Fatalf("layout %d failed", layout)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package song
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// chordQualities contains the notes in each chord quality, in semitones above
+// the root, in close position.
+var chordQualities = map[string][]int{
+	"":      {0, 4, 7},
+	"m":     {0, 3, 7},
+	"dim":   {0, 3, 6},
+	"aug":   {0, 4, 8},
+	"+":     {0, 4, 8},
+	"5":     {0, 7},
+	"sus2":  {0, 2, 7},
+	"sus4":  {0, 5, 7},
+	"6":     {0, 4, 7, 9},
+	"m6":    {0, 3, 7, 9},
+	"7":     {0, 4, 7, 10},
+	"maj7":  {0, 4, 7, 11},
+	"m7":    {0, 3, 7, 10},
+	"mmaj7": {0, 3, 7, 11},
+	"m7b5":  {0, 3, 6, 10},
+	"dim7":  {0, 3, 6, 9},
+	"7sus4": {0, 5, 7, 10},
+	"add9":  {0, 4, 7, 14},
+	"madd9": {0, 3, 7, 14},
+	"9":     {0, 4, 7, 10, 14},
+	"maj9":  {0, 4, 7, 11, 14},
+	"m9":    {0, 3, 7, 10, 14},
+	"11":    {0, 4, 7, 10, 14, 17},
+	"m11":   {0, 3, 7, 10, 14, 17},
+	"13":    {0, 4, 7, 10, 14, 21},
+}
+
+// An offsetErr is an error at a specific offset within a token.
+type offsetErr struct {
+	offset int
+	err    error
+}
+
+func (e *offsetErr) Error() string {
+	return e.err.Error()
+}
+
+// errOffset returns the offset of an error within its token.
+func errOffset(err error) int {
+	var e *offsetErr
+	if errors.As(err, &e) {
+		return e.offset
+	}
+	return 0
+}
+
+// parsePitchClass parses a note name without octave, like "C" or "Bb", at the
+// start of the text. Returns the pitch class and the remaining text.
+func parsePitchClass(text string) (int, string, error) {
+	if text == "" || text[0] < 'A' || 'G' < text[0] {
+		return 0, "", errors.New("expected note name")
+	}
+	value := baseNote[text[0]-'A']
+	text = text[1:]
+	if text != "" {
+		switch text[0] {
+		case '#':
+			value++
+			text = text[1:]
+		case 'b':
+			value--
+			text = text[1:]
+		}
+	}
+	return (value + 12) % 12, text, nil
+}
+
+// parseModifier parses a number after a chord modifier letter, like the "2"
+// in "d2". Returns the number and the remaining text.
+func parseModifier(text string) (int, string) {
+	i := 0
+	for i < len(text) && '0' <= text[i] && text[i] <= '9' {
+		i++
+	}
+	n, err := strconv.Atoi(text[:i])
+	if err != nil {
+		return -1, text[i:]
+	}
+	return n, text[i:]
+}
+
+// parseChord parses a chord symbol, like "Cmaj7@4", with a root, a quality, an
+// optional bass note after "/", and the octave of the root after "@". The
+// notes are stacked above the root in close position. The octave may be
+// followed by modifiers: "i" and a number for an inversion, which moves that
+// many of the lowest notes up an octave, and "d" and a number for a drop
+// voicing, which moves that note, counting from the top, down an octave. For
+// example, "Am@3", "G7/B@3", "Cmaj7@4i1", and "Cmaj7@4d2".
+func parseChord(text string) (values [ChordSize]uint8, err error) {
+	full := text
+	// offset returns the offset of the remaining text in the chord symbol.
+	offset := func() int { return len(full) - len(text) }
+	root, text, err := parsePitchClass(text)
+	if err != nil {
+		return values, err
+	}
+	qstart := offset()
+	for text != "" && text[0] != '/' && text[0] != '@' {
+		text = text[1:]
+	}
+	quality := full[qstart:offset()]
+	intervals, ok := chordQualities[quality]
+	if !ok {
+		return values, &offsetErr{qstart, fmt.Errorf("unknown chord quality: %q", quality)}
+	}
+	bass := -1
+	if text != "" && text[0] == '/' {
+		text = text[1:]
+		pos := offset()
+		bass, text, err = parsePitchClass(text)
+		if err != nil {
+			return values, &offsetErr{pos, fmt.Errorf("invalid bass note: %v", err)}
+		}
+	}
+	if text == "" || text[0] != '@' {
+		return values, &offsetErr{offset(), errors.New("missing octave, like \"@4\"")}
+	}
+	text = text[1:]
+	pos := offset()
+	octave, text := parseModifier(text)
+	if octave < 0 || 10 < octave {
+		return values, &offsetErr{pos, errors.New("invalid octave")}
+	}
+	var inversion, drop int
+	for text != "" {
+		pos := offset()
+		c := text[0]
+		var n int
+		n, text = parseModifier(text[1:])
+		switch c {
+		case 'i':
+			if inversion != 0 || n < 1 || len(intervals) <= n {
+				return values, &offsetErr{pos, errors.New("invalid inversion")}
+			}
+			inversion = n
+		case 'd':
+			if drop != 0 || n < 2 || len(intervals) < n {
+				return values, &offsetErr{pos, errors.New("invalid drop voicing")}
+			}
+			drop = n
+		default:
+			return values, &offsetErr{pos, fmt.Errorf("unknown chord modifier: %q", c)}
+		}
+	}
+	base := root + 12*(octave+1)
+	var notes []int
+	for _, x := range intervals {
+		notes = append(notes, base+x)
+	}
+	for i := 0; i < inversion; i++ {
+		notes[i] += 12
+	}
+	sort.Ints(notes)
+	if drop != 0 {
+		notes[len(notes)-drop] -= 12
+		sort.Ints(notes)
+	}
+	if bass >= 0 {
+		// The bass note replaces any note with the same pitch class, and is
+		// placed below the rest of the chord.
+		var upper []int
+		for _, n := range notes {
+			if n%12 != bass {
+				upper = append(upper, n)
+			}
+		}
+		b := upper[0] - 1
+		for (b%12+12)%12 != bass {
+			b--
+		}
+		notes = append([]int{b}, upper...)
+	}
+	if len(notes) > ChordSize {
+		return values, errors.New("too many notes in a chord")
+	}
+	for i, n := range notes {
+		if n <= 0 || 127 < n {
+			return values, errors.New("note out of range")
+		}
+		values[i] = uint8(n)
+	}
+	return values, nil
+}
@@ -0,0 +1,111 @@
+package song
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseChord(t *testing.T) {
+	cases := []struct {
+		text   string
+		expect string
+	}{
+		{"C@4", "c4e4g4"},
+		{"Am@3", "a3c4e4"},
+		{"Cmaj7@4", "c4e4g4b4"},
+		{"Bb7@3", "a#3d4f4g#4"},
+		{"F#m7b5@3", "f#3a3c4e4"},
+		{"G7/B@3", "b2g3d4f4"},
+		{"C/E@4", "e3c4g4"},
+		{"Am/G@3", "g3a3c4e4"},
+		{"Cmaj7@4i1", "e4g4b4c5"},
+		{"C@4i2", "g4c5e5"},
+		{"Cmaj7@4d2", "g3c4e4b4"},
+		{"C9@3", "c3e3g3a#3d4"},
+	}
+	for _, c := range cases {
+		v, err := parseValue(c.text)
+		if err != nil {
+			t.Errorf("%q: %v", c.text, err)
+			continue
+		}
+		s, err := formatValue(v)
+		if err != nil {
+			t.Errorf("%q: %v", c.text, err)
+			continue
+		}
+		if s != c.expect {
+			t.Errorf("%q: got %s, expect %s", c.text, s, c.expect)
+		}
+	}
+}
+
+func TestParseChordErrors(t *testing.T) {
+	cases := []struct {
+		text   string
+		offset int
+		err    string
+	}{
+		{"Cmin7@4", 1, "unknown chord quality: \"min7\""},
+		{"Ebxyz/G@4", 2, "unknown chord quality"},
+		{"Cmaj7", 5, "missing octave"},
+		{"Cmaj7@x", 6, "invalid octave"},
+		{"C7/H@3", 3, "invalid bass note"},
+		{"C@4i3", 3, "invalid inversion"},
+		{"C@4d4", 3, "invalid drop voicing"},
+		{"C@4x1", 3, "unknown chord modifier"},
+	}
+	for _, c := range cases {
+		_, err := parseValue(c.text)
+		if err == nil {
+			t.Errorf("%q: no error", c.text)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %q, expect %q", c.text, err, c.err)
+		}
+		if off := errOffset(err); off != c.offset {
+			t.Errorf("%q: error offset is %d, expect %d", c.text, off, c.offset)
+		}
+	}
+}
+
+func TestParseChordTrack(t *testing.T) {
+	const song = `@info
+name: Chords
+tempo: 120
+division: 16
+
+@track
+
+Cmaj7@4.8 Am@3.8v90 | G7/B@3.16 | Dm7x@4.16 |
+`
+	_, err := ParseAll([]byte(song))
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("got error %v, expect one error", err)
+	}
+	if e := errs[0]; e.Line != 8 || e.Column != 36 || !strings.Contains(e.Err.Error(), "unknown chord quality: \"m7x\"") {
+		t.Errorf("got error %v", e)
+	}
+}
+
+func TestFormatTextChords(t *testing.T) {
+	const song = `@info
+name: Chords
+tempo: 120
+division: 16
+
+@track
+
+Cmaj7@4.8 Am@3.8v90 | G7/B@3.16 | c4e4g4.16 |
+`
+	const expect = `Cmaj7@4.8 Am@3.8v90 |
+G7/B@3.16           |
+c4e4g4.16           |
+`
+	text := checkFormatText(t, "chords", []byte(song))
+	if !strings.HasSuffix(string(text), "\n\n"+expect) {
+		t.Errorf("FormatText:\n%s\nexpect notes:\n%s", text, expect)
+	}
+}
@@ -23,15 +23,18 @@ const (
 )
 
 const (
+	// Size of the header, in bytes.
+	headerSize = 4
+
 	// Initial value, for calculating deltas
 	startValue = 60
-
-	// Base length of a tick, in seconds, for encoding tempo. So if the song's
-	// tempo is encoded as N, then the duration of a tick is equal to
-	// N*baseTickLength seconds.
-	baseTickLength = 2e-3
 )
 
+// BaseTickLength is the base length of a tick, in seconds, for encoding tempo.
+// So if the song's tempo is encoded as N, then the duration of a tick is equal
+// to N*BaseTickLength seconds.
+const BaseTickLength = 2e-3
+
 type compileError struct {
 	songname  string
 	tracknum  int
@@ -47,11 +50,25 @@ func compileErrorf(sn *Song, i int, tr *Track, format string, a ...interface{})
 	return &compileError{sn.Info.Name, i, tr.Name, fmt.Sprintf(format, a...)}
 }
 
-// A Compiled contains the results of compiling sounds and songs.
+// A Compiled contains the results of compiling sounds, songs, and sound
+// effects.
 type Compiled struct {
 	Data       []byte   `json:"data"`
 	SoundNames []string `json:"soundNames"`
 	SongNames  []string `json:"songNames"`
+	SfxNames   []string `json:"sfxNames"`
+	// TrackNames contains the names of the tracks in each song. This is not
+	// needed by the game, so it is not sent to it.
+	TrackNames [][]string `json:"-"`
+	// JSModule is the path to the generated JavaScript module with song,
+	// instrument, and sound effect indexes, or empty if there is none. See
+	// WriteJS.
+	JSModule string `json:"-"`
+	// Parts records which parts of the input produced which bytes of Data, for
+	// size reports. See Sizes.
+	Parts []Part `json:"-"`
+	// Layout contains the layout flags chosen for Data.
+	Layout int `json:"-"`
 }
 
 func encodeGain(gainDB float64) (uint8, error) {
@@ -63,6 +80,39 @@ func encodeGain(gainDB float64) (uint8, error) {
 	return uint8(x), nil
 }
 
+// Track flags, stored with the constant duration. Since the byte must be less
+// than embed.NumValues, the velocity flag limits the constant duration of
+// tracks with velocity to maxVelocityConstantDuration.
+const (
+	constantDurationMask = 1<<6 - 1
+	velocityFlag         = 1 << 6
+
+	maxVelocityConstantDuration = embed.NumValues - 1 - velocityFlag
+)
+
+// trackHasVelocity returns true if the track has any notes with velocity.
+func trackHasVelocity(tr *Track) bool {
+	for _, n := range tr.Notes {
+		if n.Velocity != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeVelocity returns the encoded velocity of a note. Velocities below
+// MaxVelocity-(embed.NumValues-1) are encoded as that value.
+func encodeVelocity(v uint8) uint8 {
+	if v == 0 {
+		v = DefaultVelocity
+	}
+	x := MaxVelocity - int(v)
+	if x >= embed.NumValues {
+		x = embed.NumValues - 1
+	}
+	return uint8(x)
+}
+
 func encodePan(pan float64) (uint8, error) {
 	const (
 		zero  = (embed.NumValues - 1) >> 1
@@ -75,13 +125,217 @@ func encodePan(pan float64) (uint8, error) {
 	return uint8(x), nil
 }
 
-func compile(snd *sounds, songs []*Song) (*Compiled, error) {
+// tickError returns the relative error in tempo caused by rounding the tick
+// duration, for the given tempo and number of divisions per whole note.
+func tickError(tempo float64, division int) float64 {
+	ftick := (240 / BaseTickLength) / (tempo * float64(division))
+	return math.Abs(math.RoundToEven(ftick)-ftick) / ftick
+}
+
+// tickDuration returns the encoded duration of a tick, for the given tempo
+// and number of divisions per whole note.
+func tickDuration(tempo float64, division int) (int, error) {
+	tdenom := tempo * float64(division)
+	if tdenom == 0 {
+		return 0, errors.New("invalid tempo or division")
+	}
+	ftick := (240 / BaseTickLength) / tdenom
+	if !(ftick >= 1) {
+		return 0, fmt.Errorf("tick duration too small: %f ms", ftick)
+	}
+	if !(ftick <= 255) {
+		return 0, fmt.Errorf("tick duration too large: %f ms", ftick)
+	}
+	itick := int(math.RoundToEven(ftick))
+	if itick < 1 {
+		itick = 1
+	} else if itick > 255 {
+		itick = 255
+	}
+	return itick, nil
+}
+
+// Layout flags, stored in the header. Every layout encodes the same music, but
+// some layouts compress better than others, depending on the music. The
+// compiler tries all of them and chooses the smallest.
+const (
+	// layoutTrackBase: the note values for each track start with the initial
+	// value for delta encoding, instead of using startValue.
+	layoutTrackBase = 1 << iota
+	// layoutInterleave: the note values, durations, and velocities for each
+	// track are stored together, instead of in three separate streams.
+	layoutInterleave
+	// layoutTrackMajor: tracks are stored in order of their index in the
+	// song, then by song, instead of by song and then index.
+	layoutTrackMajor
+	// layoutUniformDurations: the durations for each track start with a byte
+	// which is either the duration of every note and rest in the track, or 0
+	// if the durations follow.
+	layoutUniformDurations
+
+	numLayouts = layoutUniformDurations << 1
+)
+
+// layoutAutomation is a layout flag which is set if any track has automation,
+// in which case the automation for each track follows the note data. It does
+// not change the size of the data, so the compiler does not try layouts with
+// and without it.
+const layoutAutomation = numLayouts
+
+// A noteData is the encoded note data for a single track.
+type noteData struct {
+	values     []uint8
+	durations  []uint8
+	velocities []uint8
+	// automation is the encoded automation, with layoutAutomation.
+	automation []uint8
+}
+
+// encodeTrack encodes the notes in a track, using the given layout.
+func encodeTrack(tr *Track, layout int) (*noteData, error) {
+	var nd noteData
+	hasVelocity := trackHasVelocity(tr)
+	var last [maxPolyphony]int
+	last[0] = startValue
+	if layout&layoutTrackBase != 0 {
+		for _, n := range tr.Notes {
+			if !n.IsRest && n.Value[0] != 0 {
+				last[0] = int(n.Value[0])
+				break
+			}
+		}
+		if last[0] >= restValue {
+			return nil, fmt.Errorf("note value out of range: %d", last[0])
+		}
+		nd.values = append(nd.values, uint8(last[0]))
+	}
+	curPolyphony := 1
+	// Number of voices which have played a note. Voices past this have no
+	// previous note.
+	numVoices := 1
+	for _, n := range tr.Notes {
+		count := 1
+		rem := n.Duration
+		for rem >= embed.NumValues {
+			count++
+			nd.durations = append(nd.durations, uint8(embed.NumValues-1))
+			rem -= embed.NumValues - 1
+		}
+		nd.durations = append(nd.durations, uint8(rem))
+		if hasVelocity {
+			v := encodeVelocity(n.Velocity)
+			for i := 0; i < count; i++ {
+				nd.velocities = append(nd.velocities, v)
+			}
+		}
+		if n.IsRest {
+			for i := 0; i < count; i++ {
+				nd.values = append(nd.values, restValue)
+			}
+		} else {
+			// Figure out the polyphony of this note.
+			var cc int = ChordSize
+			for i, v := range n.Value {
+				if v == 0 {
+					cc = i
+					break
+				}
+				if v >= restValue {
+					return nil, fmt.Errorf("note value out of range: %d", n.Value)
+				}
+			}
+			if cc == 0 {
+				return nil, errors.New("empty chord")
+			}
+			if cc > maxPolyphony {
+				return nil, fmt.Errorf("too much polyphony: chord has %d notes, maximum is %d (use split_voices to split the track)", cc, maxPolyphony)
+			}
+			// Emit polyphony change if necessary.
+			if curPolyphony != cc {
+				nd.values = append(nd.values, uint8(poly1+cc-1))
+			}
+			var nlast int
+			for i, v := range n.Value[:cc] {
+				// Relative to previous note in same voice, falls back to
+				// previous note in this chord.
+				if i < numVoices {
+					nlast = last[i]
+				}
+				vi := int(v)
+				delta := vi - nlast
+				if delta < 0 {
+					delta += restValue
+				}
+				nlast = vi
+				last[i] = vi
+				nd.values = append(nd.values, uint8(delta))
+			}
+			curPolyphony = cc
+			if cc > numVoices {
+				numVoices = cc
+			}
+			for i := cc; i < count*cc; i++ {
+				nd.values = append(nd.values, 0)
+			}
+		}
+	}
+	nd.values = append(nd.values, trackEnd)
+	if layout&layoutUniformDurations != 0 {
+		uniform := len(nd.durations) != 0
+		for _, d := range nd.durations {
+			if d != nd.durations[0] {
+				uniform = false
+				break
+			}
+		}
+		if uniform {
+			nd.durations = nd.durations[:1]
+		} else {
+			nd.durations = append([]uint8{0}, nd.durations...)
+		}
+	}
+	return &nd, nil
+}
+
+// compile compiles songs and sound effects, trying every layout and returning
+// the one which is smallest after compression. Drum tracks are expanded and
+// tracks with SplitVoices are split first, if necessary.
+func compile(snd *sounds, songs []*Song, sfx []*Sfx) (*Compiled, error) {
+	songs = splitVoices(expandDrums(songs))
+	var best *Compiled
+	var bestSize int
+	for layout := 0; layout < numLayouts; layout++ {
+		c, err := compileLayout(snd, songs, sfx, layout)
+		if err != nil {
+			return nil, err
+		}
+		n, err := deflatedSize(c.Data)
+		if err != nil {
+			return nil, err
+		}
+		if best == nil || n < bestSize {
+			best = c
+			bestSize = n
+		}
+	}
+	return best, nil
+}
+
+// compileLayout compiles songs and sound effects using the given layout. The
+// layoutAutomation flag is added if necessary.
+func compileLayout(snd *sounds, songs []*Song, sfx []*Sfx, layout int) (*Compiled, error) {
+	if hasAutomation(songs) {
+		layout |= layoutAutomation
+	}
 	/*
 		Data format:
 		N = embed.NumValues
 
 		byte: number of programs
 		byte: number of songs
+		byte: number of sound effects
+		byte: layout flags, see layoutTrackBase and the following constants,
+			and layoutAutomation
 		program[]: program data (length = number of programs)
 			Each program is a unique sound, stored as bytecode, which
 			constructs an audio processing graph.
@@ -92,93 +346,115 @@ func compile(snd *sounds, songs []*Song) (*Compiled, error) {
 			byte: tick duration, 1 = 2 ms
 			byte[2]: song length in ticks (big endian)
 				value = arr[0]*N + arr[1]
+			byte: number of tempo changes
+			tempo[]: tempo changes, in order
+				byte[2]: time of change in ticks, like song length
+				byte: new tick duration
 			track[]: track metadata
 			    byte: instrument, index into program array
 				byte: gain
 				byte: pan
-				byte: constant duration -- if nonzero, all note durations are this value
+				byte: flags and constant duration
+					bits 0-5: constant duration -- if nonzero, all note
+						durations are this value
+					bit 6: track has velocity values
 		byte[]: note values
-			Contains all tracks across all songs, in order, concatenated.
+			Contains all tracks across all songs, concatenated, in song
+			order or, with layoutTrackMajor, in track index order.
+			With layoutTrackBase, each track starts with its initial value.
 			Each track ends with N-1.
-			Rests are encoded as N-2.
-			Other notes are delta-encoded, per track, modulo N-2. The first value is delta encoded
-			relative to the starting point, 60.
+			Rests are encoded as N-6.
+			Polyphony changes are encoded as N-5 to N-2, for 1 to 4 voices.
+			Other notes are delta-encoded, per voice, modulo N-6, with one value
+			for each voice. The first value is delta encoded relative to the
+			starting point, 60, or the track's initial value. A voice which
+			has not played yet is delta encoded relative to the previous
+			voice in the same chord.
+			Notes and rests longer than N-1 ticks are split into several
+			values, each N-1 ticks long except the last. The extra values
+			for a note repeat the same note.
 		byte[]: duration values
-			Contains all tracks across all songs, in order, concatenated.
-			Each duration value is measured in ticks.
+			Contains all tracks, in the same order as note values.
+			Each duration value is measured in ticks, with one duration for
+			each note or rest in the note values.
+			With layoutUniformDurations, each track starts with a byte: 0 if
+			the durations follow, or the duration of every note and rest, in
+			which case no durations follow.
+		byte[]: velocity values
+			Contains only the tracks with velocity values, in the same
+			order as note values. There is one velocity for each duration
+			value, encoded as 127 minus the velocity.
+		With layoutInterleave, the note values, durations, and velocities
+		are instead stored together for each track, in the same order.
+		automation[]: with layoutAutomation, automation for each track, in the
+			same order as note values
+			byte: number of points
+			point[]: automation points, gain points first, then pan points,
+				each in order
+				byte[2]: time of point in ticks, like song length
+				byte: flags
+					bit 0: point is for pan, instead of gain
+					bits 1-2: ramp, see Ramp
+				byte: value, encoded like the track's gain or pan
+		sfx[]: sound effect data (length = number of sound effects)
+			byte: instrument, index into program array
+			byte: gain
+			byte: tick duration, like songs
+			byte: pitch sweep over each note, in semitones, plus (N-1)/2
+			byte: number of notes
+			note[]: notes and rests
+				byte: note value, or N-6 for a rest
+				byte: duration in ticks
 	*/
 	var soundnames, songnames []string
-	var songdata, values, durations []uint8
+	var tracknames [][]string
+	var songdata []uint8
 	var soundDats [][]byte
+	var parts partBuilder
 	instrIdx := make(map[string]int)
+	// instrument returns the index of an instrument in the program array,
+	// adding it if necessary.
+	instrument := func(name string) (int, bool) {
+		inum, ok := instrIdx[name]
+		if !ok {
+			idata, ok := snd.Instruments[name]
+			if !ok {
+				return 0, false
+			}
+			inum = len(soundDats)
+			soundDats = append(soundDats, idata)
+			instrIdx[name] = inum
+			soundnames = append(soundnames, name)
+		}
+		return inum, true
+	}
+	// Note data for each track, in song order, and the parts they belong to.
+	var tracks []*noteData
+	var trackParts, songParts []int
 	for _, sn := range songs {
 		songnames = append(songnames, sn.Info.Name)
-		// Write track note data, and calculate length of song.
-		var slen int
+		var tnames []string
 		for _, tr := range sn.Tracks {
+			tnames = append(tnames, tr.Name)
+		}
+		tracknames = append(tracknames, tnames)
+		spart := parts.add("song", sn.Info.Name)
+		// Encode track note data, and calculate length of song.
+		var slen int
+		t0 := len(tracks)
+		for i, tr := range sn.Tracks {
+			tpart := parts.add("track", sn.Info.Name+": "+tr.Name)
+			nd, err := encodeTrack(tr, layout)
+			if err != nil {
+				return nil, compileErrorf(sn, i, tr, "%v", err)
+			}
+			tracks = append(tracks, nd)
+			trackParts = append(trackParts, tpart)
+			songParts = append(songParts, spart)
 			var tlen int
-			var last [maxPolyphony]int
-			last[0] = startValue
-			curPolyphony := 1
 			for _, n := range tr.Notes {
-				count := 1
-				rem := n.Duration
-				for rem >= embed.NumValues {
-					count++
-					durations = append(durations, uint8(embed.NumValues-1))
-					rem -= embed.NumValues - 1
-				}
-				durations = append(durations, uint8(rem))
-				if n.IsRest {
-					for i := 0; i < count; i++ {
-						values = append(values, restValue)
-					}
-				} else {
-					// Figure out the polyphony of this note.
-					var cc int = ChordSize
-					for i, v := range n.Value {
-						if v == 0 {
-							cc = i
-							break
-						}
-						if v >= restValue {
-							return nil, fmt.Errorf("note value out of range: %d", n.Value)
-						}
-					}
-					if cc == 0 {
-						return nil, errors.New("empty chord")
-					}
-					if cc > maxPolyphony {
-						return nil, errors.New("too much polyphony")
-					}
-					// Emit polyphony change if necessary.
-					if curPolyphony != cc {
-						values = append(values, uint8(poly1+cc-1))
-					}
-					var nlast int
-					for i, v := range n.Value[:cc] {
-						// Relative to previous note in same voice, falls back
-						// to previous note in this chord.
-						if i < curPolyphony {
-							nlast = last[i]
-						}
-						vi := int(v)
-						delta := vi - nlast
-						if delta < 0 {
-							delta += restValue
-						}
-						nlast = vi
-						last[i] = vi
-						values = append(values, uint8(delta))
-					}
-					curPolyphony = cc
-					for i := cc; i < count*cc; i++ {
-						values = append(values, 0)
-					}
-				}
 				tlen += int(n.Duration)
 			}
-			values = append(values, trackEnd)
 			if tlen > slen {
 				slen = tlen
 			}
@@ -190,42 +466,49 @@ func compile(snd *sounds, songs []*Song) (*Compiled, error) {
 			return nil, fmt.Errorf("song too long: %d ticks", slen)
 		}
 		// Write song metadata.
-		tdenom := sn.Info.Tempo * float64(sn.Info.Division)
-		if tdenom == 0 {
-			return nil, errors.New("invalid tempo or division")
+		if err := sn.checkTempoMap(); err != nil {
+			return nil, fmt.Errorf("song %q: %v", sn.Info.Name, err)
 		}
-		ftick := (240 / baseTickLength) / tdenom
-		if !(ftick >= 1) {
-			return nil, fmt.Errorf("tick duration too small: %f ms", ftick)
+		itick, err := tickDuration(sn.Info.Tempo, sn.Info.Division)
+		if err != nil {
+			return nil, fmt.Errorf("song %q: division %d: %v", sn.Info.Name, sn.Info.Division, err)
 		}
-		if !(ftick <= 255) {
-			return nil, fmt.Errorf("tick duration too large: %f ms", ftick)
+		var changes []uint8
+		for _, c := range sn.TempoMap {
+			if c.Tempo == 0 {
+				continue
+			}
+			tick := sn.measureStart(c.Measure) + c.Offset
+			if tick >= embed.NumValues*embed.NumValues {
+				return nil, fmt.Errorf("song %q: tempo change too late: tick %d", sn.Info.Name, tick)
+			}
+			ctick, err := tickDuration(c.Tempo, sn.Info.Division)
+			if err != nil {
+				return nil, fmt.Errorf("song %q: tempo change in measure %d: %v", sn.Info.Name, c.Measure+1, err)
+			}
+			changes = append(changes,
+				uint8(tick/embed.NumValues),
+				uint8(tick%embed.NumValues),
+				uint8(ctick))
 		}
-		itick := int(math.RoundToEven(ftick))
-		if itick < 1 {
-			itick = 1
-		} else if itick > 255 {
-			itick = 255
+		if len(changes)/3 >= embed.NumValues {
+			return nil, fmt.Errorf("song %q: too many tempo changes", sn.Info.Name)
 		}
+		h0 := len(songdata)
 		songdata = append(songdata,
 			uint8(len(sn.Tracks)),
 			uint8(itick),
 			uint8(slen/embed.NumValues),
-			uint8(slen%embed.NumValues))
+			uint8(slen%embed.NumValues),
+			uint8(len(changes)/3))
+		songdata = append(songdata, changes...)
 		for i, tr := range sn.Tracks {
 			if tr.Instrument == "" {
 				return nil, compileErrorf(sn, i, tr, "track has no instrument")
 			}
-			inum, ok := instrIdx[tr.Instrument]
+			inum, ok := instrument(tr.Instrument)
 			if !ok {
-				idata, ok := snd.Instruments[tr.Instrument]
-				if !ok {
-					return nil, compileErrorf(sn, i, tr, "instrument does not exist: %q", tr.Instrument)
-				}
-				inum = len(soundDats)
-				soundDats = append(soundDats, idata)
-				instrIdx[tr.Instrument] = inum
-				soundnames = append(soundnames, tr.Instrument)
+				return nil, compileErrorf(sn, i, tr, "instrument does not exist: %q", tr.Instrument)
 			}
 			gain, err := encodeGain(sn.Info.GainDB + tr.GainDB)
 			if err != nil {
@@ -235,34 +518,179 @@ func compile(snd *sounds, songs []*Song) (*Compiled, error) {
 			if err != nil {
 				return nil, compileErrorf(sn, i, tr, "invalid pan")
 			}
-			songdata = append(songdata, uint8(inum), gain, pan, uint8(tr.ConstantDuration))
+			if layout&layoutAutomation != 0 {
+				tracks[t0+i].automation, err = encodeAutomation(sn, tr)
+				if err != nil {
+					return nil, compileErrorf(sn, i, tr, "%v", err)
+				}
+			}
+			flags := tr.ConstantDuration
+			if flags > constantDurationMask {
+				return nil, compileErrorf(sn, i, tr, "constant duration too long: %d, the maximum is %d",
+					tr.ConstantDuration, constantDurationMask)
+			}
+			if trackHasVelocity(tr) {
+				flags |= velocityFlag
+			}
+			if flags >= embed.NumValues {
+				return nil, compileErrorf(sn, i, tr, "constant duration too long for track with velocity: %d, the maximum is %d",
+					tr.ConstantDuration, maxVelocityConstantDuration)
+			}
+			parts.addSpan(spart+1+i, secSongs, len(songdata), len(songdata)+4)
+			songdata = append(songdata, uint8(inum), gain, pan, uint8(flags))
+		}
+		parts.addSpan(spart, secSongs, h0, len(songdata))
+	}
+	// Write track note data, in the order given by the layout.
+	order := make([]int, 0, len(tracks))
+	if layout&layoutTrackMajor != 0 {
+		for i := 0; len(order) < len(tracks); i++ {
+			var pos int
+			for _, sn := range songs {
+				if i < len(sn.Tracks) {
+					order = append(order, pos+i)
+				}
+				pos += len(sn.Tracks)
+			}
+		}
+	} else {
+		for i := range tracks {
+			order = append(order, i)
+		}
+	}
+	var notes, values, durations, velocities []uint8
+	write := func(section int, buf *[]uint8, i int, d []uint8) {
+		p0 := len(*buf)
+		*buf = append(*buf, d...)
+		parts.addSpan(trackParts[i], section, p0, len(*buf))
+		parts.addSpan(songParts[i], section, p0, len(*buf))
+	}
+	if layout&layoutInterleave != 0 {
+		for _, i := range order {
+			write(secNotes, &notes, i, tracks[i].values)
+			write(secNotes, &notes, i, tracks[i].durations)
+			write(secNotes, &notes, i, tracks[i].velocities)
+		}
+	} else {
+		for _, i := range order {
+			write(secValues, &values, i, tracks[i].values)
+		}
+		for _, i := range order {
+			write(secDurations, &durations, i, tracks[i].durations)
+		}
+		for _, i := range order {
+			write(secVelocities, &velocities, i, tracks[i].velocities)
+		}
+	}
+	var automation []uint8
+	if layout&layoutAutomation != 0 {
+		for _, i := range order {
+			write(secAutomation, &automation, i, tracks[i].automation)
+		}
+	}
+	var sfxnames []string
+	var sfxdata []uint8
+	for _, x := range sfx {
+		sfxnames = append(sfxnames, x.Name)
+		inum, ok := instrument(x.Instrument)
+		if !ok {
+			return nil, fmt.Errorf("sfx %q: instrument does not exist: %q", x.Name, x.Instrument)
+		}
+		gain, err := encodeGain(x.GainDB)
+		if err != nil {
+			return nil, fmt.Errorf("sfx %q: invalid gain", x.Name)
+		}
+		itick, err := tickDuration(x.Tempo, x.Division)
+		if err != nil {
+			return nil, fmt.Errorf("sfx %q: %v", x.Name, err)
+		}
+		if x.Sweep < -maxSweep || maxSweep < x.Sweep {
+			return nil, fmt.Errorf("sfx %q: sweep out of range: %d", x.Name, x.Sweep)
+		}
+		if len(x.Notes) >= embed.NumValues {
+			return nil, fmt.Errorf("sfx %q: too many notes", x.Name)
+		}
+		xpart := parts.add("sfx", x.Name)
+		x0 := len(sfxdata)
+		sfxdata = append(sfxdata, uint8(inum), gain, uint8(itick),
+			uint8(x.Sweep+maxSweep), uint8(len(x.Notes)))
+		for _, n := range x.Notes {
+			v := uint8(restValue)
+			if !n.IsRest {
+				v = n.Value[0]
+				if v == 0 || v >= restValue || n.Value[1] != 0 {
+					return nil, fmt.Errorf("sfx %q: invalid note: %v", x.Name, n.Value)
+				}
+			}
+			if n.Duration == 0 || n.Duration >= embed.NumValues {
+				return nil, fmt.Errorf("sfx %q: invalid duration: %d", x.Name, n.Duration)
+			}
+			sfxdata = append(sfxdata, v, n.Duration)
 		}
+		parts.addSpan(xpart, secSfx, x0, len(sfxdata))
+	}
+	if len(sfx) >= embed.NumValues {
+		return nil, errors.New("too many sound effects")
 	}
 	var data []byte
-	data = []byte{byte(len(soundDats)), byte(len(songs))}
-	for _, s := range soundDats {
+	data = []byte{byte(len(soundDats)), byte(len(songs)), byte(len(sfx)), byte(layout)}
+	var programs []byte
+	for i, s := range soundDats {
 		if len(s) >= embed.NumValues {
 			return nil, errors.New("sound is too long")
 		}
-		data = append(data, uint8(len(s)))
-		data = append(data, s...)
+		ipart := parts.add("instrument", soundnames[i])
+		p0 := len(programs)
+		programs = append(programs, uint8(len(s)))
+		programs = append(programs, s...)
+		parts.addSpan(ipart, secPrograms, p0, len(programs))
 	}
+	data = append(data, programs...)
 	data = append(data, songdata...)
+	data = append(data, notes...)
 	data = append(data, values...)
 	data = append(data, durations...)
+	data = append(data, velocities...)
+	data = append(data, automation...)
+	data = append(data, sfxdata...)
+	sizes := [numSections]int{
+		secHeader:     headerSize,
+		secPrograms:   len(programs),
+		secSongs:      len(songdata),
+		secNotes:      len(notes),
+		secValues:     len(values),
+		secDurations:  len(durations),
+		secVelocities: len(velocities),
+		secAutomation: len(automation),
+		secSfx:        len(sfxdata),
+	}
 	return &Compiled{
 		Data:       data,
 		SoundNames: soundnames,
 		SongNames:  songnames,
+		SfxNames:   sfxnames,
+		TrackNames: tracknames,
+		Layout:     layout,
+		Parts:      parts.finish(sizes),
 	}, nil
 }
 
 type songs struct {
 	Songs []string `json:"songs"`
+	// Sfx contains the files with sound effects, in @sfx sections.
+	Sfx []string `json:"sfx"`
+	// JSModule is the JavaScript module to generate with song, instrument, and
+	// sound effect indexes, relative to songs.json.
+	JSModule string `json:"jsModule"`
 }
 
+// Compile compiles the sounds, songs, and sound effects listed in a songs.json
+// file. The instruments are read from InstrumentsFile in the same directory.
+// If the instruments, any song, or any sound effect has errors, the error is an
+// ErrorList. The JavaScript module named by "jsModule" is not written; call
+// WriteJS on the result.
 func Compile(ctx context.Context, filename string) (*Compiled, error) {
-	snd, err := compileSounds(ctx, filepath.Join(filepath.Dir(filename), CodeFile))
+	snd, err := compileSounds(filepath.Join(filepath.Dir(filename), InstrumentsFile))
 	if err != nil {
 		return nil, err
 	}
@@ -277,6 +705,7 @@ func Compile(ctx context.Context, filename string) (*Compiled, error) {
 		return nil, fmt.Errorf("songs %s: %v", filename, err)
 	}
 	var sns []*Song
+	var errs ErrorList
 	dir := filepath.Dir(filename)
 	for _, name := range spec.Songs {
 		if err := ctx.Err(); err != nil {
@@ -286,11 +715,54 @@ func Compile(ctx context.Context, filename string) (*Compiled, error) {
 		if err != nil {
 			return nil, err
 		}
-		sn, err := Parse(data)
+		sn, err := ParseAll(data)
 		if err != nil {
-			return nil, fmt.Errorf("song %s: %v", name, err)
+			for _, e := range err.(ErrorList) {
+				e.File = name
+				errs = append(errs, e)
+			}
+			continue
 		}
 		sns = append(sns, sn)
 	}
-	return compile(snd, sns)
+	var sfx []*Sfx
+	sfxnames := make(map[string]string)
+	for _, name := range spec.Sfx {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		s, err := ParseSfx(data)
+		if err != nil {
+			for _, e := range err.(ErrorList) {
+				e.File = name
+				errs = append(errs, e)
+			}
+			continue
+		}
+		for _, x := range s {
+			if other, ok := sfxnames[x.Name]; ok {
+				errs = append(errs, &Error{
+					File: name,
+					Err:  fmt.Errorf("sound effect %q is also defined in %s", x.Name, other),
+				})
+			}
+			sfxnames[x.Name] = name
+		}
+		sfx = append(sfx, s...)
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	c, err := compile(snd, sns, sfx)
+	if err != nil {
+		return nil, err
+	}
+	if spec.JSModule != "" {
+		c.JSModule = filepath.Join(dir, spec.JSModule)
+	}
+	return c, nil
 }
@@ -0,0 +1,446 @@
+package song
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"moria.us/js13k/build/embed"
+)
+
+// A DecodedTrack is an instrument track decoded from compiled music data.
+type DecodedTrack struct {
+	// Instrument is the index of the track's instrument program.
+	Instrument int
+	// GainDB is the total gain for the track, including the song's gain.
+	GainDB           float64
+	Pan              float64
+	ConstantDuration int
+	Notes            []Note
+	// GainAutomation and PanAutomation contain the automation points for the
+	// track. Gain values include the song's gain, like GainDB.
+	GainAutomation []DecodedAutomationPoint
+	PanAutomation  []DecodedAutomationPoint
+
+	hasVelocity bool
+}
+
+// A DecodedAutomationPoint is an automation point for a track's gain or pan.
+type DecodedAutomationPoint struct {
+	// Tick is the time of the point, in ticks.
+	Tick  int
+	Value float64
+	Ramp  Ramp
+}
+
+// A DecodedTempoChange is a change in tick duration partway through a song.
+type DecodedTempoChange struct {
+	// Tick is the time of the change, in ticks.
+	Tick int
+	// TickDuration is the new length of a tick, in units of 2 ms.
+	TickDuration int
+}
+
+// A DecodedSong is a song decoded from compiled music data.
+type DecodedSong struct {
+	// TickDuration is the length of a tick at the start of the song, in units
+	// of 2 ms.
+	TickDuration int
+	// Duration is the length of the song, in ticks.
+	Duration     int
+	TempoChanges []DecodedTempoChange
+	Tracks       []*DecodedTrack
+}
+
+// A DecodedSfx is a sound effect decoded from compiled music data.
+type DecodedSfx struct {
+	// Instrument is the index of the effect's instrument program.
+	Instrument int
+	GainDB     float64
+	// TickDuration is the length of a tick, in units of 2 ms.
+	TickDuration int
+	Sweep        int
+	Notes        []Note
+}
+
+// Decoded is the contents of compiled music data.
+type Decoded struct {
+	// Layout contains the layout flags for the note data.
+	Layout   int
+	Programs [][]byte
+	Songs    []*DecodedSong
+	Sfx      []*DecodedSfx
+}
+
+func decodeGain(x uint8) float64 {
+	const exponent = 0.94
+	return float64(x) * (20 * math.Log10(exponent))
+}
+
+// decodeVelocity returns the velocity of a note. A velocity equal to
+// DefaultVelocity decodes as 0.
+func decodeVelocity(x uint8) uint8 {
+	v := MaxVelocity - int(x)
+	if v == DefaultVelocity {
+		return 0
+	}
+	return uint8(v)
+}
+
+func decodePan(x uint8) float64 {
+	const (
+		zero  = (embed.NumValues - 1) >> 1
+		scale = 60
+	)
+	return float64(int(x)-zero) / scale
+}
+
+var errTruncated = errors.New("unexpected end of data")
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if len(d.data)-d.pos < n {
+		return nil, errTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// A segment is a single note value with its own duration in the compiled
+// data. Notes and rests which are too long are split into several segments.
+type segment struct {
+	isRest bool
+	value  [ChordSize]uint8
+}
+
+// decodeValues decodes the note values for one track.
+func (d *decoder) decodeValues(layout int) ([]segment, error) {
+	var segs []segment
+	var last [maxPolyphony]int
+	last[0] = startValue
+	if layout&layoutTrackBase != 0 {
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == 0 || b[0] >= restValue {
+			return nil, fmt.Errorf("invalid initial value: %d", b[0])
+		}
+		last[0] = int(b[0])
+	}
+	polyphony := 1
+	numVoices := 1
+	for {
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		x := int(b[0])
+		switch {
+		case x == trackEnd:
+			return segs, nil
+		case x == restValue:
+			segs = append(segs, segment{isRest: true})
+		case x > restValue:
+			polyphony = x - poly1 + 1
+		default:
+			d.pos--
+			deltas, err := d.read(polyphony)
+			if err != nil {
+				return nil, err
+			}
+			var s segment
+			var prev int
+			for i, delta := range deltas {
+				if int(delta) >= restValue {
+					return nil, fmt.Errorf("invalid note delta in chord: %d", delta)
+				}
+				base := prev
+				if i < numVoices {
+					base = last[i]
+				}
+				v := (base + int(delta)) % restValue
+				if v == 0 {
+					return nil, errors.New("invalid note value: 0")
+				}
+				last[i] = v
+				prev = v
+				s.value[i] = uint8(v)
+			}
+			if polyphony > numVoices {
+				numVoices = polyphony
+			}
+			segs = append(segs, s)
+		}
+	}
+}
+
+// decodeDurations decodes the durations for one track, which has n segments.
+func (d *decoder) decodeDurations(layout, n int) ([]uint8, error) {
+	if layout&layoutUniformDurations != 0 {
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != 0 {
+			durs := make([]uint8, n)
+			for i := range durs {
+				durs[i] = b[0]
+			}
+			return durs, nil
+		}
+	}
+	return d.read(n)
+}
+
+// decodeAutomation decodes the automation points for one track.
+func (d *decoder) decodeAutomation(tr *DecodedTrack) error {
+	n, err := d.read(1)
+	if err != nil {
+		return err
+	}
+	points, err := d.read(4 * int(n[0]))
+	if err != nil {
+		return err
+	}
+	for ; len(points) != 0; points = points[4:] {
+		p := DecodedAutomationPoint{
+			Tick: int(points[0])*embed.NumValues + int(points[1]),
+			Ramp: Ramp(points[2] >> automationRampShift),
+		}
+		if p.Ramp > RampExponential {
+			return fmt.Errorf("invalid ramp: %d", p.Ramp)
+		}
+		lane := &tr.GainAutomation
+		if points[2]&automationPanFlag != 0 {
+			if p.Ramp == RampExponential {
+				return errors.New("exponential ramp for pan")
+			}
+			lane = &tr.PanAutomation
+			p.Value = decodePan(points[3])
+		} else {
+			p.Value = decodeGain(points[3])
+		}
+		if k := len(*lane); k != 0 && p.Tick <= (*lane)[k-1].Tick {
+			return errors.New("points out of order")
+		}
+		*lane = append(*lane, p)
+	}
+	return nil
+}
+
+// mergeSegments combines segments into notes, undoing the splitting of long
+// notes and rests done by the compiler. The encoding is ambiguous: a note
+// exactly embed.NumValues-1 ticks long, followed by the same note with the same
+// velocity, is decoded as a single note. If the track has no velocity values,
+// vels is nil.
+func mergeSegments(segs []segment, durs, vels []uint8) ([]Note, error) {
+	const splitLength = embed.NumValues - 1
+	var notes []Note
+	var lastDur uint8
+	for i, s := range segs {
+		dur := durs[i]
+		if dur == 0 {
+			return nil, errors.New("zero duration")
+		}
+		var vel uint8
+		if vels != nil && !s.isRest {
+			if vels[i] >= embed.NumValues {
+				return nil, fmt.Errorf("invalid velocity: %d", vels[i])
+			}
+			vel = decodeVelocity(vels[i])
+		}
+		if len(notes) != 0 && lastDur == splitLength {
+			n := &notes[len(notes)-1]
+			if n.IsRest == s.isRest && n.Value == s.value && n.Velocity == vel &&
+				int(n.Duration)+int(dur) <= math.MaxUint8 {
+				n.Duration += dur
+				lastDur = dur
+				continue
+			}
+		}
+		notes = append(notes, Note{
+			IsRest:   s.isRest,
+			Value:    s.value,
+			Duration: dur,
+			Velocity: vel,
+		})
+		lastDur = dur
+	}
+	return notes, nil
+}
+
+// Decode decodes compiled music data. This is the inverse of Compile, except
+// that song, sound effect, and instrument names are not present in the
+// compiled data. It should accept the same data that Load in audio.data.js
+// accepts.
+func Decode(data []byte) (*Decoded, error) {
+	d := decoder{data: data}
+	h, err := d.read(headerSize)
+	if err != nil {
+		return nil, err
+	}
+	nprograms := int(h[0])
+	nsongs := int(h[1])
+	nsfx := int(h[2])
+	layout := int(h[3])
+	if layout&^layoutAutomation >= numLayouts {
+		return nil, fmt.Errorf("invalid layout: %d", layout)
+	}
+	r := Decoded{Layout: layout}
+	for i := 0; i < nprograms; i++ {
+		n, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		p, err := d.read(int(n[0]))
+		if err != nil {
+			return nil, err
+		}
+		r.Programs = append(r.Programs, p)
+	}
+	var tracks []*DecodedTrack
+	for i := 0; i < nsongs; i++ {
+		h, err := d.read(5)
+		if err != nil {
+			return nil, err
+		}
+		sn := DecodedSong{
+			TickDuration: int(h[1]),
+			Duration:     int(h[2])*embed.NumValues + int(h[3]),
+		}
+		for j := 0; j < int(h[4]); j++ {
+			c, err := d.read(3)
+			if err != nil {
+				return nil, err
+			}
+			tc := DecodedTempoChange{
+				Tick:         int(c[0])*embed.NumValues + int(c[1]),
+				TickDuration: int(c[2]),
+			}
+			if n := len(sn.TempoChanges); n != 0 && tc.Tick <= sn.TempoChanges[n-1].Tick {
+				return nil, fmt.Errorf("song %d: tempo changes out of order", i+1)
+			}
+			sn.TempoChanges = append(sn.TempoChanges, tc)
+		}
+		for j := 0; j < int(h[0]); j++ {
+			t, err := d.read(4)
+			if err != nil {
+				return nil, err
+			}
+			if int(t[0]) >= nprograms {
+				return nil, fmt.Errorf("song %d track %d: invalid instrument: %d", i+1, j+1, t[0])
+			}
+			sn.Tracks = append(sn.Tracks, &DecodedTrack{
+				Instrument:       int(t[0]),
+				GainDB:           decodeGain(t[1]),
+				Pan:              decodePan(t[2]),
+				ConstantDuration: int(t[3]) & constantDurationMask,
+				hasVelocity:      t[3]&velocityFlag != 0,
+			})
+		}
+		tracks = append(tracks, sn.Tracks...)
+		r.Songs = append(r.Songs, &sn)
+	}
+	order := tracks
+	if layout&layoutTrackMajor != 0 {
+		order = nil
+		for i := 0; len(order) < len(tracks); i++ {
+			for _, sn := range r.Songs {
+				if i < len(sn.Tracks) {
+					order = append(order, sn.Tracks[i])
+				}
+			}
+		}
+	}
+	segs := make([][]segment, len(order))
+	durs := make([][]uint8, len(order))
+	vels := make([][]uint8, len(order))
+	// Each function decodes one part of the note data for a track.
+	values := func(i int) (err error) {
+		segs[i], err = d.decodeValues(layout)
+		return
+	}
+	durations := func(i int) (err error) {
+		durs[i], err = d.decodeDurations(layout, len(segs[i]))
+		return
+	}
+	velocities := func(i int) (err error) {
+		if order[i].hasVelocity {
+			vels[i], err = d.read(len(segs[i]))
+		}
+		return
+	}
+	if layout&layoutInterleave != 0 {
+		for i := range order {
+			for _, f := range [...]func(int) error{values, durations, velocities} {
+				if err := f(i); err != nil {
+					return nil, fmt.Errorf("track %d: %v", i+1, err)
+				}
+			}
+		}
+	} else {
+		for _, f := range [...]func(int) error{values, durations, velocities} {
+			for i := range order {
+				if err := f(i); err != nil {
+					return nil, fmt.Errorf("track %d: %v", i+1, err)
+				}
+			}
+		}
+	}
+	for i, tr := range order {
+		tr.Notes, err = mergeSegments(segs[i], durs[i], vels[i])
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %v", i+1, err)
+		}
+	}
+	if layout&layoutAutomation != 0 {
+		for i, tr := range order {
+			if err := d.decodeAutomation(tr); err != nil {
+				return nil, fmt.Errorf("track %d: automation: %v", i+1, err)
+			}
+		}
+	}
+	for i := 0; i < nsfx; i++ {
+		h, err := d.read(5)
+		if err != nil {
+			return nil, err
+		}
+		if int(h[0]) >= nprograms {
+			return nil, fmt.Errorf("sfx %d: invalid instrument: %d", i+1, h[0])
+		}
+		sfx := DecodedSfx{
+			Instrument:   int(h[0]),
+			GainDB:       decodeGain(h[1]),
+			TickDuration: int(h[2]),
+			Sweep:        int(h[3]) - maxSweep,
+		}
+		notes, err := d.read(2 * int(h[4]))
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < len(notes); j += 2 {
+			v, dur := notes[j], notes[j+1]
+			if v == 0 || v > restValue || dur == 0 || dur >= embed.NumValues {
+				return nil, fmt.Errorf("sfx %d: invalid note", i+1)
+			}
+			n := Note{Duration: dur}
+			if v == restValue {
+				n.IsRest = true
+			} else {
+				n.Value[0] = v
+			}
+			sfx.Notes = append(sfx.Notes, n)
+		}
+		r.Sfx = append(r.Sfx, &sfx)
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("extra data after end: %d bytes", len(data)-d.pos)
+	}
+	return &r, nil
+}
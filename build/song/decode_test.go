@@ -0,0 +1,392 @@
+package song
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"moria.us/js13k/build/embed"
+)
+
+var testInstruments = []string{"Bass", "Lead", "Drums"}
+
+func testSounds() *sounds {
+	s := sounds{Instruments: make(map[string][]byte)}
+	for i, name := range testInstruments {
+		s.Instruments[name] = []byte{3, 1, byte(i)}
+	}
+	return &s
+}
+
+// randomNotes returns a random sequence of notes, in the form that Parse
+// would produce.
+func randomNotes(r *rand.Rand) []Note {
+	var notes []Note
+	n := r.Intn(200)
+	for i := 0; i < n; i++ {
+		var nn Note
+		switch r.Intn(10) {
+		case 0:
+			// Long note.
+			nn.Duration = uint8(120 + r.Intn(136))
+		default:
+			nn.Duration = uint8(1 + r.Intn(32))
+		}
+		if r.Intn(5) == 0 {
+			nn.IsRest = true
+			if len(notes) != 0 && notes[len(notes)-1].IsRest {
+				// The parser coalesces rests.
+				last := &notes[len(notes)-1]
+				if int(last.Duration)+int(nn.Duration) <= math.MaxUint8 {
+					last.Duration += nn.Duration
+					continue
+				}
+				nn.Duration -= ^last.Duration
+				last.Duration = math.MaxUint8
+			}
+		} else {
+			var cc int
+			if r.Intn(3) == 0 {
+				cc = 1 + r.Intn(maxPolyphony)
+			} else {
+				cc = 1
+			}
+			for j := 0; j < cc; j++ {
+				nn.Value[j] = uint8(1 + r.Intn(restValue-1))
+			}
+			if len(notes) != 0 {
+				last := notes[len(notes)-1]
+				if last.Duration%(embed.NumValues-1) == 0 && last.Value == nn.Value {
+					// Ambiguous encoding, see mergeSegments.
+					continue
+				}
+			}
+		}
+		notes = append(notes, nn)
+	}
+	return notes
+}
+
+func randomSong(r *rand.Rand, n int) *Song {
+	sn := Song{
+		Info: Info{
+			Name:     fmt.Sprintf("Song %d", n),
+			Tempo:    float64(60 + r.Intn(120)),
+			Time:     TimeSignature{4, 2},
+			Division: 8 << uint(r.Intn(3)),
+			GainDB:   -float64(r.Intn(20)),
+		},
+	}
+	for m := 1 + r.Intn(8); r.Intn(3) != 0; m += 1 + r.Intn(8) {
+		c := TempoChange{Measure: m, Tempo: float64(60 + r.Intn(120))}
+		switch r.Intn(3) {
+		case 0:
+			c.Time = TimeSignature{2 + r.Intn(6), 2}
+		case 1:
+			c.Offset = r.Intn(sn.barLength(m))
+		}
+		if err := sn.addTempoChange(c); err != nil {
+			panic(err)
+		}
+	}
+	ntracks := 1 + r.Intn(4)
+	for i := 0; i < ntracks; i++ {
+		tr := Track{
+			Name:       fmt.Sprintf("Track %d", i),
+			Instrument: testInstruments[r.Intn(len(testInstruments))],
+			GainDB:     -float64(r.Intn(10)),
+			Pan:        float64(r.Intn(21)-10) / 10,
+			Notes:      randomNotes(r),
+		}
+		if r.Intn(4) == 0 {
+			tr.ConstantDuration = 1 + r.Intn(16)
+		}
+		if r.Intn(3) == 0 {
+			for j := range tr.Notes {
+				n := &tr.Notes[j]
+				if !n.IsRest && r.Intn(2) == 0 {
+					// Low velocities are clamped, and DefaultVelocity is
+					// decoded as 0.
+					n.Velocity = uint8(3 + r.Intn(MaxVelocity-2))
+					if n.Velocity == DefaultVelocity {
+						n.Velocity = 0
+					}
+				}
+			}
+		}
+		sn.Tracks = append(sn.Tracks, &tr)
+	}
+	return &sn
+}
+
+func randomSfx(r *rand.Rand, n int) *Sfx {
+	x := Sfx{
+		Name:       fmt.Sprintf("Sfx %d", n),
+		Instrument: testInstruments[r.Intn(len(testInstruments))],
+		Tempo:      float64(60 + r.Intn(120)),
+		Division:   8 << uint(r.Intn(3)),
+		GainDB:     -float64(r.Intn(20)),
+		Sweep:      r.Intn(2*maxSweep+1) - maxSweep,
+	}
+	for i := 1 + r.Intn(8); i > 0; i-- {
+		nn := Note{Duration: uint8(1 + r.Intn(embed.NumValues-1))}
+		if i > 1 && r.Intn(4) == 0 {
+			nn.IsRest = true
+		} else {
+			nn.Value[0] = uint8(1 + r.Intn(restValue-1))
+		}
+		x.Notes = append(x.Notes, nn)
+	}
+	return &x
+}
+
+// checkRoundTrip checks that the decoded songs and sound effects match the
+// originals.
+func checkRoundTrip(t *testing.T, songs []*Song, sfx []*Sfx) {
+	t.Helper()
+	c, err := compile(testSounds(), songs, sfx)
+	if err != nil {
+		t.Fatal("compile:", err)
+	}
+	checkDecode(t, c, songs, sfx)
+}
+
+// checkDecode checks that the compiled data decodes to the original songs and
+// sound effects.
+func checkDecode(t *testing.T, c *Compiled, songs []*Song, sfx []*Sfx) {
+	t.Helper()
+	d, err := Decode(c.Data)
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+	if len(d.Songs) != len(songs) {
+		t.Fatalf("got %d songs, expect %d", len(d.Songs), len(songs))
+	}
+	if len(d.Sfx) != len(sfx) {
+		t.Fatalf("got %d sound effects, expect %d", len(d.Sfx), len(sfx))
+	}
+	for i, x := range sfx {
+		dx := d.Sfx[i]
+		if name := c.SoundNames[dx.Instrument]; name != x.Instrument {
+			t.Errorf("sfx %d: instrument is %q, expect %q", i, name, x.Instrument)
+		}
+		if math.Abs(dx.GainDB-x.GainDB) > 0.3 {
+			t.Errorf("sfx %d: gain is %f dB, expect %f dB", i, dx.GainDB, x.GainDB)
+		}
+		if dx.Sweep != x.Sweep {
+			t.Errorf("sfx %d: sweep is %d, expect %d", i, dx.Sweep, x.Sweep)
+		}
+		if !reflect.DeepEqual(dx.Notes, x.Notes) {
+			t.Errorf("sfx %d: notes are %v, expect %v", i, dx.Notes, x.Notes)
+		}
+	}
+	for i, sn := range songs {
+		dsn := d.Songs[i]
+		if len(dsn.Tracks) != len(sn.Tracks) {
+			t.Errorf("song %d: got %d tracks, expect %d", i, len(dsn.Tracks), len(sn.Tracks))
+			continue
+		}
+		tick := 240 / BaseTickLength / (sn.Info.Tempo * float64(sn.Info.Division))
+		if math.Abs(float64(dsn.TickDuration)-tick) > 0.5 {
+			t.Errorf("song %d: tick duration is %d, expect %f", i, dsn.TickDuration, tick)
+		}
+		var changes []DecodedTempoChange
+		for _, c := range sn.TempoMap {
+			changes = append(changes, DecodedTempoChange{
+				Tick:         sn.measureStart(c.Measure) + c.Offset,
+				TickDuration: int(math.RoundToEven(240 / BaseTickLength / (c.Tempo * float64(sn.Info.Division)))),
+			})
+		}
+		if !reflect.DeepEqual(dsn.TempoChanges, changes) {
+			t.Errorf("song %d: tempo changes are %v, expect %v", i, dsn.TempoChanges, changes)
+		}
+		var length int
+		for j, tr := range sn.Tracks {
+			dtr := dsn.Tracks[j]
+			if name := c.SoundNames[dtr.Instrument]; name != tr.Instrument {
+				t.Errorf("song %d track %d: instrument is %q, expect %q", i, j, name, tr.Instrument)
+			}
+			if gain := sn.Info.GainDB + tr.GainDB; math.Abs(dtr.GainDB-gain) > 0.3 {
+				t.Errorf("song %d track %d: gain is %f dB, expect %f dB", i, j, dtr.GainDB, gain)
+			}
+			if math.Abs(dtr.Pan-tr.Pan) > 1.0/120 {
+				t.Errorf("song %d track %d: pan is %f, expect %f", i, j, dtr.Pan, tr.Pan)
+			}
+			if dtr.ConstantDuration != tr.ConstantDuration {
+				t.Errorf("song %d track %d: constant duration is %d, expect %d",
+					i, j, dtr.ConstantDuration, tr.ConstantDuration)
+			}
+			checkAutomation(t, fmt.Sprintf("song %d track %d gain", i, j), sn, tr.GainAutomation, dtr.GainAutomation, sn.Info.GainDB, 0.3)
+			checkAutomation(t, fmt.Sprintf("song %d track %d pan", i, j), sn, tr.PanAutomation, dtr.PanAutomation, 0, 1.0/120)
+			var tlen int
+			for _, n := range tr.Notes {
+				tlen += int(n.Duration)
+			}
+			if tlen > length {
+				length = tlen
+			}
+			if len(dtr.Notes) != len(tr.Notes) {
+				t.Errorf("song %d track %d: got %d notes, expect %d", i, j, len(dtr.Notes), len(tr.Notes))
+				continue
+			}
+			for k, n := range tr.Notes {
+				if dn := dtr.Notes[k]; dn != n {
+					t.Errorf("song %d track %d note %d: got %v, expect %v", i, j, k, dn, n)
+					break
+				}
+			}
+		}
+		if sn.Info.Duration != 0 {
+			length = sn.Info.Duration
+		}
+		if dsn.Duration != length {
+			t.Errorf("song %d: duration is %d, expect %d", i, dsn.Duration, length)
+		}
+	}
+}
+
+// checkAutomation checks that decoded automation points match the original
+// points, plus offset, within the given tolerance.
+func checkAutomation(t *testing.T, name string, sn *Song, points []AutomationPoint, decoded []DecodedAutomationPoint, offset, tolerance float64) {
+	t.Helper()
+	if len(decoded) != len(points) {
+		t.Errorf("%s: got %d automation points, expect %d", name, len(decoded), len(points))
+		return
+	}
+	for i, p := range points {
+		dp := decoded[i]
+		if tick := sn.measureStart(p.Measure) + p.Offset; dp.Tick != tick {
+			t.Errorf("%s point %d: tick is %d, expect %d", name, i, dp.Tick, tick)
+		}
+		if v := p.Value + offset; math.Abs(dp.Value-v) > tolerance {
+			t.Errorf("%s point %d: value is %f, expect %f", name, i, dp.Value, v)
+		}
+		if dp.Ramp != p.Ramp {
+			t.Errorf("%s point %d: ramp is %v, expect %v", name, i, dp.Ramp, p.Ramp)
+		}
+	}
+}
+
+func TestDecodeRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		var songs []*Song
+		n := 1 + r.Intn(3)
+		for j := 0; j < n; j++ {
+			songs = append(songs, randomSong(r, j))
+		}
+		var sfx []*Sfx
+		n = r.Intn(3)
+		for j := 0; j < n; j++ {
+			sfx = append(sfx, randomSfx(r, j))
+		}
+		checkRoundTrip(t, songs, sfx)
+		if t.Failed() {
+			break
+		}
+	}
+}
+
+func TestDecodeLayouts(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	songs := []*Song{randomSong(r, 0), randomSong(r, 1), randomSong(r, 2)}
+	// Test uniform durations.
+	for i := range songs[0].Tracks[0].Notes {
+		songs[0].Tracks[0].Notes[i].Duration = 4
+	}
+	for layout := 0; layout < numLayouts; layout++ {
+		c, err := compileLayout(testSounds(), songs, nil, layout)
+		if err != nil {
+			t.Fatal("compile:", err)
+		}
+		if c.Data[3] != byte(layout) {
+			t.Errorf("layout %d: header has layout %d", layout, c.Data[3])
+		}
+		checkDecode(t, c, songs, nil)
+		if t.Failed() {
+			t.Fatalf("layout %d failed", layout)
+		}
+	}
+}
+
+func TestDecodeSongFiles(t *testing.T) {
+	files, err := filepath.Glob("../../music/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skip("no song files")
+	}
+	var songs []*Song
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sn, err := Parse(data)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for i, tr := range sn.Tracks {
+			tr.Instrument = testInstruments[i%len(testInstruments)]
+		}
+		songs = append(songs, sn)
+	}
+	checkRoundTrip(t, songs, nil)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	c, err := compile(testSounds(), []*Song{randomSong(r, 0)}, []*Sfx{randomSfx(r, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(c.Data); n++ {
+		if _, err := Decode(c.Data[:n]); err == nil {
+			t.Errorf("Decode(data[:%d]): no error", n)
+		}
+	}
+	data := append([]byte(nil), c.Data...)
+	data = append(data, 0)
+	if _, err := Decode(data); err == nil || !strings.Contains(err.Error(), "extra data") {
+		t.Errorf("Decode with extra data: got %v", err)
+	}
+}
+
+func TestConstantDurationLimit(t *testing.T) {
+	cases := []struct {
+		duration int
+		velocity uint8
+		err      string
+	}{
+		{constantDurationMask, 0, ""},
+		{constantDurationMask + 1, 0, "maximum is 63"},
+		{maxVelocityConstantDuration, 80, ""},
+		{maxVelocityConstantDuration + 1, 80, "maximum is 60"},
+	}
+	for _, c := range cases {
+		r := rand.New(rand.NewSource(6))
+		sn := randomSong(r, 0)
+		tr := sn.Tracks[0]
+		tr.ConstantDuration = c.duration
+		tr.Notes = []Note{{Value: [ChordSize]uint8{60}, Duration: 4, Velocity: c.velocity}}
+		for _, tr := range sn.Tracks[1:] {
+			for i := range tr.Notes {
+				tr.Notes[i].Velocity = 0
+			}
+		}
+		_, err := compile(testSounds(), []*Song{sn}, nil)
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("constant duration %d, velocity %d: %v", c.duration, c.velocity, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("constant duration %d, velocity %d: got error %v, expect %q", c.duration, c.velocity, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package song
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Drum is a named drum in a song's kit. Drum tracks use drum names in place
+// of pitches, and each drum plays a fixed note on an instrument.
+type Drum struct {
+	Name       string
+	Instrument string
+	Value      uint8
+}
+
+// parseDrum parses a drum in a @kit section. The value is the instrument name
+// followed by the note, like "Kick c2".
+func parseDrum(name, value string) (Drum, error) {
+	if !isPatternName(name) || name[0] < 'a' || 'z' < name[0] {
+		return Drum{}, errors.New("drum names must start with a lowercase letter, and contain only letters, digits, and '_'")
+	}
+	i := strings.LastIndexAny(value, " \t")
+	if i == -1 {
+		return Drum{}, errors.New("expected instrument and note, like \"Kick c2\"")
+	}
+	inst := strings.TrimSpace(value[:i])
+	note := value[i+1:]
+	if note == "" || note[0] < 'a' || 'g' < note[0] {
+		return Drum{}, fmt.Errorf("invalid note: %q", note)
+	}
+	v, err := parseValue(note)
+	if err != nil {
+		return Drum{}, err
+	}
+	if v[1] != 0 {
+		return Drum{}, errors.New("drum must be a single note")
+	}
+	return Drum{Name: name, Instrument: inst, Value: v[0]}, nil
+}
+
+// kitIndex returns the index of the drum with the given name in the kit, or
+// -1 if there is no such drum.
+func kitIndex(kit []Drum, name string) int {
+	for i, d := range kit {
+		if d.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseDrums parses the drums in a drum track token, like "kick+hat". In drum
+// tracks, note values are indexes into the kit, plus one.
+func parseDrums(kit []Drum, text string) (values [ChordSize]uint8, err error) {
+	var n int
+	for _, name := range strings.Split(text, "+") {
+		i := kitIndex(kit, name)
+		if i == -1 {
+			return values, fmt.Errorf("unknown drum: %q", name)
+		}
+		v := uint8(i + 1)
+		var dup bool
+		for _, x := range values[:n] {
+			if x == v {
+				dup = true
+			}
+		}
+		if dup {
+			continue
+		}
+		if n >= ChordSize {
+			return values, errors.New("too many drums at the same time")
+		}
+		values[n] = v
+		n++
+	}
+	return values, nil
+}
+
+// formatDrums returns the text for the drums in a note in a drum track.
+func formatDrums(kit []Drum, value [ChordSize]uint8) (string, error) {
+	var names []string
+	for _, v := range value {
+		if v == 0 {
+			break
+		}
+		if int(v) > len(kit) {
+			return "", fmt.Errorf("invalid drum: %d", v)
+		}
+		names = append(names, kit[v-1].Name)
+	}
+	if len(names) == 0 {
+		return "", errors.New("empty chord")
+	}
+	return strings.Join(names, "+"), nil
+}
+
+// appendRest adds a rest to the end of a list of notes, merging it with the
+// previous rest if possible.
+func appendRest(notes []Note, dur uint8) []Note {
+	if k := len(notes) - 1; k >= 0 && notes[k].IsRest && int(notes[k].Duration)+int(dur) <= 0xff {
+		notes[k].Duration += dur
+		return notes
+	}
+	return append(notes, Note{IsRest: true, Duration: dur})
+}
+
+// expandDrumTrack converts a drum track into pitched tracks, one for each
+// instrument used by the track, in the order the instruments appear in the
+// kit. The new tracks are split if necessary, like tracks with SplitVoices.
+func expandDrumTrack(kit []Drum, tr *Track) []*Track {
+	var insts []string
+	used := make(map[string]bool)
+	for _, n := range tr.Notes {
+		for _, v := range n.Value {
+			if v == 0 {
+				break
+			}
+			used[kit[v-1].Instrument] = true
+		}
+	}
+	for _, d := range kit {
+		if used[d.Instrument] {
+			insts = append(insts, d.Instrument)
+			used[d.Instrument] = false
+		}
+	}
+	var tracks []*Track
+	for _, inst := range insts {
+		t := Track{
+			Name:             fmt.Sprintf("%s (%s)", tr.Name, inst),
+			Instrument:       inst,
+			GainDB:           tr.GainDB,
+			Pan:              tr.Pan,
+			ConstantDuration: tr.ConstantDuration,
+			GainAutomation:   tr.GainAutomation,
+			PanAutomation:    tr.PanAutomation,
+			SplitVoices:      true,
+		}
+		for _, n := range tr.Notes {
+			var values []uint8
+			if !n.IsRest {
+				for _, v := range n.Value {
+					if v == 0 {
+						break
+					}
+					d := kit[v-1]
+					if d.Instrument != inst {
+						continue
+					}
+					var dup bool
+					for _, x := range values {
+						if x == d.Value {
+							dup = true
+						}
+					}
+					if !dup {
+						values = append(values, d.Value)
+					}
+				}
+			}
+			if len(values) == 0 {
+				t.Notes = appendRest(t.Notes, n.Duration)
+				continue
+			}
+			sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+			nn := Note{Duration: n.Duration, Velocity: n.Velocity}
+			copy(nn.Value[:], values)
+			t.Notes = append(t.Notes, nn)
+		}
+		// Trailing rests are kept, so the new tracks are as long as the drum
+		// track, which may set the length of the song.
+		tracks = append(tracks, &t)
+	}
+	return tracks
+}
+
+// expandDrums returns the songs with every drum track replaced by pitched
+// tracks. The original songs are not modified.
+func expandDrums(songs []*Song) []*Song {
+	r := make([]*Song, len(songs))
+	for i, sn := range songs {
+		r[i] = sn
+		var tracks []*Track
+		var expanded bool
+		for _, tr := range sn.Tracks {
+			if tr.Drums {
+				tracks = append(tracks, expandDrumTrack(sn.Kit, tr)...)
+				expanded = true
+			} else {
+				tracks = append(tracks, tr)
+			}
+		}
+		if expanded {
+			nsn := *sn
+			nsn.Tracks = tracks
+			r[i] = &nsn
+		}
+	}
+	return r
+}
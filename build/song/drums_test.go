@@ -0,0 +1,155 @@
+package song
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const drumSong = `@info
+name: Beat
+tempo: 120
+division: 8
+
+@kit
+kick: Drums c2
+snare: Drums d2
+hat: Bass f#5
+
+@track
+name: Kit
+kind: drums
+
+kick+hat.2 hat.2 snare+hat.2 hat.2 |
+kick.2 r2 snare.2 kick+snare.2 |
+`
+
+func TestParseDrums(t *testing.T) {
+	sn, err := Parse([]byte(drumSong))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKit := []Drum{
+		{"kick", "Drums", 36},
+		{"snare", "Drums", 38},
+		{"hat", "Bass", 78},
+	}
+	if !reflect.DeepEqual(sn.Kit, expectKit) {
+		t.Errorf("kit is %v, expect %v", sn.Kit, expectKit)
+	}
+	text, err := Format(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn2, err := Parse(text)
+	if err != nil {
+		t.Fatalf("Parse(Format()): %v\n%s", err, text)
+	}
+	if !reflect.DeepEqual(sn, sn2) {
+		t.Errorf("Parse(Format()) does not match original:\n%s", text)
+	}
+
+	tracks := expandDrumTrack(sn.Kit, sn.Tracks[0])
+	note := func(values ...uint8) Note {
+		n := Note{Duration: 2}
+		copy(n.Value[:], values)
+		return n
+	}
+	expect := []Track{
+		{
+			Name:        "Kit (Drums)",
+			Instrument:  "Drums",
+			SplitVoices: true,
+			Notes: []Note{
+				note(36), {IsRest: true, Duration: 2}, note(38), {IsRest: true, Duration: 2},
+				note(36), {IsRest: true, Duration: 2}, note(38), note(36, 38),
+			},
+		},
+		{
+			Name:        "Kit (Bass)",
+			Instrument:  "Bass",
+			SplitVoices: true,
+			Notes:       []Note{note(78), note(78), note(78), note(78), {IsRest: true, Duration: 8}},
+		},
+	}
+	if len(tracks) != len(expect) {
+		t.Fatalf("got %d tracks, expect %d", len(tracks), len(expect))
+	}
+	for i, tr := range tracks {
+		if !reflect.DeepEqual(*tr, expect[i]) {
+			t.Errorf("track %d: got %v, expect %v", i, *tr, expect[i])
+		}
+	}
+}
+
+func TestDrumTrackDuration(t *testing.T) {
+	note := func(value uint8, dur uint8) Note {
+		n := Note{Duration: dur}
+		if value == 0 {
+			n.IsRest = true
+		} else {
+			n.Value[0] = value
+		}
+		return n
+	}
+	sn := Song{
+		Info: Info{Name: "Beat", Tempo: 120, Time: TimeSignature{4, 2}, Division: 8},
+		Kit: []Drum{
+			{"kick", "Drums", 36},
+			{"hat", "Bass", 78},
+		},
+		Tracks: []*Track{{
+			Name:  "Kit",
+			Drums: true,
+			// The track ends with a rest, and the hat ends before the kick.
+			Notes: []Note{note(1, 2), note(2, 2), note(0, 4), note(1, 2), note(0, 6)},
+		}},
+	}
+	c, err := compile(testSounds(), []*Song{&sn}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Decode(c.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn := d.Songs[0]
+	if dsn.Duration != 16 {
+		t.Errorf("duration is %d, expect 16", dsn.Duration)
+	}
+	for i, tr := range dsn.Tracks {
+		var n int
+		for _, nn := range tr.Notes {
+			n += int(nn.Duration)
+		}
+		if n != 16 {
+			t.Errorf("track %d: length is %d, expect 16", i, n)
+		}
+	}
+}
+
+func TestParseDrumErrors(t *testing.T) {
+	cases := []struct {
+		old, new string
+		err      string
+	}{
+		{"hat.2 |", "cymbal.2 |", "unknown drum: \"cymbal\""},
+		{"kick.2 r2", "c4.2 r2", "unknown drum: \"c4\""},
+		{"kind: drums", "kind: drums\ninstrument: Bass", "cannot have an instrument"},
+		{"kind: drums", "kind: cowbell", "unknown track kind"},
+		{"kick: Drums c2", "Kick: Drums c2", "lowercase letter"},
+		{"kick: Drums c2", "kick: c2", "expected instrument and note"},
+		{"kick: Drums c2", "kick: Drums c2e2", "single note"},
+		{"hat: Bass f#5", "kick: Bass f#5", "duplicate property"},
+		{"@kit\n", "@notkit\n", "unknown section"},
+	}
+	for _, c := range cases {
+		text := strings.Replace(drumSong, c.old, c.new, 1)
+		_, err := Parse([]byte(text))
+		if err == nil {
+			t.Errorf("%q: no error", c.new)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %q, expect %q", c.new, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package song
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var noteNames = [12]string{"c", "c#", "d", "d#", "e", "f", "f#", "g", "g#", "a", "a#", "b"}
+
+// formatValue returns the text for a note or chord value, without duration.
+func formatValue(value [ChordSize]uint8) (string, error) {
+	var b strings.Builder
+	for _, v := range value {
+		if v == 0 {
+			break
+		}
+		octave := int(v)/12 - 1
+		if octave < 0 {
+			return "", fmt.Errorf("note out of range: %d", v)
+		}
+		b.WriteString(noteNames[v%12])
+		b.WriteString(strconv.Itoa(octave))
+	}
+	if b.Len() == 0 {
+		return "", errors.New("empty chord")
+	}
+	return b.String(), nil
+}
+
+func formatNumber(x float64) string {
+	return strconv.FormatFloat(x, 'f', -1, 64)
+}
+
+func formatTimeSignature(t TimeSignature) string {
+	return fmt.Sprintf("%d/%d", t.Numerator, 1<<t.DenominatorLog2)
+}
+
+// formatVelocity returns the velocity or accent suffix for a note.
+func formatVelocity(v uint8) string {
+	switch v {
+	case 0:
+		return ""
+	case AccentVelocity:
+		return ">"
+	default:
+		return "v" + strconv.Itoa(int(v))
+	}
+}
+
+// formatPosition returns the text for a position in a song, which must be on a
+// beat. See parsePosition.
+func formatPosition(sn *Song, measure, offset int) (string, error) {
+	pos := strconv.Itoa(measure + 1)
+	if offset != 0 {
+		t := sn.timeSignature(measure)
+		beatlen := sn.Info.Division >> t.DenominatorLog2
+		if beatlen == 0 || offset%beatlen != 0 || beatlen<<t.DenominatorLog2 != sn.Info.Division {
+			return "", errors.New("not on a beat")
+		}
+		pos += ":" + strconv.Itoa(offset/beatlen+1)
+	}
+	return pos, nil
+}
+
+// formatTempoChange returns the line in the tempo map for a change. The change
+// must be on a beat.
+func formatTempoChange(sn *Song, c TempoChange) (string, error) {
+	pos, err := formatPosition(sn, c.Measure, c.Offset)
+	if err != nil {
+		return "", fmt.Errorf("tempo change in measure %d is not on a beat", c.Measure+1)
+	}
+	if c.Time.Numerator != 0 {
+		pos += " time=" + formatTimeSignature(c.Time)
+	}
+	if c.Tempo != 0 {
+		pos += " tempo=" + formatNumber(c.Tempo)
+	}
+	return pos, nil
+}
+
+// A measureWriter splits notes into measures.
+type measureWriter struct {
+	song     *Song
+	bar      int
+	barlen   int
+	time     int
+	barstart int
+	cur      []string
+	measures [][]string
+}
+
+// padding returns the length of the rest needed to fill the last measure,
+// after writing a note or rest with the given duration.
+func (w *measureWriter) padding(dur int) int {
+	time := w.time + dur
+	bar, barstart, barlen := w.bar, w.barstart, w.barlen
+	if time == barstart {
+		return 0
+	}
+	for time > barstart+barlen {
+		barstart += barlen
+		bar++
+		barlen = w.song.barLength(bar)
+	}
+	return barstart + barlen - time
+}
+
+// span writes tokens for a note or rest, splitting it at barlines. The first
+// token starts with first and ends with suffix, and the remaining tokens start
+// with rest.
+func (w *measureWriter) span(first, suffix, rest string, dur int) {
+	prefix := first
+	for dur > 0 {
+		n := w.barstart + w.barlen - w.time
+		if n > dur {
+			n = dur
+		}
+		if n > math.MaxUint8 {
+			n = math.MaxUint8
+		}
+		w.cur = append(w.cur, prefix+strconv.Itoa(n)+suffix)
+		prefix = rest
+		suffix = ""
+		dur -= n
+		w.time += n
+		if w.time == w.barstart+w.barlen {
+			w.measures = append(w.measures, w.cur)
+			w.cur = nil
+			w.barstart = w.time
+			w.bar++
+			w.barlen = w.song.barLength(w.bar)
+		}
+	}
+}
+
+// formatNotes returns the note data for a track, one measure per line. The
+// barlines are aligned. If drums is true, the notes are drums from the song's
+// kit.
+func formatNotes(sn *Song, notes []Note, drums bool) ([]string, error) {
+	w := measureWriter{song: sn, barlen: sn.barLength(0)}
+	var rest int
+	for _, n := range notes {
+		if n.IsRest {
+			rest += int(n.Duration)
+			continue
+		}
+		if rest > 0 {
+			w.span("r", "", "r", rest)
+			rest = 0
+		}
+		var v string
+		var err error
+		if drums {
+			v, err = formatDrums(sn.Kit, n.Value)
+		} else {
+			v, err = formatValue(n.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		w.span(v+".", formatVelocity(n.Velocity), "~", int(n.Duration))
+	}
+	// Pad the last measure with a rest.
+	rest += w.padding(rest)
+	if rest > 0 {
+		w.span("r", "", "r", rest)
+	}
+	var width int
+	lines := make([]string, len(w.measures))
+	for i, m := range w.measures {
+		lines[i] = strings.Join(m, " ")
+		if len(lines[i]) > width {
+			width = len(lines[i])
+		}
+	}
+	for i, line := range lines {
+		lines[i] = line + strings.Repeat(" ", width-len(line)) + " |"
+	}
+	return lines, nil
+}
+
+// writeComments writes comment lines from the original text.
+func writeComments(b *bytes.Buffer, comments []string) {
+	for _, c := range comments {
+		b.WriteString(c)
+		b.WriteByte('\n')
+	}
+}
+
+// A propWriter writes the properties of a section. If the section came from
+// song text, the comments before each property are written with it.
+type propWriter struct {
+	props []pair
+	done  map[string]bool
+	buf   bytes.Buffer
+}
+
+func (w *propWriter) prop(key, value string) {
+	for _, p := range w.props {
+		if p.key == key {
+			writeComments(&w.buf, p.comments)
+			if w.done == nil {
+				w.done = make(map[string]bool)
+			}
+			w.done[key] = true
+		}
+	}
+	w.buf.WriteString(key)
+	w.buf.WriteString(": ")
+	w.buf.WriteString(value)
+	w.buf.WriteByte('\n')
+}
+
+// writeTo writes the properties. The comments for properties which were
+// omitted, because they have default values, are written first.
+func (w *propWriter) writeTo(b *bytes.Buffer) {
+	for _, p := range w.props {
+		if !w.done[p.key] {
+			writeComments(b, p.comments)
+		}
+	}
+	b.Write(w.buf.Bytes())
+}
+
+func writeInfo(w *propWriter, info *Info) {
+	w.prop("name", info.Name)
+	if info.Composer != "" {
+		w.prop("composer", info.Composer)
+	}
+	w.prop("tempo", formatNumber(info.Tempo))
+	w.prop("time", formatTimeSignature(info.Time))
+	w.prop("division", strconv.Itoa(info.Division))
+	if info.GainDB != 0 {
+		w.prop("gain", formatNumber(info.GainDB))
+	}
+	if info.Duration != 0 {
+		w.prop("duration", strconv.Itoa(info.Duration))
+	}
+}
+
+func writeDrum(w *propWriter, d Drum) error {
+	v, err := formatValue([ChordSize]uint8{d.Value})
+	if err != nil {
+		return fmt.Errorf("drum %q: %v", d.Name, err)
+	}
+	w.prop(d.Name, d.Instrument+" "+v)
+	return nil
+}
+
+func writeTrack(w *propWriter, tr *Track) {
+	if tr.Name != "" {
+		w.prop("name", tr.Name)
+	}
+	if tr.Drums {
+		w.prop("kind", "drums")
+	}
+	if tr.Instrument != "" {
+		w.prop("instrument", tr.Instrument)
+	}
+	if tr.GainDB != 0 {
+		w.prop("gain", formatNumber(tr.GainDB))
+	}
+	if tr.Pan != 0 {
+		w.prop("pan", formatNumber(tr.Pan))
+	}
+	if tr.ConstantDuration != 0 {
+		w.prop("constant_duration", strconv.Itoa(tr.ConstantDuration))
+	}
+	if tr.SplitVoices {
+		w.prop("split_voices", "true")
+	}
+}
+
+func writeLines(b *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+}
+
+// Format returns the song as text, in canonical form. The output has one
+// measure per line, with aligned barlines, properties in a fixed order, and
+// adjacent rests merged. Patterns are expanded, and durations are written at
+// the song's division. To reformat song text without losing its notation or
+// comments, use FormatText.
+func Format(sn *Song) ([]byte, error) {
+	if err := sn.checkTempoMap(); err != nil {
+		return nil, err
+	}
+	if sn.barLength(0) <= 0 {
+		return nil, errors.New("invalid measure length")
+	}
+	var b bytes.Buffer
+	b.WriteString("@info\n")
+	var w propWriter
+	writeInfo(&w, &sn.Info)
+	w.writeTo(&b)
+	if len(sn.TempoMap) != 0 {
+		b.WriteString("\n@tempo\n\n")
+		for _, c := range sn.TempoMap {
+			line, err := formatTempoChange(sn, c)
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+	if len(sn.Kit) != 0 {
+		b.WriteString("\n@kit\n")
+		var w propWriter
+		for _, d := range sn.Kit {
+			if err := writeDrum(&w, d); err != nil {
+				return nil, err
+			}
+		}
+		w.writeTo(&b)
+	}
+	for i, tr := range sn.Tracks {
+		b.WriteString("\n@track\n")
+		var w propWriter
+		writeTrack(&w, tr)
+		w.writeTo(&b)
+		lines, err := formatNotes(sn, tr.Notes, tr.Drums)
+		if err != nil {
+			return nil, fmt.Errorf("track %d %q: %v", i+1, tr.Name, err)
+		}
+		if len(lines) != 0 {
+			b.WriteByte('\n')
+			writeLines(&b, lines)
+		}
+		if len(tr.GainAutomation) != 0 || len(tr.PanAutomation) != 0 {
+			lines, err := formatAutomation(sn, tr)
+			if err != nil {
+				return nil, fmt.Errorf("track %d %q: %v", i+1, tr.Name, err)
+			}
+			b.WriteString("\n@automation\n\n")
+			writeLines(&b, lines)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// isRest returns true if a token in note data is a rest, like "r4".
+func isRest(tok string) bool {
+	if len(tok) < 2 || tok[0] != 'r' {
+		return false
+	}
+	for _, c := range []byte(tok[1:]) {
+		if c < '0' || '9' < c {
+			return false
+		}
+	}
+	return true
+}
+
+// patternName returns the name of the pattern in a pattern reference, like
+// "*bass+5".
+func patternName(tok string) string {
+	name := tok[1:]
+	if i := strings.IndexAny(name, "+-"); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// barPatterns returns the names of the patterns which end with a barline,
+// either directly or by ending with a reference to another such pattern.
+func barPatterns(ss []section) map[string]bool {
+	last := make(map[string]string)
+	for _, s := range ss {
+		if s.kind != "pattern" || len(s.properties) == 0 || len(s.data) == 0 {
+			continue
+		}
+		f := strings.Fields(s.data[len(s.data)-1].data)
+		last[s.properties[0].value] = f[len(f)-1]
+	}
+	r := make(map[string]bool)
+	for name := range last {
+		seen := make(map[string]bool)
+		for n := name; !seen[n]; {
+			seen[n] = true
+			tok := last[n]
+			if tok == "|" {
+				r[name] = true
+			}
+			if tok == "" || tok[0] != '*' {
+				break
+			}
+			n = patternName(tok)
+		}
+	}
+	return r
+}
+
+// formatData returns the note data in a track or pattern, one measure per
+// line, with aligned barlines. The tokens from the original text are kept, so
+// patterns, tuplets, ties, and chord symbols are preserved. A reference to a
+// pattern in bars, which ends with a barline, also ends the line. Adjacent
+// rests outside tuplets are merged, if the merged rest is short enough at the
+// song's scale. Comments are written before the measure where the next data
+// line starts.
+func formatData(data []line, scale int, bars map[string]bool) []string {
+	var lines, comments, cur []string
+	var measures []int
+	var tuplet bool
+	measure := func(barline bool) {
+		lines = append(lines, comments...)
+		comments = nil
+		text := strings.Join(cur, " ")
+		cur = nil
+		if barline {
+			measures = append(measures, len(lines))
+		}
+		lines = append(lines, text)
+	}
+	for _, l := range data {
+		comments = append(comments, l.comments...)
+		for _, tok := range strings.Fields(l.data) {
+			switch {
+			case tok == "|":
+				measure(true)
+				continue
+			case tok[0] == '(':
+				tuplet = true
+			case tok == ")":
+				tuplet = false
+			case tok[0] == '*' && bars[patternName(tok)]:
+				cur = append(cur, tok)
+				measure(false)
+				continue
+			case !tuplet && isRest(tok) && len(cur) != 0 && isRest(cur[len(cur)-1]):
+				a, _ := strconv.Atoi(cur[len(cur)-1][1:])
+				b, _ := strconv.Atoi(tok[1:])
+				if (a+b)*scale <= math.MaxUint8 {
+					cur[len(cur)-1] = "r" + strconv.Itoa(a+b)
+					continue
+				}
+			}
+			cur = append(cur, tok)
+		}
+	}
+	if len(cur) != 0 {
+		measure(false)
+	}
+	lines = append(lines, comments...)
+	var width int
+	for _, i := range measures {
+		if len(lines[i]) > width {
+			width = len(lines[i])
+		}
+	}
+	for _, i := range measures {
+		lines[i] += strings.Repeat(" ", width-len(lines[i])) + " |"
+	}
+	return lines
+}
+
+// FormatText returns song text in canonical form, like Format, but keeps the
+// notation used in the text: patterns, tuplets, ties, chord symbols, and the
+// song's division are unchanged. Sections are kept in their original order.
+// Whole-line comments are kept with the section, property, or measure which
+// follows them.
+func FormatText(data []byte) ([]byte, error) {
+	sn, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	var errs ErrorList
+	ss := parseSections(data, &errs)
+	var b bytes.Buffer
+	scale := 1
+	var track *Track
+	var ntracks int
+	bars := barPatterns(ss)
+	for i, s := range ss {
+		if i != 0 {
+			b.WriteByte('\n')
+		}
+		writeComments(&b, s.comments)
+		b.WriteString("@" + s.kind + "\n")
+		w := propWriter{props: s.properties}
+		var lines []string
+		switch s.kind {
+		case "info":
+			var orig Info
+			for _, p := range s.properties {
+				orig.setProp(p.key, p.value)
+			}
+			scale = sn.Info.Division / orig.Division
+			info := sn.Info
+			info.Division /= scale
+			info.Duration /= scale
+			writeInfo(&w, &info)
+		case "tempo":
+			for j, l := range s.data {
+				line, err := formatTempoChange(sn, sn.TempoMap[j])
+				if err != nil {
+					return nil, err
+				}
+				lines = append(lines, l.comments...)
+				lines = append(lines, line)
+			}
+		case "kit":
+			for j := range s.properties {
+				if err := writeDrum(&w, sn.Kit[j]); err != nil {
+					return nil, err
+				}
+			}
+		case "track":
+			track = sn.Tracks[ntracks]
+			ntracks++
+			writeTrack(&w, track)
+			lines = formatData(s.data, scale, bars)
+		case "automation":
+			for _, l := range s.data {
+				var tr Track
+				if err := sn.parseAutomation(&tr, l.data); err != nil {
+					return nil, err
+				}
+				alines, err := formatAutomation(sn, &tr)
+				if err != nil {
+					return nil, fmt.Errorf("track %q: %v", track.Name, err)
+				}
+				lines = append(lines, l.comments...)
+				lines = append(lines, alines...)
+			}
+		case "pattern":
+			for _, p := range s.properties {
+				w.prop(p.key, p.value)
+			}
+			lines = formatData(s.data, scale, bars)
+		}
+		w.writeTo(&b)
+		if len(lines) != 0 {
+			b.WriteByte('\n')
+			writeLines(&b, lines)
+		}
+		writeComments(&b, s.trailing)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,163 @@
+package song
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	files, err := filepath.Glob("../../music/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skip("no song files")
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sn, err := Parse(data)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		text, err := Format(sn)
+		if err != nil {
+			t.Errorf("%s: Format: %v", file, err)
+			continue
+		}
+		sn2, err := Parse(text)
+		if err != nil {
+			t.Errorf("%s: Parse(Format()): %v", file, err)
+			continue
+		}
+		if !reflect.DeepEqual(sn, sn2) {
+			t.Errorf("%s: Parse(Format()) does not match original", file)
+		}
+		text2, err := Format(sn2)
+		if err != nil {
+			t.Errorf("%s: Format: %v", file, err)
+			continue
+		}
+		if !bytes.Equal(text, text2) {
+			t.Errorf("%s: Format is not idempotent", file)
+		}
+	}
+}
+
+func TestFormatTextFiles(t *testing.T) {
+	files, err := filepath.Glob("../../music/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skip("no song files")
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFormatText(t, file, data)
+	}
+}
+
+// checkFormatText checks that FormatText does not change the song, and that
+// the result is already formatted. Returns the formatted text.
+func checkFormatText(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	sn, err := Parse(data)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	text, err := FormatText(data)
+	if err != nil {
+		t.Fatalf("%s: FormatText: %v", name, err)
+	}
+	sn2, err := Parse(text)
+	if err != nil {
+		t.Fatalf("%s: Parse(FormatText()): %v\n%s", name, err, text)
+	}
+	if !reflect.DeepEqual(sn, sn2) {
+		t.Errorf("%s: Parse(FormatText()) does not match original:\n%s", name, text)
+	}
+	text2, err := FormatText(text)
+	if err != nil {
+		t.Fatalf("%s: FormatText: %v", name, err)
+	}
+	if !bytes.Equal(text, text2) {
+		t.Errorf("%s: FormatText is not idempotent:\n%s", name, text)
+	}
+	return text
+}
+
+func TestFormatTextComments(t *testing.T) {
+	const in = `; Song header.
+@info
+; The tempo.
+tempo: 120
+name: Comments
+; Default gain.
+gain: 0
+division: 4
+; End of info.
+
+; Next track.
+@track
+instrument: Lead
+; Lead name.
+name: Lead
+
+c4.2 r1
+; Middle of a measure.
+r1 | d4.4 |
+; Before a measure.
+e4.1 r1 r2
+ | f4.4
+
+; End of track.
+@automation
+
+; Fade out.
+2 gain=-6
+; End of file.
+`
+	const out = `; Song header.
+@info
+; Default gain.
+name: Comments
+; The tempo.
+tempo: 120
+time: 4/4
+division: 4
+
+; End of info.
+; Next track.
+@track
+; Lead name.
+name: Lead
+instrument: Lead
+
+; Middle of a measure.
+c4.2 r2 |
+d4.4    |
+; Before a measure.
+e4.1 r3 |
+f4.4
+
+; End of track.
+@automation
+
+; Fade out.
+2 gain=-6
+; End of file.
+`
+	text := checkFormatText(t, "comments", []byte(in))
+	if string(text) != out {
+		t.Errorf("FormatText:\n%s\nexpect:\n%s", text, out)
+	}
+}
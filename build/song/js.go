@@ -0,0 +1,98 @@
+package song
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// jsIdentifier converts a name to a JavaScript identifier with the given
+// prefix, by capitalizing each word and removing everything other than ASCII
+// letters and digits. For example, "The Light of Creation (Intro)" becomes
+// "TheLightOfCreationIntro". Returns an empty string if the name has no
+// letters or digits.
+func jsIdentifier(prefix, name string) string {
+	var b strings.Builder
+	start := true
+	for _, c := range []byte(name) {
+		switch {
+		case 'a' <= c && c <= 'z':
+			if start {
+				c -= 'a' - 'A'
+			}
+			fallthrough
+		case 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			if b.Len() == 0 {
+				b.WriteString(prefix)
+			}
+			b.WriteByte(c)
+			start = false
+		default:
+			start = true
+		}
+	}
+	return b.String()
+}
+
+// writeJSConst writes an exported numeric constant, with a comment.
+func writeJSConst(b *bytes.Buffer, comment, name string, value int) {
+	fmt.Fprintf(b, "\n/**\n * %s\n * @const {number}\n */\nexport const %s = %d;\n", comment, name, value)
+}
+
+// GenerateJS generates a JavaScript module which contains the index of each
+// song, instrument, and sound effect as a constant, so game code can refer to
+// them by name. An error is returned if two names in the same group map to the
+// same identifier.
+func (c *Compiled) GenerateJS() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("// Code generated by the music compiler from songs.json. DO NOT EDIT.\n")
+	groups := []struct {
+		prefix string
+		kind   string
+		count  string
+		names  []string
+	}{
+		{"Song", "song", "NumSongs", c.SongNames},
+		{"Instrument", "instrument", "NumInstruments", c.SoundNames},
+		{"Sfx", "sound effect", "NumSfx", c.SfxNames},
+	}
+	for _, g := range groups {
+		idents := make(map[string]string)
+		for i, name := range g.names {
+			id := jsIdentifier(g.prefix, name)
+			if id == "" {
+				return nil, fmt.Errorf("%s %q has no letters or digits for a JavaScript name", g.kind, name)
+			}
+			if other, ok := idents[id]; ok {
+				return nil, fmt.Errorf("%s %q and %q have the same JavaScript name: %s", g.kind, other, name, id)
+			}
+			idents[id] = name
+			writeJSConst(&b, fmt.Sprintf("Index of %s %q.", g.kind, name), id, i)
+		}
+		writeJSConst(&b, fmt.Sprintf("Number of %ss.", g.kind), g.count, len(g.names))
+	}
+	return b.Bytes(), nil
+}
+
+// WriteJS generates the JavaScript module and writes it to c.JSModule, if
+// set. The file is only written if its contents change, so tools watching the
+// source directory do not rebuild unnecessarily.
+func (c *Compiled) WriteJS() error {
+	if c.JSModule == "" {
+		return nil
+	}
+	data, err := c.GenerateJS()
+	if err != nil {
+		return err
+	}
+	old, err := ioutil.ReadFile(c.JSModule)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if bytes.Equal(old, data) {
+		return nil
+	}
+	return ioutil.WriteFile(c.JSModule, data, 0666)
+}
@@ -0,0 +1,54 @@
+package song
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSIdentifier(t *testing.T) {
+	cases := []struct {
+		name, expect string
+	}{
+		{"After Dark", "SongAfterDark"},
+		{"The Light of Creation (Intro)", "SongTheLightOfCreationIntro"},
+		{"bass_2", "SongBass2"},
+		{"x-ray", "SongXRay"},
+		{"3 Kick", "Song3Kick"},
+		{" ()", ""},
+	}
+	for _, c := range cases {
+		if id := jsIdentifier("Song", c.name); id != c.expect {
+			t.Errorf("%q: got %q, expect %q", c.name, id, c.expect)
+		}
+	}
+}
+
+func TestGenerateJS(t *testing.T) {
+	c := Compiled{
+		SongNames:  []string{"Intro", "Main Theme"},
+		SoundNames: []string{"Bass"},
+	}
+	data, err := c.GenerateJS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	for _, s := range []string{
+		"export const SongIntro = 0;\n",
+		"export const SongMainTheme = 1;\n",
+		"export const NumSongs = 2;\n",
+		"export const InstrumentBass = 0;\n",
+		"export const NumSfx = 0;\n",
+	} {
+		if !strings.Contains(text, s) {
+			t.Errorf("missing %q", s)
+		}
+	}
+
+	c = Compiled{SongNames: []string{"Main Theme", "main theme"}}
+	if _, err := c.GenerateJS(); err == nil {
+		t.Error("no error for duplicate identifier")
+	} else if !strings.Contains(err.Error(), "same JavaScript name") {
+		t.Errorf("got error %q", err)
+	}
+}
@@ -0,0 +1,225 @@
+package song
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"moria.us/js13k/build/embed"
+)
+
+// maxSweep is the largest pitch sweep for a sound effect, in semitones.
+const maxSweep = (embed.NumValues - 1) >> 1
+
+// An Sfx is a sound effect: a short sequence of notes played on an
+// instrument. Sound effects are not part of a song, and the game plays them
+// by index.
+type Sfx struct {
+	Name       string
+	Instrument string
+	Tempo      float64
+	Division   int
+	GainDB     float64
+	// Sweep is the change in pitch over the length of each note, in
+	// semitones.
+	Sweep int
+	// Notes contains the notes in the effect. Sound effects have a single
+	// voice, notes do not have velocity, and each note or rest is shorter than
+	// embed.NumValues ticks.
+	Notes []Note
+}
+
+func (s *Sfx) setProp(key, value string) error {
+	switch key {
+	case "name":
+		s.Name = value
+		return nil
+	case "instrument":
+		s.Instrument = value
+		return nil
+	case "tempo":
+		n, err := parseTempo(value)
+		if err != nil {
+			return err
+		}
+		s.Tempo = n
+		return nil
+	case "division":
+		n, err := strconv.ParseUint(value, 10, strconv.IntSize-1)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errors.New("division may not be 0")
+		}
+		s.Division = int(n)
+		return nil
+	case "gain":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		s.GainDB = n
+		return nil
+	case "sweep":
+		n, err := strconv.ParseInt(value, 10, 8)
+		if err != nil {
+			return err
+		}
+		if n < -maxSweep || maxSweep < n {
+			return fmt.Errorf("sweep must be in the range [%d, %d]", -maxSweep, maxSweep)
+		}
+		s.Sweep = int(n)
+		return nil
+	default:
+		return fmt.Errorf("unknown property key: %q", key)
+	}
+}
+
+// parseSfxDur parses the duration of a note or rest in a sound effect.
+func parseSfxDur(text string) (uint8, error) {
+	n, err := strconv.ParseUint(text, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid length: %v", err)
+	}
+	if n == 0 {
+		return 0, errors.New("zero length")
+	}
+	if n >= embed.NumValues {
+		return 0, fmt.Errorf("length %d is too long, maximum is %d", n, embed.NumValues-1)
+	}
+	return uint8(n), nil
+}
+
+// parseSfxToken parses a note or rest in a sound effect, like "c5.2" or "r4".
+func parseSfxToken(text string) (Note, error) {
+	if text[0] == 'r' {
+		dur, err := parseSfxDur(text[1:])
+		if err != nil {
+			return Note{}, err
+		}
+		return Note{IsRest: true, Duration: dur}, nil
+	}
+	if text[0] < 'a' || 'g' < text[0] {
+		return Note{}, errors.New("unknown token")
+	}
+	i := strings.IndexByte(text, '.')
+	if i == -1 {
+		return Note{}, errors.New("missing duration")
+	}
+	value, err := parseValue(text[:i])
+	if err != nil {
+		return Note{}, err
+	}
+	if value[1] != 0 {
+		return Note{}, errors.New("sound effects cannot have chords")
+	}
+	if value[0] >= restValue {
+		return Note{}, errors.New("note out of range")
+	}
+	dur, err := parseSfxDur(text[i+1:])
+	if err != nil {
+		return Note{}, err
+	}
+	return Note{Value: value, Duration: dur}, nil
+}
+
+// parseSfxSection parses a single @sfx section.
+func parseSfxSection(s *section, errs *ErrorList) *Sfx {
+	var sfx Sfx
+	for _, p := range s.properties {
+		if err := sfx.setProp(p.key, p.value); err != nil {
+			errs.add(p.lineno, err)
+		}
+	}
+	if sfx.Name == "" {
+		errs.add(s.lineno, errors.New("sound effect has no name"))
+	}
+	if sfx.Instrument == "" {
+		errs.add(s.lineno, errors.New("sound effect has no instrument"))
+	}
+	if sfx.Tempo == 0 {
+		errs.add(s.lineno, errors.New("missing tempo"))
+	}
+	if sfx.Division == 0 {
+		errs.add(s.lineno, errors.New("missing division"))
+	}
+	for _, l := range s.data {
+		var start int
+		text := l.data
+		for {
+			for start < len(text) && (text[start] == ' ' || text[start] == '\t') {
+				start++
+			}
+			end := start
+			for end < len(text) && text[end] != ' ' && text[end] != '\t' {
+				end++
+			}
+			if end == start {
+				break
+			}
+			tok := text[start:end]
+			n, err := parseSfxToken(tok)
+			if err != nil {
+				*errs = append(*errs, &Error{Line: l.lineno, Column: l.col + start, Err: &tokErr{tok, err}})
+			} else {
+				sfx.Notes = append(sfx.Notes, n)
+			}
+			start = end
+		}
+	}
+	for len(sfx.Notes) != 0 && sfx.Notes[len(sfx.Notes)-1].IsRest {
+		sfx.Notes = sfx.Notes[:len(sfx.Notes)-1]
+	}
+	if len(sfx.Notes) == 0 {
+		errs.add(s.lineno, errors.New("sound effect has no notes"))
+	}
+	return &sfx
+}
+
+// ParseSfx parses a file containing sound effects, each in its own @sfx
+// section. Properties give the effect's name, instrument, tempo, division,
+// gain, and pitch sweep, and the data contains notes and rests, without
+// barlines.
+//
+//	@sfx
+//	name: Pickup
+//	instrument: Pluck
+//	tempo: 120
+//	division: 16
+//	sweep: 12
+//
+//	c5.1 e5.1 g5.2
+//
+// If there are errors, the error is an ErrorList containing all of them,
+// sorted by position.
+func ParseSfx(data []byte) ([]*Sfx, error) {
+	var errs ErrorList
+	ss := parseSections(data, &errs)
+	var r []*Sfx
+	names := make(map[string]bool)
+	for i := range ss {
+		s := &ss[i]
+		switch s.kind {
+		case "sfx":
+			sfx := parseSfxSection(s, &errs)
+			if sfx.Name != "" {
+				if names[sfx.Name] {
+					errs.add(s.lineno, fmt.Errorf("duplicate sound effect name: %q", sfx.Name))
+				}
+				names[sfx.Name] = true
+			}
+			r = append(r, sfx)
+		case "":
+			// Missing section kind, already reported.
+		default:
+			errs.add(s.lineno, fmt.Errorf("unknown section: %q", s.kind))
+		}
+	}
+	if len(errs) != 0 {
+		errs.Sort()
+		return nil, errs
+	}
+	return r, nil
+}
@@ -0,0 +1,83 @@
+package song
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSfx = `@sfx
+name: Pickup
+instrument: Pluck
+tempo: 120
+division: 16
+gain: -6
+sweep: 12
+
+c5.1 e5.1
+  r2 g5.2 r4
+
+@sfx
+name: Device
+instrument: Keys
+tempo: 90
+division: 8
+
+c3.8
+`
+
+func TestParseSfx(t *testing.T) {
+	sfx, err := ParseSfx([]byte(testSfx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := func(v, dur uint8) Note {
+		return Note{Value: [ChordSize]uint8{v}, Duration: dur}
+	}
+	expect := []*Sfx{
+		{
+			Name:       "Pickup",
+			Instrument: "Pluck",
+			Tempo:      120,
+			Division:   16,
+			GainDB:     -6,
+			Sweep:      12,
+			Notes:      []Note{note(72, 1), note(76, 1), {IsRest: true, Duration: 2}, note(79, 2)},
+		},
+		{
+			Name:       "Device",
+			Instrument: "Keys",
+			Tempo:      90,
+			Division:   8,
+			Notes:      []Note{note(48, 8)},
+		},
+	}
+	if !reflect.DeepEqual(sfx, expect) {
+		t.Errorf("got %+v, expect %+v", sfx, expect)
+	}
+}
+
+func TestParseSfxErrors(t *testing.T) {
+	cases := []struct {
+		old, new string
+		err      string
+	}{
+		{"name: Device", "name: Pickup", "12: duplicate sound effect"},
+		{"instrument: Keys\n", "", "12: sound effect has no instrument"},
+		{"sweep: 12", "sweep: 63", "sweep must be"},
+		{"c5.1 e5.1", "c5e5.1", "chords"},
+		{"c5.1 e5.1", "c5.1 e5.125", "too long"},
+		{"  r2 g5.2", "  r2 | g5.2", "10:6: invalid token"},
+		{"c3.8", "r8", "no notes"},
+		{"@sfx\nname: Device", "@song\nname: Device", "unknown section"},
+	}
+	for _, c := range cases {
+		text := strings.Replace(testSfx, c.old, c.new, 1)
+		_, err := ParseSfx([]byte(text))
+		if err == nil {
+			t.Errorf("%q: no error", c.new)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %q, expect %q", c.new, err, c.err)
+		}
+	}
+}
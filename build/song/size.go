@@ -0,0 +1,176 @@
+package song
+
+import (
+	"bytes"
+	"compress/flate"
+	"sort"
+)
+
+// Sections of compiled data.
+const (
+	secHeader = iota
+	secPrograms
+	secSongs
+	secNotes
+	secValues
+	secDurations
+	secVelocities
+	secAutomation
+	secSfx
+	numSections
+)
+
+var sectionNames = [numSections]string{
+	"header",
+	"programs",
+	"song headers",
+	"interleaved notes",
+	"note values",
+	"durations",
+	"velocities",
+	"automation",
+	"sound effects",
+}
+
+// A span is a range of bytes in one section of compiled data, before the
+// sections are concatenated.
+type span struct {
+	section    int
+	start, end int
+}
+
+// A Range is a range of bytes in compiled data, from Start up to but not
+// including End.
+type Range struct {
+	Start, End int
+}
+
+// A Part is a part of the compiler input, like a section, song, track,
+// instrument, or sound effect, and the compiled data it produces.
+type Part struct {
+	// Kind is "section", "song", "track", "instrument", or "sfx".
+	Kind string
+	Name string
+	// Ranges are the bytes in the compiled data that came from this part, in
+	// order. A track's bytes are also part of its song.
+	Ranges []Range
+}
+
+// Size returns the number of bytes of compiled data that came from the part.
+func (p *Part) Size() int {
+	var n int
+	for _, r := range p.Ranges {
+		n += r.End - r.Start
+	}
+	return n
+}
+
+// partBuilder records which parts of the input produce which bytes of output,
+// while compiling.
+type partBuilder struct {
+	parts []Part
+	spans [][]span
+}
+
+// add adds a new part and returns its index.
+func (b *partBuilder) add(kind, name string) int {
+	b.parts = append(b.parts, Part{Kind: kind, Name: name})
+	b.spans = append(b.spans, nil)
+	return len(b.parts) - 1
+}
+
+// addSpan adds bytes from one section to a part.
+func (b *partBuilder) addSpan(part, section, start, end int) {
+	if start < end {
+		b.spans[part] = append(b.spans[part], span{section, start, end})
+	}
+}
+
+// finish returns the parts, given the length of each section. The sections
+// themselves are returned first, except for empty sections.
+func (b *partBuilder) finish(sizes [numSections]int) []Part {
+	var offsets [numSections]int
+	var parts []Part
+	var pos int
+	for i, n := range sizes {
+		offsets[i] = pos
+		if n == 0 {
+			continue
+		}
+		parts = append(parts, Part{
+			Kind:   "section",
+			Name:   sectionNames[i],
+			Ranges: []Range{{pos, pos + n}},
+		})
+		pos += n
+	}
+	for i, p := range b.parts {
+		for _, s := range b.spans[i] {
+			off := offsets[s.section]
+			p.Ranges = append(p.Ranges, Range{off + s.start, off + s.end})
+		}
+		sort.Slice(p.Ranges, func(i, j int) bool {
+			return p.Ranges[i].Start < p.Ranges[j].Start
+		})
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// deflatedSize returns the size of the data after compressing it. The data is
+// compressed without encoding it for embedding first, since the encoding maps
+// each byte to a different byte, and does not change the compressed size.
+func deflatedSize(data []byte) (int, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return buf.Len(), nil
+}
+
+// A PartSize is the contribution of one part to the size of the compiled
+// data.
+type PartSize struct {
+	Part *Part
+	// Size is the number of bytes in the compiled data.
+	Size int
+	// Deflated is the number of bytes the part adds to the compressed data.
+	// This is the difference in compressed size between the data with and
+	// without the part's bytes, so it may be negative.
+	Deflated int
+}
+
+// Sizes measures how much each part contributes to the size of the data,
+// before and after compression. Compression is estimated with DEFLATE, which
+// is close to, but not quite as good as, the zopfli compression used for the
+// final build. The deflated size of all the data is also returned.
+func (c *Compiled) Sizes() ([]PartSize, int, error) {
+	total, err := deflatedSize(c.Data)
+	if err != nil {
+		return nil, 0, err
+	}
+	r := make([]PartSize, len(c.Parts))
+	for i := range c.Parts {
+		p := &c.Parts[i]
+		var data []byte
+		var pos int
+		for _, rg := range p.Ranges {
+			data = append(data, c.Data[pos:rg.Start]...)
+			pos = rg.End
+		}
+		data = append(data, c.Data[pos:]...)
+		n, err := deflatedSize(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		r[i] = PartSize{Part: p, Size: p.Size(), Deflated: total - n}
+	}
+	return r, total, nil
+}
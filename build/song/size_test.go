@@ -0,0 +1,76 @@
+package song
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestParts(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	songs := []*Song{randomSong(r, 0), randomSong(r, 1)}
+	sfx := []*Sfx{randomSfx(r, 0)}
+	c, err := compile(testSounds(), songs, sfx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each byte must be in exactly one section, and in exactly one song,
+	// instrument, or sound effect (except the header). Each track byte must be
+	// in the song before it.
+	sections := make([]int, len(c.Data))
+	owners := make([]int, len(c.Data))
+	var song *Part
+	for i := range c.Parts {
+		p := &c.Parts[i]
+		for _, rg := range p.Ranges {
+			for j := rg.Start; j < rg.End; j++ {
+				switch p.Kind {
+				case "section":
+					sections[j]++
+				case "track":
+					if !contains(song, j) {
+						t.Errorf("track %q: byte %d is not in song", p.Name, j)
+					}
+				default:
+					owners[j]++
+				}
+			}
+		}
+		if p.Kind == "song" {
+			song = p
+		}
+	}
+	for i := range c.Data {
+		if sections[i] != 1 {
+			t.Errorf("byte %d: in %d sections", i, sections[i])
+		}
+		expect := 1
+		if i < headerSize {
+			expect = 0
+		}
+		if owners[i] != expect {
+			t.Errorf("byte %d: in %d parts, expect %d", i, owners[i], expect)
+		}
+	}
+	sizes, total, err := c.Sizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != len(c.Parts) {
+		t.Fatalf("got %d sizes, expect %d", len(sizes), len(c.Parts))
+	}
+	if total <= 0 {
+		t.Errorf("total deflated size is %d", total)
+	}
+}
+
+func contains(p *Part, i int) bool {
+	if p == nil {
+		return false
+	}
+	for _, rg := range p.Ranges {
+		if rg.Start <= i && i < rg.End {
+			return true
+		}
+	}
+	return false
+}
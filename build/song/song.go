@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -38,6 +40,16 @@ type TrackInfo struct {
 
 const ChordSize = 8
 
+// Note velocities, which use the same scale as MIDI.
+const (
+	// DefaultVelocity is the velocity of notes which do not specify one.
+	DefaultVelocity = 100
+	// AccentVelocity is the velocity of accented notes.
+	AccentVelocity = 127
+	// MaxVelocity is the maximum velocity of a note.
+	MaxVelocity = 127
+)
+
 // A Note is an individual note in an instrument track. A note does not store
 // the time when it starts, instead, a note starts when the previous note
 // finishes.
@@ -45,34 +57,82 @@ type Note struct {
 	IsRest   bool
 	Value    [ChordSize]uint8
 	Duration uint8
+	// Velocity is the velocity of the note, from 1 to MaxVelocity, or 0 if
+	// the note uses DefaultVelocity. Rests have zero velocity.
+	Velocity uint8
 }
 
 // A Track is an individual instrument track within a song.
 type Track struct {
-	Name             string
-	Instrument       string
-	GainDB           float64
-	Pan              float64
+	Name       string
+	Instrument string
+	GainDB     float64
+	Pan        float64
+	// ConstantDuration is the length of every note, in ticks, or zero if each
+	// note lasts for its written duration. The compiled data stores it in the
+	// same byte as the track flags, so it may be at most 63, or 60 if any note
+	// in the track has a velocity.
 	ConstantDuration int
-	Notes            []Note
+	// SplitVoices is true if the track should be split into several tracks
+	// when compiled, if it has chords with more than four notes.
+	SplitVoices bool
+	// Drums is true if the track is a drum track. Drum tracks have no
+	// instrument, and their note values are indexes into the song's kit,
+	// plus one. When compiled, each drum track becomes one track for each
+	// instrument it uses.
+	Drums bool
+	Notes []Note
+	// GainAutomation and PanAutomation contain the automation points for the
+	// track's gain and pan, in order. Before the first point, the track uses
+	// GainDB and Pan.
+	GainAutomation []AutomationPoint
+	PanAutomation  []AutomationPoint
+}
+
+// A TempoChange is a change in tempo or time signature partway through a
+// song. Time signature changes happen at the start of a measure, but tempo
+// changes may happen on any beat.
+type TempoChange struct {
+	// Measure is the measure where the change happens, counting from zero.
+	Measure int
+	// Offset is the time within the measure where the change happens, in
+	// divisions.
+	Offset int
+	// Tempo is the new tempo, or zero if the tempo does not change.
+	Tempo float64
+	// Time is the new time signature, or zero if the time signature does not
+	// change.
+	Time TimeSignature
 }
 
 // A Song is a complete piece of music.
 type Song struct {
-	Info   Info
+	Info Info
+	// TempoMap contains the changes in tempo and time signature, in order.
+	TempoMap []TempoChange
+	// Kit contains the drums used by drum tracks.
+	Kit    []Drum
 	Tracks []*Track
 }
 
 // =============================================================================
 
+// Comments are whole lines starting with ';'. Each comment is kept with the
+// section header, property, or data line which follows it, so they can be
+// preserved by FormatText.
+
 type pair struct {
 	lineno     int
 	key, value string
+	comments   []string
 }
 
 type line struct {
 	lineno int
-	data   string
+	// col is the column where the data starts, counting from 1.
+	col      int
+	data     string
+	comments []string
 }
 
 type section struct {
@@ -80,6 +140,10 @@ type section struct {
 	kind       string
 	properties []pair
 	data       []line
+	comments   []string
+	// trailing contains the comments at the end of the file, if this is the
+	// last section.
+	trailing []string
 }
 
 func splitLine(data []byte) (line, rest []byte) {
@@ -113,15 +177,27 @@ func trim(d []byte) []byte {
 	return d
 }
 
+// An Error is an error at a specific location in a song file.
 type Error struct {
-	Line int
-	Err  error
+	// File is the name of the song file, if known.
+	File string
+	// Line and Column are the position of the error, counting from 1. They
+	// are zero if unknown.
+	Line   int
+	Column int
+	Err    error
 }
 
 func (e *Error) Error() string {
 	var s string
+	if e.File != "" {
+		s += e.File + ":"
+	}
 	if e.Line != 0 {
 		s += strconv.Itoa(e.Line) + ":"
+		if e.Column != 0 {
+			s += strconv.Itoa(e.Column) + ":"
+		}
 	}
 	if s != "" {
 		s += " "
@@ -130,7 +206,40 @@ func (e *Error) Error() string {
 	return s
 }
 
-func parseSections(data []byte) ([]section, error) {
+// An ErrorList is a list of errors in song files.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// Sort sorts the list by file and position.
+func (l ErrorList) Sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := l[i], l[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+func (l *ErrorList) add(line int, err error) {
+	*l = append(*l, &Error{Line: line, Err: err})
+}
+
+// parseSections splits a song file into sections. Lines with errors are
+// skipped.
+func parseSections(data []byte, errs *ErrorList) []section {
 	const (
 		stateInit = iota
 		stateProperty
@@ -140,10 +249,13 @@ func parseSections(data []byte) ([]section, error) {
 	var wasblank bool
 	var ss []section
 	var s section
+	var comments []string
 	keys := make(map[string]bool, 16)
+lines:
 	for lineno := 1; len(data) != 0; lineno++ {
 		var text []byte
 		text, data = splitLine(data)
+		col := len(text) - len(bytes.TrimLeft(text, " \t")) + 1
 		text = trim(text)
 		if len(text) == 0 {
 			if !wasblank {
@@ -156,14 +268,17 @@ func parseSections(data []byte) ([]section, error) {
 		}
 		wasblank = false
 		if !utf8.Valid(text) {
-			return nil, &Error{lineno, errors.New("invalid UTF-8")}
+			errs.add(lineno, errors.New("invalid UTF-8"))
+			continue
 		}
 		for _, c := range text {
 			if c < 32 || 127 == c {
-				return nil, &Error{lineno, fmt.Errorf("invalid control character: 0x%02x", c)}
+				errs.add(lineno, fmt.Errorf("invalid control character: 0x%02x", c))
+				continue lines
 			}
 		}
 		if text[0] == ';' {
+			comments = append(comments, string(text))
 			continue
 		}
 		if text[0] == '@' {
@@ -172,15 +287,14 @@ func parseSections(data []byte) ([]section, error) {
 			}
 			kind := trim(text[1:])
 			if len(kind) == 0 {
-				return nil, &Error{lineno, errors.New("missing section kind")}
-			}
-			if !utf8.Valid(kind) {
-				return nil, &Error{lineno, errors.New("invalid UTF-8")}
+				errs.add(lineno, errors.New("missing section kind"))
 			}
 			s = section{
-				lineno: lineno,
-				kind:   string(kind),
+				lineno:   lineno,
+				kind:     string(kind),
+				comments: comments,
 			}
+			comments = nil
 			state = stateProperty
 			for k := range keys {
 				delete(keys, k)
@@ -189,37 +303,44 @@ func parseSections(data []byte) ([]section, error) {
 		}
 		switch state {
 		case stateInit:
-			return nil, &Error{lineno, errors.New("expected directive before data")}
+			errs.add(lineno, errors.New("expected directive before data"))
 		case stateProperty:
 			i := bytes.IndexByte(text, ':')
 			if i == -1 {
-				return nil, &Error{lineno, errors.New("expected ':' in property")}
+				errs.add(lineno, errors.New("expected ':' in property"))
+				continue
 			}
 			key := trim(text[:i])
 			value := trim(text[i+1:])
 			if len(key) == 0 {
-				return nil, &Error{lineno, errors.New("empty key")}
+				errs.add(lineno, errors.New("empty key"))
+				continue
 			}
 			k := string(key)
-			s.properties = append(s.properties, pair{
-				lineno: lineno,
-				key:    k,
-				value:  string(value),
-			})
 			if keys[k] {
-				return nil, &Error{lineno, fmt.Errorf("duplicate property: %q", k)}
+				errs.add(lineno, fmt.Errorf("duplicate property: %q", k))
+				continue
 			}
 			keys[k] = true
+			s.properties = append(s.properties, pair{
+				lineno:   lineno,
+				key:      k,
+				value:    string(value),
+				comments: comments,
+			})
+			comments = nil
 		case stateData:
-			s.data = append(s.data, line{lineno: lineno, data: string(text)})
+			s.data = append(s.data, line{lineno: lineno, col: col, data: string(text), comments: comments})
+			comments = nil
 		default:
 			panic("bad state")
 		}
 	}
 	if state != stateInit {
+		s.trailing = comments
 		ss = append(ss, s)
 	}
-	return ss, nil
+	return ss
 }
 
 // =============================================================================
@@ -238,6 +359,42 @@ func ilog2(x uint64) int {
 	}
 }
 
+func parseTempo(value string) (float64, error) {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if !(minTempo < n && n < maxTempo) {
+		return 0, fmt.Errorf("tempo %f is not in allowed range %d..%d", n, minTempo, maxTempo)
+	}
+	return n, nil
+}
+
+func parseTimeSignature(value string) (TimeSignature, error) {
+	i := strings.IndexByte(value, '/')
+	if i == -1 {
+		return TimeSignature{}, errors.New("time signature must be N/M")
+	}
+	n, err := strconv.ParseUint(value[:i], 10, strconv.IntSize-1)
+	if err != nil {
+		return TimeSignature{}, err
+	}
+	m, err := strconv.ParseUint(value[i+1:], 10, strconv.IntSize-1)
+	if err != nil {
+		return TimeSignature{}, err
+	}
+	if n == 0 {
+		return TimeSignature{}, errors.New("zero numerator")
+	}
+	if m == 0 || (m&(m-1)) != 0 {
+		return TimeSignature{}, fmt.Errorf("denominator is not a power of two: %d", m)
+	}
+	return TimeSignature{
+		Numerator:       int(n),
+		DenominatorLog2: ilog2(m),
+	}, nil
+}
+
 func (d *Info) setProp(key, value string) error {
 	switch key {
 	case "name":
@@ -247,38 +404,18 @@ func (d *Info) setProp(key, value string) error {
 		d.Composer = value
 		return nil
 	case "tempo":
-		n, err := strconv.ParseFloat(value, 64)
+		n, err := parseTempo(value)
 		if err != nil {
 			return err
 		}
-		if !(minTempo < n && n < maxTempo) {
-			return fmt.Errorf("tempo %f is not in allowed range %d..%d", n, minTempo, maxTempo)
-		}
 		d.Tempo = n
 		return nil
 	case "time":
-		i := strings.IndexByte(value, '/')
-		if i == -1 {
-			return errors.New("time signature must be N/M")
-		}
-		n, err := strconv.ParseUint(value[:i], 10, strconv.IntSize-1)
-		if err != nil {
-			return err
-		}
-		m, err := strconv.ParseUint(value[:i], 10, strconv.IntSize-1)
+		t, err := parseTimeSignature(value)
 		if err != nil {
 			return err
 		}
-		if n == 0 {
-			return errors.New("zero numerator")
-		}
-		if m == 0 || (m&(m-1)) != 0 {
-			return fmt.Errorf("denominator is not a power of two: %d", m)
-		}
-		d.Time = TimeSignature{
-			Numerator:       int(n),
-			DenominatorLog2: ilog2(m),
-		}
+		d.Time = t
 		return nil
 	case "division":
 		n, err := strconv.ParseUint(value, 10, strconv.IntSize-1)
@@ -312,6 +449,105 @@ func (d *Info) setProp(key, value string) error {
 	}
 }
 
+// measureLength returns the length of a measure with the given time
+// signature, in divisions.
+func measureLength(division int, t TimeSignature) (int, error) {
+	barlen := division * t.Numerator
+	if barlen&((1<<t.DenominatorLog2)-1) != 0 {
+		return 0, errors.New("divisions per measure is not an integer")
+	}
+	return barlen >> t.DenominatorLog2, nil
+}
+
+// timeSignature returns the time signature in force for a measure, counting
+// from zero.
+func (sn *Song) timeSignature(measure int) TimeSignature {
+	t := sn.Info.Time
+	for _, c := range sn.TempoMap {
+		if c.Measure > measure {
+			break
+		}
+		if c.Time.Numerator != 0 {
+			t = c.Time
+		}
+	}
+	return t
+}
+
+// barLength returns the length of a measure, counting from zero, in
+// divisions. The tempo map must be valid.
+func (sn *Song) barLength(measure int) int {
+	n, err := measureLength(sn.Info.Division, sn.timeSignature(measure))
+	if err != nil {
+		panic("invalid tempo map: " + err.Error())
+	}
+	return n
+}
+
+// measureStart returns the time when a measure starts, counting from zero, in
+// divisions. The tempo map must be valid.
+func (sn *Song) measureStart(measure int) int {
+	var t int
+	for i := 0; i < measure; i++ {
+		t += sn.barLength(i)
+	}
+	return t
+}
+
+// Tick returns the time of a position in the song, in divisions from the start
+// of the song. The measure counts from zero, and the offset is in divisions
+// from the start of the measure. The tempo map must be valid.
+func (sn *Song) Tick(measure, offset int) int {
+	return sn.measureStart(measure) + offset
+}
+
+// addTempoChange checks that a tempo change is valid and adds it to the end
+// of the tempo map.
+func (sn *Song) addTempoChange(c TempoChange) error {
+	if c.Tempo == 0 && c.Time.Numerator == 0 {
+		return errors.New("no tempo or time signature")
+	}
+	if c.Measure < 0 || c.Offset < 0 || c.Measure == 0 && c.Offset == 0 {
+		return errors.New("change must be after the start of the song")
+	}
+	if n := len(sn.TempoMap); n != 0 {
+		p := sn.TempoMap[n-1]
+		if c.Measure < p.Measure || c.Measure == p.Measure && c.Offset <= p.Offset {
+			return errors.New("changes are out of order")
+		}
+	}
+	if c.Tempo != 0 && !(minTempo < c.Tempo && c.Tempo < maxTempo) {
+		return fmt.Errorf("tempo %f is not in allowed range %d..%d", c.Tempo, minTempo, maxTempo)
+	}
+	if c.Time.Numerator != 0 {
+		if c.Offset != 0 {
+			return errors.New("time signature change must be at the start of a measure")
+		}
+		if _, err := measureLength(sn.Info.Division, c.Time); err != nil {
+			return err
+		}
+	}
+	if c.Offset >= sn.barLength(c.Measure) {
+		return errors.New("offset is past the end of the measure")
+	}
+	sn.TempoMap = append(sn.TempoMap, c)
+	return nil
+}
+
+// checkTempoMap checks that the song's time signature and tempo map are valid.
+func (sn *Song) checkTempoMap() error {
+	if _, err := measureLength(sn.Info.Division, sn.Info.Time); err != nil {
+		return err
+	}
+	m := Song{Info: sn.Info}
+	for _, c := range sn.TempoMap {
+		if err := m.addTempoChange(c); err != nil {
+			return fmt.Errorf("tempo change in measure %d: %v", c.Measure+1, err)
+		}
+	}
+	return nil
+}
+
 func (tr *Track) setProp(key, value string) error {
 	switch key {
 	case "name":
@@ -347,40 +583,233 @@ func (tr *Track) setProp(key, value string) error {
 		}
 		tr.ConstantDuration = int(n)
 		return nil
+	case "kind":
+		switch value {
+		case "notes":
+			tr.Drums = false
+		case "drums":
+			tr.Drums = true
+		default:
+			return fmt.Errorf("unknown track kind: %q", value)
+		}
+		return nil
+	case "split_voices":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		tr.SplitVoices = b
+		return nil
 	default:
 		return fmt.Errorf("unknown property key: %q", key)
 	}
 }
 
 type noteParser struct {
+	// song contains the time signature for each measure.
+	song     *Song
 	barlen   int
 	time     int
 	bar      int
 	barstart int
 	notes    []Note
 	last     [ChordSize]uint8
+
+	// patterns contains all patterns in the song, by name.
+	patterns map[string]*pattern
+	// expanding contains the patterns currently being expanded, to detect
+	// recursion.
+	expanding map[string]bool
+	// transpose is the number of semitones added to each note, when
+	// expanding a transposed pattern.
+	transpose int
+
+	// scale is the factor by which all durations are multiplied, so notes
+	// in tuplets are a whole number of ticks long.
+	scale int
+	// tuplet is the tuplet being parsed, or nil.
+	tuplet *tuplet
+	// rescale is the factor by which scale must be multiplied, if a note in
+	// a tuplet is not a whole number of ticks long.
+	rescale int
+
+	// drums is true if the track is a drum track, which uses drum names from
+	// the song's kit instead of pitches.
+	drums bool
+
+	// skipping is true if tokens are being skipped until the next barline,
+	// after an error.
+	skipping bool
+}
+
+// A tuplet is a group of notes played in the time of a different number of
+// notes, like three notes in the time of two.
+type tuplet struct {
+	count int
+	space int
+}
+
+// errRescale is returned when a note in a tuplet is not a whole number of
+// ticks long.
+var errRescale = errors.New("tuplet cannot be represented at this resolution")
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// parseTuplet parses the start of a tuplet, like "(3" or "(3:2". If the space
+// is omitted, it is the largest power of two less than the count.
+func parseTuplet(text string) (*tuplet, error) {
+	count, space := text, ""
+	if i := strings.IndexByte(text, ':'); i != -1 {
+		count, space = text[:i], text[i+1:]
+	}
+	n, err := strconv.ParseUint(count, 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tuplet count: %v", err)
+	}
+	if n < 2 {
+		return nil, errors.New("tuplet count must be at least 2")
+	}
+	var m uint64
+	if space != "" {
+		m, err = strconv.ParseUint(space, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tuplet space: %v", err)
+		}
+		if m == 0 {
+			return nil, errors.New("zero tuplet space")
+		}
+	} else {
+		m = 1 << ilog2(n-1)
+	}
+	if n == m {
+		return nil, errors.New("tuplet count and space are equal")
+	}
+	return &tuplet{count: int(n), space: int(m)}, nil
+}
+
+// A pattern is a named sequence of notes, which can be used in tracks.
+type pattern struct {
+	lineno int
+	data   []line
+}
+
+func isPatternName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// expandPattern parses the notes in a pattern, as if they appeared in place of
+// the pattern reference. The text is the pattern name, optionally followed by
+// a transposition in semitones, like "bass+5" or "bass-12".
+func (p *noteParser) expandPattern(text string) error {
+	name := text
+	var transpose int
+	if i := strings.IndexAny(text, "+-"); i != -1 {
+		name = text[:i]
+		n, err := strconv.ParseInt(text[i:], 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid transposition: %v", err)
+		}
+		transpose = int(n)
+	}
+	if !isPatternName(name) {
+		return fmt.Errorf("invalid pattern name: %q", name)
+	}
+	pat := p.patterns[name]
+	if pat == nil {
+		return fmt.Errorf("no pattern named %q", name)
+	}
+	if p.expanding[name] {
+		return fmt.Errorf("pattern %q uses itself", name)
+	}
+	if p.expanding == nil {
+		p.expanding = make(map[string]bool)
+	}
+	p.expanding[name] = true
+	saved := p.transpose
+	p.transpose += transpose
+	defer func() {
+		p.transpose = saved
+		delete(p.expanding, name)
+	}()
+	tuplet := p.tuplet
+	for _, l := range pat.data {
+		if err := p.parseLine(l.data); err != nil {
+			return fmt.Errorf("in pattern %q, line %d: %v", name, l.lineno, err)
+		}
+	}
+	if p.tuplet != tuplet {
+		return fmt.Errorf("in pattern %q: tuplet is not closed", name)
+	}
+	return nil
 }
 
 func (p *noteParser) parseLine(text string) error {
+	return p.parseTokens(text, nil)
+}
+
+// parseTokens parses the tokens in a line of notes. If report is nil, parsing
+// stops at the first error. Otherwise, each error is passed to report, along
+// with the offset of the token in the text, and parsing resumes at the next
+// barline.
+func (p *noteParser) parseTokens(text string, report func(pos int, err error)) error {
+	var start int
 	for {
-		for len(text) != 0 && (text[0] == ' ' || text[0] == '\t') {
-			text = text[1:]
+		for start < len(text) && (text[start] == ' ' || text[start] == '\t') {
+			start++
 		}
-		var pos int
-		for pos < len(text) && text[pos] != ' ' && text[pos] != '\t' {
-			pos++
+		end := start
+		for end < len(text) && text[end] != ' ' && text[end] != '\t' {
+			end++
 		}
-		if pos == 0 {
+		if end == start {
 			return nil
 		}
-		tok := text[:pos]
-		if err := p.parseToken(tok); err != nil {
-			return &tokErr{tok, err}
+		tok := text[start:end]
+		if p.skipping {
+			if tok == "|" {
+				p.skipMeasure()
+			}
+		} else if err := p.parseToken(tok); err != nil {
+			pos := start + errOffset(err)
+			err = &tokErr{tok, err}
+			if report == nil {
+				return err
+			}
+			report(pos, err)
+			if tok == "|" {
+				p.skipMeasure()
+			} else {
+				p.skipping = true
+			}
 		}
-		text = text[pos:]
+		start = end
 	}
 }
 
+// skipMeasure moves to the start of the next measure, discarding the rest of
+// the current measure. This is used to recover from errors.
+func (p *noteParser) skipMeasure() {
+	p.skipping = false
+	p.tuplet = nil
+	p.barstart += p.barlen
+	p.time = p.barstart
+	p.bar++
+	p.barlen = p.song.barLength(p.bar)
+}
+
 type tokErr struct {
 	tok string
 	err error
@@ -398,10 +827,31 @@ func (p *noteParser) parseDur(text string) (int, error) {
 	if n == 0 {
 		return 0, errors.New("zero length")
 	}
-	dur := int(n)
+	dur := int(n) * p.scale
+	if t := p.tuplet; t != nil {
+		x := dur * t.space
+		if x%t.count != 0 {
+			rescale := t.count / gcd(t.count, x)
+			if p.scale*rescale > maxTupletScale {
+				return 0, errRescale
+			}
+			if err := p.song.checkTupletScale(rescale); err != nil {
+				return 0, err
+			}
+			p.rescale = rescale
+			return 0, errRescale
+		}
+		dur = x / t.count
+	}
 	if dur > p.barlen {
 		return 0, errors.New("longer than one measure")
 	}
+	if dur > math.MaxUint8 {
+		if p.scale > 1 {
+			return 0, fmt.Errorf("too long at division %d, which is needed for tuplets", p.song.Info.Division)
+		}
+		return 0, errors.New("too long at this resolution")
+	}
 	return dur, nil
 }
 
@@ -414,6 +864,28 @@ func (p *noteParser) advanceTime(dur int) error {
 	return nil
 }
 
+// parseVelocity removes the velocity or accent from the end of a note's
+// duration, and returns the remaining text and the velocity. A velocity is
+// written as "v" followed by a number, like "c4.4v80", and an accent is written
+// as ">", like "c4.4>". If there is no velocity or accent, the velocity is 0.
+func parseVelocity(text string) (string, uint8, error) {
+	if strings.HasSuffix(text, ">") {
+		return text[:len(text)-1], AccentVelocity, nil
+	}
+	i := strings.IndexByte(text, 'v')
+	if i == -1 {
+		return text, 0, nil
+	}
+	n, err := strconv.ParseUint(text[i+1:], 10, 8)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid velocity: %v", err)
+	}
+	if n == 0 || MaxVelocity < n {
+		return "", 0, fmt.Errorf("velocity %d is not in range 1..%d", n, MaxVelocity)
+	}
+	return text[:i], uint8(n), nil
+}
+
 var baseNote = [7]int{9, 11, 0, 2, 4, 5, 7}
 
 func trimByteFront(text string, b uint8) (int, string) {
@@ -424,7 +896,13 @@ func trimByteFront(text string, b uint8) (int, string) {
 	return pos, text[pos:]
 }
 
+// parseValue parses a note or chord value, without duration. This is either
+// a list of notes, like "c4e4g4", or a chord symbol, like "Cmaj7@4". See
+// parseChord.
 func parseValue(text string) (values [ChordSize]uint8, err error) {
+	if text != "" && 'A' <= text[0] && text[0] <= 'G' {
+		return parseChord(text)
+	}
 	for pos := 0; len(text) > 0; pos++ {
 		if pos >= ChordSize {
 			return values, errors.New("too many notes in a chord")
@@ -470,10 +948,42 @@ func parseValue(text string) (values [ChordSize]uint8, err error) {
 	return values, nil
 }
 
+// parseNote parses the velocity and duration of a note, after the '.', and
+// adds the note.
+func (p *noteParser) parseNote(value [ChordSize]uint8, text string) error {
+	text, vel, err := parseVelocity(text)
+	if err != nil {
+		return err
+	}
+	dur, err := p.parseDur(text)
+	if err != nil {
+		return err
+	}
+	if err := p.advanceTime(dur); err != nil {
+		return err
+	}
+	p.notes = append(p.notes, Note{false, value, uint8(dur), vel})
+	p.last = value
+	return nil
+}
+
 func (p *noteParser) parseToken(text string) error {
 	if len(text) == 0 {
 		panic("empty token")
 	}
+	if c := text[0]; p.drums && 'a' <= c && c <= 'z' {
+		// Drums, like "kick.4" or "kick+hat.4".
+		if i := strings.IndexByte(text, '.'); i != -1 {
+			if p.transpose != 0 {
+				return errors.New("cannot transpose drums")
+			}
+			value, err := parseDrums(p.song.Kit, text[:i])
+			if err != nil {
+				return err
+			}
+			return p.parseNote(value, text[i+1:])
+		}
+	}
 	switch c := text[0]; c {
 	case 'r':
 		dur, err := p.parseDur(text[1:])
@@ -499,7 +1009,7 @@ func (p *noteParser) parseToken(text string) error {
 			}
 		}
 		if dur > 0 {
-			p.notes = append(p.notes, Note{true, [ChordSize]uint8{}, uint8(dur)})
+			p.notes = append(p.notes, Note{true, [ChordSize]uint8{}, uint8(dur), 0})
 		}
 		return nil
 	case '~':
@@ -526,22 +1036,50 @@ func (p *noteParser) parseToken(text string) error {
 		if text != "|" {
 			return errors.New("unexpected character after |")
 		}
+		if p.tuplet != nil {
+			return errors.New("barline inside tuplet")
+		}
 		barend := p.barstart + p.barlen
 		if p.time != barend {
-			return fmt.Errorf("shart measure in measure %d", p.bar+1)
+			return fmt.Errorf("short measure in measure %d", p.bar+1)
 		}
 		p.barstart = barend
+		p.bar++
+		p.barlen = p.song.barLength(p.bar)
 		return nil
-	case 'a', 'b', 'c', 'd', 'e', 'f', 'g':
+	case 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'A', 'B', 'C', 'D', 'E', 'F', 'G':
 		i := strings.IndexByte(text, '.')
 		if i == -1 {
 			return errors.New("missing duration")
 		}
+		if p.drums {
+			return errors.New("drum tracks cannot have pitched notes")
+		}
 		value, err := parseValue(text[:i])
 		if err != nil {
 			return err
 		}
-		text = text[i+1:]
+		if p.transpose != 0 {
+			for j, v := range value {
+				if v == 0 {
+					break
+				}
+				x := int(v) + p.transpose
+				if x <= 0 || 127 < x {
+					return errors.New("transposed note out of range")
+				}
+				value[j] = uint8(x)
+			}
+		}
+		return p.parseNote(value, text[i+1:])
+	case ':':
+		if p.last[0] == 0 {
+			return errors.New("cannot repeat without previous note")
+		}
+		text, vel, err := parseVelocity(text[1:])
+		if err != nil {
+			return err
+		}
 		dur, err := p.parseDur(text)
 		if err != nil {
 			return err
@@ -549,100 +1087,387 @@ func (p *noteParser) parseToken(text string) error {
 		if err := p.advanceTime(dur); err != nil {
 			return err
 		}
-		p.notes = append(p.notes, Note{false, value, uint8(dur)})
-		p.last = value
+		p.notes = append(p.notes, Note{false, p.last, uint8(dur), vel})
 		return nil
-	case ':':
-		if p.last[0] == 0 {
-			return errors.New("cannot repeat without previous note")
+	case '*':
+		return p.expandPattern(text[1:])
+	case '(':
+		if p.tuplet != nil {
+			return errors.New("nested tuplets are not supported")
 		}
-		dur, err := p.parseDur(text[1:])
+		t, err := parseTuplet(text[1:])
 		if err != nil {
 			return err
 		}
-		if err := p.advanceTime(dur); err != nil {
-			return err
+		p.tuplet = t
+		return nil
+	case ')':
+		if text != ")" {
+			return errors.New("unexpected character after )")
+		}
+		if p.tuplet == nil {
+			return errors.New("no tuplet to close")
 		}
-		p.notes = append(p.notes, Note{false, p.last, uint8(dur)})
+		p.tuplet = nil
 		return nil
 	default:
 		return errors.New("unknown token")
 	}
 }
 
-// Parse parses a text song file.
-func Parse(data []byte) (*Song, error) {
-	ss, err := parseSections(data)
+// parsePosition parses a position in a song, like "17" or "17:3", which is a
+// measure number, optionally followed by a beat. Measures and beats count from
+// one. Returns the measure, counting from zero, and the offset within the
+// measure, in divisions. The tempo map must be valid up to this position.
+func (sn *Song) parsePosition(pos string) (measure, offset int, err error) {
+	beat := 1
+	if i := strings.IndexByte(pos, ':'); i != -1 {
+		n, err := strconv.ParseUint(pos[i+1:], 10, 16)
+		if err != nil || n == 0 {
+			return 0, 0, fmt.Errorf("invalid beat: %q", pos[i+1:])
+		}
+		beat = int(n)
+		pos = pos[:i]
+	}
+	n, err := strconv.ParseUint(pos, 10, 16)
+	if err != nil || n == 0 {
+		return 0, 0, fmt.Errorf("invalid measure: %q", pos)
+	}
+	measure = int(n) - 1
+	if beat > 1 {
+		t := sn.timeSignature(measure)
+		beatlen := sn.Info.Division >> t.DenominatorLog2
+		if beatlen<<t.DenominatorLog2 != sn.Info.Division {
+			return 0, 0, errors.New("divisions per beat is not an integer")
+		}
+		offset = (beat - 1) * beatlen
+	}
+	return measure, offset, nil
+}
+
+// parseTempoChange parses a line in the tempo map, like "17 tempo=66" or
+// "9 time=3/4 tempo=100". See parsePosition.
+func (sn *Song) parseTempoChange(text string) (TempoChange, error) {
+	var c TempoChange
+	fields := strings.Fields(text)
+	var err error
+	c.Measure, c.Offset, err = sn.parsePosition(fields[0])
 	if err != nil {
-		return nil, err
+		return c, err
+	}
+	if len(fields) == 1 {
+		return c, errors.New("expected tempo or time signature")
+	}
+	for _, f := range fields[1:] {
+		i := strings.IndexByte(f, '=')
+		if i == -1 {
+			return c, fmt.Errorf("expected key=value: %q", f)
+		}
+		key, value := f[:i], f[i+1:]
+		switch key {
+		case "tempo":
+			if c.Tempo != 0 {
+				return c, errors.New("duplicate tempo")
+			}
+			if c.Tempo, err = parseTempo(value); err != nil {
+				return c, err
+			}
+		case "time":
+			if c.Time.Numerator != 0 {
+				return c, errors.New("duplicate time signature")
+			}
+			if c.Time, err = parseTimeSignature(value); err != nil {
+				return c, err
+			}
+		default:
+			return c, fmt.Errorf("unknown key: %q", key)
+		}
+	}
+	return c, nil
+}
+
+// maxTupletScale is the maximum factor by which the song's division may be
+// multiplied to make the notes in tuplets a whole number of ticks long.
+const maxTupletScale = 64
+
+// maxTupletTickError is the largest relative error in tempo allowed when the
+// song's division is multiplied for tuplets. Tick durations are rounded to a
+// multiple of 2 ms, so shorter ticks give a larger error.
+const maxTupletTickError = 0.01
+
+// checkTupletScale checks that the song's tempos can still be played
+// accurately if the division is multiplied by the given factor.
+func (sn *Song) checkTupletScale(factor int) error {
+	division := sn.Info.Division * factor
+	tempos := []float64{sn.Info.Tempo}
+	for _, c := range sn.TempoMap {
+		if c.Tempo != 0 {
+			tempos = append(tempos, c.Tempo)
+		}
+	}
+	for _, tempo := range tempos {
+		if e := tickError(tempo, division); e > maxTupletTickError {
+			return fmt.Errorf("tuplet needs division %d, which would change tempo %s by %.1f%%", division, formatNumber(tempo), e*100)
+		}
+	}
+	return nil
+}
+
+// Parse parses a text song file. If the song contains tuplets, the song's
+// division is multiplied by the smallest factor that makes every note a whole
+// number of ticks long, and all durations are scaled to match. This is an
+// error if the shorter ticks would make the tempo inaccurate. If there are
+// errors, only the first one is returned.
+func Parse(data []byte) (*Song, error) {
+	sn, errs := parse(data)
+	if len(errs) != 0 {
+		return nil, errs[0]
 	}
+	return sn, nil
+}
+
+// ParseAll parses a text song file, like Parse, but does not stop at the first
+// error. If there are errors, the error is an ErrorList containing all of
+// them, sorted by position. After an error in a track, parsing resumes at the
+// next barline.
+func ParseAll(data []byte) (*Song, error) {
+	sn, errs := parse(data)
+	if len(errs) != 0 {
+		errs.Sort()
+		return nil, errs
+	}
+	return sn, nil
+}
+
+// parse parses a text song file, and returns the song and all errors, in the
+// order they were found.
+func parse(data []byte) (*Song, ErrorList) {
+	var errs ErrorList
+	ss := parseSections(data, &errs)
+	patterns := make(map[string]*pattern)
+	for _, s := range ss {
+		if s.kind != "pattern" {
+			continue
+		}
+		var name string
+		for _, p := range s.properties {
+			if p.key != "name" {
+				errs.add(p.lineno, fmt.Errorf("unknown property key: %q", p.key))
+				continue
+			}
+			if !isPatternName(p.value) {
+				errs.add(p.lineno, fmt.Errorf("invalid pattern name: %q", p.value))
+				continue
+			}
+			name = p.value
+		}
+		if name == "" {
+			errs.add(s.lineno, errors.New("pattern has no name"))
+			continue
+		}
+		if patterns[name] != nil {
+			errs.add(s.lineno, fmt.Errorf("duplicate pattern: %q", name))
+			continue
+		}
+		patterns[name] = &pattern{lineno: s.lineno, data: s.data}
+	}
+	scale := 1
+	for {
+		perrs := errs
+		sn, rescale := parseSong(ss, patterns, scale, &perrs)
+		if rescale == 0 {
+			if len(perrs) != 0 {
+				return nil, perrs
+			}
+			return sn, nil
+		}
+		scale *= rescale
+	}
+}
+
+// parseSong parses a song from its sections, with all durations multiplied by
+// scale. If a tuplet needs a larger scale, returns the factor by which the
+// scale must be multiplied.
+func parseSong(ss []section, patterns map[string]*pattern, scale int, errs *ErrorList) (*Song, int) {
 	var sn Song
-	var hasinfo bool
-	var barlen int
+	var hasinfo, infoOK, hastempo, hasKit bool
+	// lastTrack is the track which an @automation section applies to, or nil
+	// if the track has errors.
+	var lastTrack *Track
+	var hasTrack, hasAutomation bool
 	for _, s := range ss {
 		switch s.kind {
 		case "info":
 			if hasinfo {
-				return nil, &Error{s.lineno, errors.New("duplicate info section")}
+				errs.add(s.lineno, errors.New("duplicate info section"))
+				continue
 			}
+			hasinfo = true
+			nerrs := len(*errs)
 			for _, p := range s.properties {
 				if err := sn.Info.setProp(p.key, p.value); err != nil {
-					return nil, &Error{p.lineno, err}
+					errs.add(p.lineno, err)
 				}
 			}
+			for _, l := range s.data {
+				errs.add(l.lineno, errors.New("unexpected data in this section type"))
+			}
 			if sn.Info.Division == 0 {
-				return nil, &Error{s.lineno, errors.New("song is missing duration")}
+				errs.add(s.lineno, errors.New("song is missing duration"))
 			}
 			if sn.Info.Time.Numerator == 0 {
 				sn.Info.Time = TimeSignature{4, 2} // 4/4
 			}
-			t := sn.Info.Time
-			barlen = sn.Info.Division * t.Numerator
-			if barlen&((1<<t.DenominatorLog2)-1) != 0 {
-				return nil, &Error{s.lineno, errors.New("divisions per measure is not an integer")}
+			if _, err := measureLength(sn.Info.Division, sn.Info.Time); err != nil {
+				errs.add(s.lineno, err)
 			}
-			barlen >>= t.DenominatorLog2
 			if sn.Info.Tempo == 0 {
-				return nil, &Error{s.lineno, errors.New("missing tempo")}
+				errs.add(s.lineno, errors.New("missing tempo"))
 			}
-			for _, l := range s.data {
-				return nil, &Error{l.lineno, errors.New("unexpected data in this section type")}
-			}
-			hasinfo = true
+			// The tempo map and tracks cannot be parsed without valid info.
+			infoOK = len(*errs) == nerrs
+			sn.Info.Division *= scale
+			sn.Info.Duration *= scale
 		case "track":
+			lastTrack = nil
+			hasTrack = true
+			hasAutomation = false
 			if !hasinfo {
-				return nil, &Error{s.lineno, errors.New("track without song info")}
+				errs.add(s.lineno, errors.New("track without song info"))
+				continue
 			}
 			var tr Track
 			for _, p := range s.properties {
 				if err := tr.setProp(p.key, p.value); err != nil {
-					return nil, &Error{p.lineno, err}
+					errs.add(p.lineno, err)
 				}
 			}
-			np := noteParser{barlen: barlen}
+			if tr.Drums {
+				if tr.Instrument != "" {
+					errs.add(s.lineno, errors.New("drum tracks use instruments from the kit, and cannot have an instrument"))
+				}
+				if len(sn.Kit) == 0 {
+					errs.add(s.lineno, errors.New("drum track without @kit section"))
+					continue
+				}
+			}
+			if !infoOK {
+				continue
+			}
+			np := noteParser{song: &sn, barlen: sn.barLength(0), scale: scale, patterns: patterns, drums: tr.Drums}
+			var rescale int
 			for _, l := range s.data {
-				if err := np.parseLine(l.data); err != nil {
-					return nil, &Error{l.lineno, err}
+				l := l
+				np.parseTokens(l.data, func(pos int, err error) {
+					if np.rescale != 0 {
+						// The song is parsed again at the larger scale, so
+						// the error is not reported. Notes which cannot be
+						// rescaled get a different error from parseDur.
+						if rescale == 0 {
+							rescale = np.rescale
+						}
+						np.rescale = 0
+						return
+					}
+					*errs = append(*errs, &Error{Line: l.lineno, Column: l.col + pos, Err: err})
+				})
+				if rescale != 0 {
+					return nil, rescale
 				}
 			}
+			if np.tuplet != nil {
+				errs.add(s.lineno, errors.New("tuplet is not closed at end of track"))
+			}
 			for len(np.notes) != 0 && np.notes[len(np.notes)-1].IsRest {
 				np.notes = np.notes[:len(np.notes)-1]
 			}
-			var dur int
-			for _, n := range np.notes {
-				dur += int(n.Duration)
-			}
 			tr.Notes = np.notes
 			sn.Tracks = append(sn.Tracks, &tr)
+			lastTrack = &tr
+		case "automation":
+			if !hasTrack {
+				errs.add(s.lineno, errors.New("automation must come after a track"))
+				continue
+			}
+			if hasAutomation {
+				errs.add(s.lineno, errors.New("duplicate automation section for track"))
+				continue
+			}
+			hasAutomation = true
+			for _, p := range s.properties {
+				errs.add(p.lineno, fmt.Errorf("unknown property key: %q", p.key))
+			}
+			if lastTrack == nil {
+				continue
+			}
+			for _, l := range s.data {
+				if err := sn.parseAutomation(lastTrack, l.data); err != nil {
+					errs.add(l.lineno, err)
+				}
+			}
+		case "tempo":
+			if !hasinfo {
+				errs.add(s.lineno, errors.New("tempo map without song info"))
+				continue
+			}
+			if hastempo {
+				errs.add(s.lineno, errors.New("duplicate tempo section"))
+				continue
+			}
+			hastempo = true
+			if len(sn.Tracks) != 0 {
+				errs.add(s.lineno, errors.New("tempo map must come before tracks"))
+				continue
+			}
+			for _, p := range s.properties {
+				errs.add(p.lineno, fmt.Errorf("unknown property key: %q", p.key))
+			}
+			if !infoOK {
+				continue
+			}
+			for _, l := range s.data {
+				c, err := sn.parseTempoChange(l.data)
+				if err == nil {
+					err = sn.addTempoChange(c)
+				}
+				if err != nil {
+					errs.add(l.lineno, err)
+				}
+			}
+		case "kit":
+			if hasKit {
+				errs.add(s.lineno, errors.New("duplicate kit section"))
+				continue
+			}
+			hasKit = true
+			if len(sn.Tracks) != 0 {
+				errs.add(s.lineno, errors.New("kit must come before tracks"))
+				continue
+			}
+			for _, p := range s.properties {
+				d, err := parseDrum(p.key, p.value)
+				if err != nil {
+					errs.add(p.lineno, fmt.Errorf("drum %q: %v", p.key, err))
+					continue
+				}
+				sn.Kit = append(sn.Kit, d)
+			}
+			for _, l := range s.data {
+				errs.add(l.lineno, errors.New("unexpected data in this section type"))
+			}
+		case "pattern":
+			// Already processed.
+		case "":
+			// Missing section kind, already reported.
 		default:
-			return nil, &Error{s.lineno, fmt.Errorf("unknown section: %q", s.kind)}
+			errs.add(s.lineno, fmt.Errorf("unknown section: %q", s.kind))
 		}
 	}
 	if !hasinfo {
-		return nil, errors.New("song has no @info section")
+		errs.add(0, errors.New("song has no @info section"))
 	}
-	if len(sn.Tracks) == 0 {
-		return nil, errors.New("song has no tracks")
+	if len(sn.Tracks) == 0 && infoOK {
+		errs.add(0, errors.New("song has no tracks"))
 	}
-	return &sn, nil
+	return &sn, 0
 }
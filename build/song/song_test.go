@@ -0,0 +1,303 @@
+package song
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSong = `@info
+name: Outro
+tempo: 120
+time: 4/4
+division: 16
+
+@tempo
+
+2 time=3/4
+3 time=4/4 tempo=100
+3:3 tempo=90
+3:4 tempo=80
+
+@track
+name: Lead
+
+c4.4> d4.4v80 e4.4 f4.4 |
+g4.4 a4.4 b4.4      |
+c5.16               |
+`
+
+func TestParseTempo(t *testing.T) {
+	sn, err := Parse([]byte(testSong))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []TempoChange{
+		{Measure: 1, Time: TimeSignature{3, 2}},
+		{Measure: 2, Tempo: 100, Time: TimeSignature{4, 2}},
+		{Measure: 2, Offset: 8, Tempo: 90},
+		{Measure: 2, Offset: 12, Tempo: 80},
+	}
+	if !reflect.DeepEqual(sn.TempoMap, expect) {
+		t.Errorf("tempo map is %v, expect %v", sn.TempoMap, expect)
+	}
+	if n := sn.measureStart(3); n != 44 {
+		t.Errorf("end of song is %d, expect 44", n)
+	}
+	text, err := Format(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn2, err := Parse(text)
+	if err != nil {
+		t.Fatalf("Parse(Format()): %v\n%s", err, text)
+	}
+	if !reflect.DeepEqual(sn, sn2) {
+		t.Errorf("Parse(Format()) does not match original:\n%s", text)
+	}
+}
+
+func TestParseVelocity(t *testing.T) {
+	sn, err := Parse([]byte(testSong))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vels []uint8
+	for _, n := range sn.Tracks[0].Notes[:4] {
+		vels = append(vels, n.Velocity)
+	}
+	if expect := []uint8{AccentVelocity, 80, 0, 0}; !reflect.DeepEqual(vels, expect) {
+		t.Errorf("velocities are %v, expect %v", vels, expect)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		old, new string
+		err      string
+	}{
+		{"2 time=3/4", "1 time=3/4", "after the start"},
+		{"3:4 tempo=80", "3:2 tempo=80", "out of order"},
+		{"3:4 tempo=80", "3:5 tempo=80", "past the end"},
+		{"3:3 tempo=90", "3:3 time=3/4", "start of a measure"},
+		{"3:3 tempo=90", "3:3", "expected tempo"},
+		{"3:3 tempo=90", "3:3 speed=90", "unknown key"},
+		{"g4.4 a4.4 b4.4 ", "g4.4 a4.4 b4.4 c4.4", "crosses barline"},
+		{"c5.16", "c5.12", "measure 3"},
+		{"d4.4v80", "d4.4v0", "velocity 0"},
+		{"d4.4v80", "d4.4v128", "velocity 128"},
+		{"d4.4v80", "d4.4v", "invalid velocity"},
+	}
+	for _, c := range cases {
+		text := strings.Replace(testSong, c.old, c.new, 1)
+		_, err := Parse([]byte(text))
+		if err == nil {
+			t.Errorf("%q: no error", c.new)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %q, expect %q", c.new, err, c.err)
+		}
+	}
+}
+
+const tupletSong = `@info
+name: Tuplets
+tempo: 125
+division: 16
+
+@track
+
+c4.4 (3 d4.2 e4.2 f4.2 ) g4.8  |
+(5:4 c4.1 d4.1 e4.1 f4.1 g4.1 ) r12 |
+`
+
+func TestParseTuplet(t *testing.T) {
+	sn, err := Parse([]byte(tupletSong))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sn.Info.Division != 16*15 {
+		t.Errorf("division is %d, expect %d", sn.Info.Division, 16*15)
+	}
+	var durs []uint8
+	for _, n := range sn.Tracks[0].Notes {
+		durs = append(durs, n.Duration)
+	}
+	expect := []uint8{60, 20, 20, 20, 120, 12, 12, 12, 12, 12}
+	if !reflect.DeepEqual(durs, expect) {
+		t.Errorf("durations are %v, expect %v", durs, expect)
+	}
+	text, err := Format(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn2, err := Parse(text)
+	if err != nil {
+		t.Fatalf("Parse(Format()): %v\n%s", err, text)
+	}
+	if !reflect.DeepEqual(sn, sn2) {
+		t.Errorf("Parse(Format()) does not match original:\n%s", text)
+	}
+	text = checkFormatText(t, "tuplets", []byte(tupletSong))
+	for _, s := range []string{"division: 16\n", "c4.4 (3 d4.2 e4.2 f4.2 ) g4.8       |\n", "(5:4 c4.1 d4.1 e4.1 f4.1 g4.1 ) r12 |\n"} {
+		if !strings.Contains(string(text), s) {
+			t.Errorf("FormatText does not contain %q:\n%s", s, text)
+		}
+	}
+}
+
+func TestParseTupletErrors(t *testing.T) {
+	cases := []struct {
+		old, new string
+		err      string
+	}{
+		{"(3 d4.2", "(1 d4.2", "at least 2"},
+		{"(3 d4.2", "(2:2 d4.2", "are equal"},
+		{"(3 d4.2", "(3 (3 d4.2", "nested"},
+		{"f4.2 )", "f4.2 ) )", "no tuplet"},
+		{"g4.1 ) r12 |", "g4.1 ) r12 | (3", "not closed"},
+		{"g4.1 ) r12 |", "g4.1 r12 | )", "barline inside tuplet"},
+		{"(3 d4.2", "(127:1 d4.2", "cannot be represented"},
+		{"tempo: 125", "tempo: 140", "would change tempo 140 by 12.0%"},
+	}
+	for _, c := range cases {
+		text := strings.Replace(tupletSong, c.old, c.new, 1)
+		_, err := Parse([]byte(text))
+		if err == nil {
+			t.Errorf("%q: no error", c.new)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %q, expect %q", c.new, err, c.err)
+		}
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	const text = `@info
+name: Errors
+tempo: 120
+division: 16
+
+@track
+pan: 2
+
+c4.4 x4.4 d4.4 e4.4 |
+c4.4 d4.4 e4.4 f4.4 |
+  c4.4 d4.4 e4.4 f4.20 |
+c4.4 d4.4 e4.4 |
+
+@bogus
+`
+	_, err := ParseAll([]byte(text))
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("got error %v, expect ErrorList", err)
+	}
+	expect := []struct {
+		line, col int
+		msg       string
+	}{
+		{7, 0, "pan must be"},
+		{9, 6, "unknown token"},
+		{11, 18, "longer than one measure"},
+		{12, 16, "short measure"},
+		{14, 0, "unknown section"},
+	}
+	if len(errs) != len(expect) {
+		t.Errorf("got %d errors, expect %d:\n%v", len(errs), len(expect), errs)
+	}
+	for i, e := range errs {
+		if i >= len(expect) {
+			break
+		}
+		x := expect[i]
+		if e.Line != x.line || e.Column != x.col || !strings.Contains(e.Err.Error(), x.msg) {
+			t.Errorf("error %d: got %v, expect %d:%d: %s", i, e, x.line, x.col, x.msg)
+		}
+	}
+	if _, err := Parse([]byte(text)); err != errs[0] && err.Error() != errs[0].Error() {
+		t.Errorf("Parse: got %v, expect %v", err, errs[0])
+	}
+}
+
+const patternSong = `@info
+name: Patterns
+tempo: 120
+division: 8
+
+@pattern
+name: riff
+
+c4.2 e4.2
+
+@pattern
+name: bar
+
+*riff g4e4.2 :2 |
+
+@track
+name: Lead
+
+*bar
+*riff+2 r4 |
+*bar-12
+`
+
+func TestParsePattern(t *testing.T) {
+	sn, err := Parse([]byte(patternSong))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expanded = `@info
+name: Patterns
+tempo: 120
+division: 8
+
+@track
+name: Lead
+
+c4.2 e4.2 g4e4.2 :2   |
+d4.2 f#4.2 r4         |
+c3.2 e3.2 g3e3.2 :2   |
+`
+	esn, err := Parse([]byte(expanded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sn, esn) {
+		t.Errorf("notes are %v, expect %v", sn.Tracks[0].Notes, esn.Tracks[0].Notes)
+	}
+	text := checkFormatText(t, "patterns", []byte(patternSong))
+	for _, s := range []string{"@pattern\nname: riff\n\nc4.2 e4.2\n", "*riff g4e4.2 :2 |\n", "*bar\n*riff+2 r4 |\n*bar-12\n"} {
+		if !strings.Contains(string(text), s) {
+			t.Errorf("FormatText does not contain %q:\n%s", s, text)
+		}
+	}
+}
+
+func TestParsePatternErrors(t *testing.T) {
+	cases := []struct {
+		old, new string
+		err      string
+	}{
+		{"*riff+2", "*solo+2", "no pattern named \"solo\""},
+		{"*riff+2", "*riff+x", "invalid transposition"},
+		{"*riff+2", "*riff-", "invalid transposition"},
+		{"*bar-12", "*bar+64", "transposed note out of range"},
+		{"*riff g4e4.2", "*bar g4e4.2", "pattern \"bar\" uses itself"},
+		{"name: bar", "name: riff", "duplicate pattern"},
+		{"name: bar", "name: bar!", "invalid pattern name"},
+		{"c4.2 e4.2", "(3 c4.2 e4.2", "tuplet is not closed"},
+		// Patterns need not be whole measures, but must fit the measure
+		// where they are used.
+		{"*riff+2 r4 |", "r6 *riff |", "crosses barline"},
+		{"*riff+2 r4 |", "*riff |", "short measure"},
+	}
+	for _, c := range cases {
+		text := strings.Replace(patternSong, c.old, c.new, 1)
+		_, err := Parse([]byte(text))
+		if err == nil {
+			t.Errorf("%q: no error", c.new)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %q, expect %q", c.new, err, c.err)
+		}
+	}
+}
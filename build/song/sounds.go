@@ -1,34 +1,53 @@
 package song
 
 import (
-	"bytes"
-	"context"
-	"encoding/json"
 	"fmt"
-	"os"
-	"os/exec"
+	"io/ioutil"
 	"path/filepath"
+
+	"moria.us/js13k/build/instrument"
 )
 
-const CodeFile = "code.py"
+// InstrumentsFile is the name of the file containing instrument definitions,
+// in the same directory as the song list.
+const InstrumentsFile = "instruments.def"
 
 type sounds struct {
-	Instruments map[string][]byte `json:"instruments"`
+	Instruments map[string][]byte
 }
 
-func compileSounds(ctx context.Context, filename string) (*sounds, error) {
-	cmd := exec.CommandContext(ctx, "python3", filename)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+// compileSounds compiles the instruments in an instrument file, and checks
+// that the resulting programs are valid. Errors in the file are returned as an
+// ErrorList.
+func compileSounds(filename string) (*sounds, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
 		return nil, err
 	}
-	dec := json.NewDecoder(bytes.NewReader(out.Bytes()))
-	dec.DisallowUnknownFields()
-	var s sounds
-	if err := dec.Decode(&s); err != nil {
-		return nil, fmt.Errorf("%s: %v", filepath.Base(filename), err)
+	insts, err := instrument.Parse(data)
+	if err != nil {
+		e := &Error{File: filepath.Base(filename), Err: err}
+		if ie, ok := err.(*instrument.Error); ok {
+			e.Line = ie.Line
+			e.Err = ie.Err
+		}
+		return nil, ErrorList{e}
+	}
+	s := sounds{Instruments: make(map[string][]byte, len(insts))}
+	var errs ErrorList
+	for _, inst := range insts {
+		if err := instrument.Validate(inst.Code); err != nil {
+			errs = append(errs, &Error{
+				File: filepath.Base(filename),
+				Line: inst.Line,
+				Err:  fmt.Errorf("instrument %q: %v", inst.Name, err),
+			})
+			continue
+		}
+		s.Instruments[inst.Name] = inst.Code
+	}
+	if len(errs) != 0 {
+		return nil, errs
 	}
 	return &s, nil
 }
@@ -0,0 +1,100 @@
+package song
+
+import (
+	"fmt"
+	"sort"
+)
+
+// chordSize returns the number of notes in a chord.
+func chordSize(value [ChordSize]uint8) int {
+	for i, v := range value {
+		if v == 0 {
+			return i
+		}
+	}
+	return ChordSize
+}
+
+// splitTrack splits a track with chords larger than maxPolyphony into several
+// tracks, with the same instrument, gain, pan, and automation. The notes in
+// each chord are sorted and divided into contiguous ranges, with the lowest
+// notes in the first track, so each track stays in the same register and the
+// note deltas stay small. Returns nil if the track does not need to be split.
+func splitTrack(tr *Track) []*Track {
+	var maxSize int
+	for _, n := range tr.Notes {
+		if !n.IsRest {
+			if sz := chordSize(n.Value); sz > maxSize {
+				maxSize = sz
+			}
+		}
+	}
+	if maxSize <= maxPolyphony {
+		return nil
+	}
+	ntracks := (maxSize + maxPolyphony - 1) / maxPolyphony
+	tracks := make([]*Track, ntracks)
+	for i := range tracks {
+		tracks[i] = &Track{
+			Name:             fmt.Sprintf("%s (%d)", tr.Name, i+1),
+			Instrument:       tr.Instrument,
+			GainDB:           tr.GainDB,
+			Pan:              tr.Pan,
+			ConstantDuration: tr.ConstantDuration,
+			GainAutomation:   tr.GainAutomation,
+			PanAutomation:    tr.PanAutomation,
+		}
+	}
+	for _, n := range tr.Notes {
+		var values []uint8
+		if !n.IsRest {
+			values = append(values, n.Value[:chordSize(n.Value)]...)
+			sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		}
+		// The first len(values)%ntracks tracks get one extra note.
+		var pos int
+		for i, t := range tracks {
+			count := len(values) / ntracks
+			if i < len(values)%ntracks {
+				count++
+			}
+			if count == 0 {
+				t.Notes = appendRest(t.Notes, n.Duration)
+				continue
+			}
+			nn := Note{Duration: n.Duration, Velocity: n.Velocity}
+			copy(nn.Value[:], values[pos:pos+count])
+			pos += count
+			t.Notes = append(t.Notes, nn)
+		}
+	}
+	return tracks
+}
+
+// splitVoices returns the songs with every track that has SplitVoices set and
+// chords larger than maxPolyphony replaced by several tracks. The original
+// songs are not modified.
+func splitVoices(songs []*Song) []*Song {
+	r := make([]*Song, len(songs))
+	for i, sn := range songs {
+		r[i] = sn
+		var tracks []*Track
+		var split bool
+		for _, tr := range sn.Tracks {
+			if tr.SplitVoices {
+				if ts := splitTrack(tr); ts != nil {
+					tracks = append(tracks, ts...)
+					split = true
+					continue
+				}
+			}
+			tracks = append(tracks, tr)
+		}
+		if split {
+			nsn := *sn
+			nsn.Tracks = tracks
+			r[i] = &nsn
+		}
+	}
+	return r
+}
@@ -0,0 +1,93 @@
+package song
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitTrack(t *testing.T) {
+	chord := func(dur uint8, values ...uint8) Note {
+		n := Note{Duration: dur}
+		copy(n.Value[:], values)
+		return n
+	}
+	rest := func(dur uint8) Note {
+		return Note{IsRest: true, Duration: dur}
+	}
+	tr := Track{
+		Name:       "Pad",
+		Instrument: "Lead",
+		GainDB:     -3,
+		Notes: []Note{
+			chord(4, 67, 60, 64, 72, 76, 79),
+			chord(4, 60, 64, 67, 72, 76),
+			chord(2, 48),
+			chord(2, 50),
+			rest(8),
+			chord(4, 60, 64, 67),
+		},
+	}
+	ts := splitTrack(&tr)
+	expect := [][]Note{
+		{
+			chord(4, 60, 64, 67),
+			chord(4, 60, 64, 67),
+			chord(2, 48),
+			chord(2, 50),
+			rest(8),
+			chord(4, 60, 64),
+		},
+		{
+			chord(4, 72, 76, 79),
+			chord(4, 72, 76),
+			rest(12),
+			chord(4, 67),
+		},
+	}
+	if len(ts) != len(expect) {
+		t.Fatalf("got %d tracks, expect %d", len(ts), len(expect))
+	}
+	for i, st := range ts {
+		if st.Instrument != tr.Instrument || st.GainDB != tr.GainDB {
+			t.Errorf("track %d: instrument %q, gain %f", i, st.Instrument, st.GainDB)
+		}
+		if !reflect.DeepEqual(st.Notes, expect[i]) {
+			t.Errorf("track %d: got %v, expect %v", i, st.Notes, expect[i])
+		}
+	}
+	if ts := splitTrack(&Track{Notes: expect[0]}); ts != nil {
+		t.Errorf("split track with small chords into %d tracks", len(ts))
+	}
+}
+
+func TestCompileSplitVoices(t *testing.T) {
+	sn := Song{
+		Info: Info{Name: "Song", Tempo: 120, Time: TimeSignature{4, 2}, Division: 16},
+		Tracks: []*Track{{
+			Name:       "Pad",
+			Instrument: "Lead",
+			Notes: []Note{
+				{Value: [ChordSize]uint8{60, 62, 64, 65, 67, 69, 71, 72}, Duration: 16},
+			},
+		}},
+	}
+	_, err := compile(testSounds(), []*Song{&sn}, nil)
+	if err == nil {
+		t.Fatal("no error for large chord")
+	} else if !strings.Contains(err.Error(), "too much polyphony") {
+		t.Fatalf("got error %q", err)
+	}
+	sn.Tracks[0].SplitVoices = true
+	c, err := compile(testSounds(), []*Song{&sn}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sn.Tracks) != 1 {
+		t.Error("song was modified")
+	}
+	expect := []string{"Pad (1)", "Pad (2)"}
+	if !reflect.DeepEqual(c.TrackNames[0], expect) {
+		t.Errorf("track names are %q, expect %q", c.TrackNames[0], expect)
+	}
+}
@@ -0,0 +1,192 @@
+package song
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"moria.us/js13k/build/synth"
+)
+
+// noteTicks returns the note values and velocity playing at each tick in a
+// decoded track. Rests have no values.
+func noteTicks(notes []Note) (values [][]int, velocities []float64) {
+	for _, n := range notes {
+		var v []int
+		vel := math.NaN()
+		if !n.IsRest {
+			for _, x := range n.Value {
+				if x == 0 {
+					break
+				}
+				v = append(v, int(x))
+			}
+			x := float64(n.Velocity)
+			if x == 0 {
+				x = DefaultVelocity
+			}
+			vel = (x / DefaultVelocity) * (x / DefaultVelocity)
+		}
+		for i := 0; i < int(n.Duration); i++ {
+			values = append(values, v)
+			velocities = append(velocities, vel)
+		}
+	}
+	return
+}
+
+// synthTicks returns the note values and velocity playing at each tick in a
+// track loaded by the synth package, like noteTicks.
+func synthTicks(tr *synth.Track) (values [][]int, velocities []float64) {
+	for i, d := range tr.Durations {
+		var v []int
+		for _, voice := range tr.Voices {
+			if x := voice[i]; x != -1 {
+				v = append(v, x)
+			}
+		}
+		vel := math.NaN()
+		if len(v) != 0 {
+			vel = 1
+			if tr.Velocities != nil {
+				vel = tr.Velocities[i]
+			}
+		}
+		for j := 0; j < d; j++ {
+			values = append(values, v)
+			velocities = append(velocities, vel)
+		}
+	}
+	return
+}
+
+func equalVelocities(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, x := range a {
+		if math.IsNaN(x) != math.IsNaN(b[i]) || math.Abs(x-b[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSynthLoad checks that the synth package loads compiled data the same
+// way that Decode does.
+func checkSynthLoad(t *testing.T, c *Compiled) {
+	t.Helper()
+	d, err := Decode(c.Data)
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+	sd, err := synth.Load(c.Data)
+	if err != nil {
+		t.Fatal("synth.Load:", err)
+	}
+	if !reflect.DeepEqual(sd.Sounds, d.Programs) {
+		t.Errorf("programs are %v, expect %v", sd.Sounds, d.Programs)
+	}
+	if len(sd.Songs) != len(d.Songs) || len(sd.Sfx) != len(d.Sfx) {
+		t.Fatalf("got %d songs and %d sound effects, expect %d and %d",
+			len(sd.Songs), len(sd.Sfx), len(d.Songs), len(d.Sfx))
+	}
+	gain := func(x float64) float64 { return 20 * math.Log10(x) }
+	for i, dsn := range d.Songs {
+		ssn := sd.Songs[i]
+		if ssn.TickDuration != float64(dsn.TickDuration)/500 || ssn.Duration != dsn.Duration {
+			t.Errorf("song %d: tick duration %v and duration %d, expect %v and %d",
+				i, ssn.TickDuration, ssn.Duration, float64(dsn.TickDuration)/500, dsn.Duration)
+		}
+		var changes []synth.TempoChange
+		for _, c := range dsn.TempoChanges {
+			changes = append(changes, synth.TempoChange{Tick: c.Tick, TickDuration: float64(c.TickDuration) / 500})
+		}
+		if !reflect.DeepEqual(ssn.TempoChanges, changes) {
+			t.Errorf("song %d: tempo changes are %v, expect %v", i, ssn.TempoChanges, changes)
+		}
+		if len(ssn.Tracks) != len(dsn.Tracks) {
+			t.Errorf("song %d: got %d tracks, expect %d", i, len(ssn.Tracks), len(dsn.Tracks))
+			continue
+		}
+		for j, dtr := range dsn.Tracks {
+			name := fmt.Sprintf("song %d track %d", i, j)
+			str := ssn.Tracks[j]
+			if str.Instrument != dtr.Instrument || str.ConstantDuration != dtr.ConstantDuration {
+				t.Errorf("%s: instrument %d and constant duration %d, expect %d and %d",
+					name, str.Instrument, str.ConstantDuration, dtr.Instrument, dtr.ConstantDuration)
+			}
+			if math.Abs(gain(str.Gain)-dtr.GainDB) > 1e-6 || math.Abs(str.Pan-dtr.Pan) > 1e-9 {
+				t.Errorf("%s: gain %f dB and pan %f, expect %f dB and %f",
+					name, gain(str.Gain), str.Pan, dtr.GainDB, dtr.Pan)
+			}
+			if (str.Velocities != nil) != dtr.hasVelocity {
+				t.Errorf("%s: has velocities is %t, expect %t", name, str.Velocities != nil, dtr.hasVelocity)
+			}
+			values, vels := synthTicks(str)
+			evalues, evels := noteTicks(dtr.Notes)
+			if !reflect.DeepEqual(values, evalues) {
+				t.Errorf("%s: notes do not match", name)
+			} else if str.Velocities != nil && !equalVelocities(vels, evels) {
+				t.Errorf("%s: velocities do not match", name)
+			}
+			var points []synth.AutomationPoint
+			for _, p := range dtr.GainAutomation {
+				points = append(points, synth.AutomationPoint{Tick: p.Tick, Ramp: int(p.Ramp), Value: p.Value})
+			}
+			for _, p := range dtr.PanAutomation {
+				points = append(points, synth.AutomationPoint{Tick: p.Tick, Pan: true, Ramp: int(p.Ramp), Value: p.Value})
+			}
+			if len(str.Automation) != len(points) {
+				t.Errorf("%s: got %d automation points, expect %d", name, len(str.Automation), len(points))
+				continue
+			}
+			for k, p := range str.Automation {
+				if !p.Pan {
+					p.Value = gain(p.Value)
+				}
+				e := points[k]
+				if p.Tick != e.Tick || p.Pan != e.Pan || p.Ramp != e.Ramp || math.Abs(p.Value-e.Value) > 1e-6 {
+					t.Errorf("%s: automation point %d is %+v, expect %+v", name, k, p, e)
+				}
+			}
+		}
+	}
+	for i, dx := range d.Sfx {
+		x := sd.Sfx[i]
+		if x.Instrument != dx.Instrument || x.Sweep != dx.Sweep || x.TickDuration != float64(dx.TickDuration)/500 ||
+			math.Abs(gain(x.Gain)-dx.GainDB) > 1e-6 {
+			t.Errorf("sfx %d: got %+v, expect %+v", i, x, dx)
+		}
+		var notes []synth.SfxNote
+		for _, n := range dx.Notes {
+			v := int(n.Value[0])
+			if n.IsRest {
+				v = -1
+			}
+			notes = append(notes, synth.SfxNote{Value: v, Duration: int(n.Duration)})
+		}
+		if !reflect.DeepEqual(x.Notes, notes) {
+			t.Errorf("sfx %d: notes are %v, expect %v", i, x.Notes, notes)
+		}
+	}
+}
+
+func TestSynthLoad(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	songs := []*Song{randomSong(r, 0), randomSong(r, 1), randomSong(r, 2)}
+	addRandomAutomation(r, songs[1])
+	sfx := []*Sfx{randomSfx(r, 0), randomSfx(r, 1)}
+	for layout := 0; layout < numLayouts; layout++ {
+		c, err := compileLayout(testSounds(), songs, sfx, layout)
+		if err != nil {
+			t.Fatal("compile:", err)
+		}
+		checkSynthLoad(t, c)
+		if t.Failed() {
+			t.Fatalf("layout %d failed", layout)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package synth
+
+import "math"
+
+// blockSize is the number of samples processed at a time.
+const blockSize = 128
+
+type nodeKind int
+
+const (
+	gainNode nodeKind = iota
+	pannerNode
+	lowpassNode
+	highpassNode
+	bandpassNode
+	squareNode
+	sawtoothNode
+	triangleNode
+)
+
+var nodeNames = [...]string{
+	gainNode:     "gain",
+	pannerNode:   "pan",
+	lowpassNode:  "lowpass",
+	highpassNode: "highpass",
+	bandpassNode: "bandpass",
+	squareNode:   "square",
+	sawtoothNode: "sawtooth",
+	triangleNode: "triangle",
+}
+
+func (k nodeKind) String() string {
+	return nodeNames[k]
+}
+
+// isSource returns true if the node is an audio source, which has no inputs.
+func (k nodeKind) isSource() bool {
+	return k >= squareNode
+}
+
+// A node is an audio processing node in a graph.
+type node struct {
+	kind   nodeKind
+	params []*param
+	inputs []*node
+
+	// stereo is true if the output has two channels. If false, only the first
+	// channel is used.
+	stereo bool
+	// inStereo is true if the input to the node has two channels.
+	inStereo bool
+	out      [2][]float64
+	values   [][]float64
+
+	// Oscillator state.
+	start, stop float64
+	phase       float64
+
+	// Filter state, for each channel.
+	x1, x2, y1, y2 [2]float64
+}
+
+// newNode creates a new node of the given type, with default parameter values.
+func newNode(kind nodeKind) *node {
+	var defaults []float64
+	switch kind {
+	case gainNode:
+		defaults = []float64{1}
+	case pannerNode:
+		defaults = []float64{0}
+	case lowpassNode, highpassNode, bandpassNode:
+		// Frequency, detune, Q.
+		defaults = []float64{350, 0, 1}
+	default:
+		// Frequency, detune.
+		defaults = []float64{440, 0}
+	}
+	n := &node{kind: kind}
+	for _, v := range defaults {
+		n.params = append(n.params, &param{value: v})
+	}
+	return n
+}
+
+// finish prepares the graph rooted at this node for processing.
+func (n *node) finish() {
+	for _, in := range n.inputs {
+		in.finish()
+		if in.stereo {
+			n.inStereo = true
+		}
+	}
+	n.stereo = n.inStereo || n.kind == pannerNode
+	n.out[0] = make([]float64, blockSize)
+	if n.stereo {
+		n.out[1] = make([]float64, blockSize)
+	}
+	n.values = make([][]float64, len(n.params))
+	for i := range n.values {
+		n.values[i] = make([]float64, blockSize)
+	}
+}
+
+// process calculates the next block of output for the node, starting at time
+// t0, with dt seconds per sample.
+func (n *node) process(size int, t0, dt float64) {
+	for i, p := range n.params {
+		p.fill(n.values[i][:size], t0, dt)
+	}
+	if n.kind.isSource() {
+		n.oscillate(size, t0, dt)
+		return
+	}
+	l := n.out[0][:size]
+	for i := range l {
+		l[i] = 0
+	}
+	var r []float64
+	if n.stereo {
+		r = n.out[1][:size]
+		for i := range r {
+			r[i] = 0
+		}
+	}
+	for _, in := range n.inputs {
+		in.process(size, t0, dt)
+		il := in.out[0][:size]
+		ir := il
+		if in.stereo {
+			ir = in.out[1][:size]
+		}
+		for i, x := range il {
+			l[i] += x
+		}
+		if r != nil {
+			for i, x := range ir {
+				r[i] += x
+			}
+		}
+	}
+	switch n.kind {
+	case gainNode:
+		g := n.values[0][:size]
+		for i := range l {
+			l[i] *= g[i]
+		}
+		for i := range r {
+			r[i] *= g[i]
+		}
+	case pannerNode:
+		pan(l, r, n.inStereo, n.values[0][:size])
+	case lowpassNode, highpassNode, bandpassNode:
+		n.filter(size, dt)
+	default:
+		panic("bad node kind")
+	}
+}
+
+// pan applies equal-power panning to a buffer, as a StereoPannerNode does. If
+// stereo is false, the input is only in the left channel.
+func pan(l, r []float64, stereo bool, pan []float64) {
+	var gl, gr float64
+	for i, p := range pan {
+		if i == 0 || p != pan[i-1] {
+			if p < -1 {
+				p = -1
+			} else if p > 1 {
+				p = 1
+			}
+			var x float64
+			switch {
+			case !stereo:
+				x = (p + 1) * (math.Pi / 4)
+			case p <= 0:
+				x = (p + 1) * (math.Pi / 2)
+			default:
+				x = p * (math.Pi / 2)
+			}
+			gl, gr = math.Cos(x), math.Sin(x)
+		}
+		switch {
+		case !stereo:
+			l[i], r[i] = l[i]*gl, l[i]*gr
+		case pan[i] <= 0:
+			l[i], r[i] = l[i]+r[i]*gl, r[i]*gr
+		default:
+			l[i], r[i] = l[i]*gl, r[i]+l[i]*gr
+		}
+	}
+}
+
+// filter applies a biquad filter to the node's output buffer, using the
+// filter formulas from the Web Audio API specification.
+func (n *node) filter(size int, dt float64) {
+	freq := n.values[0]
+	detune := n.values[1]
+	q := n.values[2]
+	nchan := 1
+	if n.stereo {
+		nchan = 2
+	}
+	nyquist := 0.5 / dt
+	var b0, b1, b2, a1, a2, qgain float64
+	for i := 0; i < size; i++ {
+		if i == 0 || q[i] != q[i-1] {
+			qgain = math.Pow(10, q[i]/20)
+		}
+		if i == 0 || freq[i] != freq[i-1] || detune[i] != detune[i-1] || q[i] != q[i-1] {
+			f := freq[i] * math.Exp2(detune[i]/1200)
+			if f < 1 {
+				f = 1
+			} else if f > nyquist*0.999 {
+				f = nyquist * 0.999
+			}
+			w0 := 2 * math.Pi * f * dt
+			cw, sw := math.Cos(w0), math.Sin(w0)
+			var alpha, c0, c1, c2 float64
+			switch n.kind {
+			case lowpassNode:
+				alpha = sw / (2 * qgain)
+				c0, c1, c2 = (1-cw)/2, 1-cw, (1-cw)/2
+			case highpassNode:
+				alpha = sw / (2 * qgain)
+				c0, c1, c2 = (1+cw)/2, -(1 + cw), (1+cw)/2
+			case bandpassNode:
+				qq := q[i]
+				if qq < 1e-4 {
+					qq = 1e-4
+				}
+				alpha = sw / (2 * qq)
+				c0, c1, c2 = alpha, 0, -alpha
+			}
+			a0 := 1 + alpha
+			b0, b1, b2 = c0/a0, c1/a0, c2/a0
+			a1, a2 = -2*cw/a0, (1-alpha)/a0
+		}
+		for c := 0; c < nchan; c++ {
+			x := n.out[c][i]
+			y := b0*x + b1*n.x1[c] + b2*n.x2[c] - a1*n.y1[c] - a2*n.y2[c]
+			n.x2[c], n.x1[c] = n.x1[c], x
+			n.y2[c], n.y1[c] = n.y1[c], y
+			n.out[c][i] = y
+		}
+	}
+}
+
+// polyBLEP returns the band-limited step correction for a discontinuity at
+// phase 0, for an oscillator with phase t and phase increment dt.
+func polyBLEP(t, dt float64) float64 {
+	if t < dt {
+		t /= dt
+		return t + t - t*t - 1
+	}
+	if t > 1-dt {
+		t = (t - 1) / dt
+		return t*t + t + t + 1
+	}
+	return 0
+}
+
+// oscillate generates the next block of output for an oscillator.
+func (n *node) oscillate(size int, t0, dt float64) {
+	out := n.out[0][:size]
+	freq := n.values[0]
+	detune := n.values[1]
+	var scale float64
+	for i := range out {
+		if i == 0 || detune[i] != detune[i-1] {
+			scale = math.Exp2(detune[i]/1200) * dt
+		}
+		t := t0 + float64(i)*dt
+		if t < n.start || t >= n.stop {
+			out[i] = 0
+			continue
+		}
+		inc := math.Abs(freq[i] * scale)
+		if inc > 0.5 {
+			inc = 0.5
+		}
+		p := n.phase
+		// Phase, offset by one half.
+		q := p + 0.5
+		if q >= 1 {
+			q -= 1
+		}
+		var x float64
+		switch n.kind {
+		case squareNode:
+			if p < 0.5 {
+				x = 1
+			} else {
+				x = -1
+			}
+			x += polyBLEP(p, inc)
+			x -= polyBLEP(q, inc)
+		case sawtoothNode:
+			x = 2*q - 1 - polyBLEP(q, inc)
+		case triangleNode:
+			switch {
+			case p < 0.25:
+				x = 4 * p
+			case p < 0.75:
+				x = 2 - 4*p
+			default:
+				x = 4*p - 4
+			}
+		}
+		out[i] = x
+		p += inc
+		if p >= 1 {
+			p -= 1
+		}
+		n.phase = p
+	}
+}
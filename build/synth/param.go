@@ -0,0 +1,142 @@
+package synth
+
+import "math"
+
+type eventKind int
+
+const (
+	setValue eventKind = iota
+	linearRamp
+	exponentialRamp
+	setTarget
+)
+
+// An event is an automation event for an audio parameter.
+type event struct {
+	kind         eventKind
+	time         float64
+	value        float64
+	timeConstant float64
+}
+
+// A param is an audio parameter. It follows the semantics of AudioParam in the
+// Web Audio API, but only implements the automation methods which the
+// synthesizer uses.
+type param struct {
+	value  float64
+	events []event
+}
+
+func (p *param) addEvent(e event) {
+	i := len(p.events)
+	for i > 0 && p.events[i-1].time > e.time {
+		i--
+	}
+	p.events = append(p.events, event{})
+	copy(p.events[i+1:], p.events[i:])
+	p.events[i] = e
+}
+
+func (p *param) setValueAtTime(value, time float64) {
+	p.addEvent(event{kind: setValue, time: time, value: value})
+}
+
+func (p *param) linearRampToValueAtTime(value, time float64) {
+	p.addEvent(event{kind: linearRamp, time: time, value: value})
+}
+
+func (p *param) exponentialRampToValueAtTime(value, time float64) {
+	p.addEvent(event{kind: exponentialRamp, time: time, value: value})
+}
+
+func (p *param) setTargetAtTime(value, time, timeConstant float64) {
+	p.addEvent(event{kind: setTarget, time: time, value: value, timeConstant: timeConstant})
+}
+
+// A segment is a part of a parameter's timeline where the value is
+// base + slope*(t-start) + scale*exp(rate*(t-start)), for start <= t < end.
+type segment struct {
+	base, slope, scale, rate float64
+	start, end               float64
+}
+
+// segmentAt returns the segment of the timeline containing the given time.
+func (p *param) segmentAt(t float64) segment {
+	v := p.value
+	var vt float64
+	var target *event
+	for i := range p.events {
+		e := &p.events[i]
+		if t < e.time {
+			switch {
+			case e.kind == linearRamp && vt < e.time:
+				return segment{
+					base:  v,
+					slope: (e.value - v) / (e.time - vt),
+					start: vt,
+					end:   e.time,
+				}
+			case e.kind == exponentialRamp && v*e.value > 0 && vt < e.time:
+				return segment{
+					scale: v,
+					rate:  math.Log(e.value/v) / (e.time - vt),
+					start: vt,
+					end:   e.time,
+				}
+			case target != nil:
+				return segment{
+					base:  target.value,
+					scale: v - target.value,
+					rate:  -1 / target.timeConstant,
+					start: vt,
+					end:   e.time,
+				}
+			}
+			return segment{base: v, start: vt, end: e.time}
+		}
+		if target != nil {
+			v = target.value + (v-target.value)*math.Exp(-(e.time-vt)/target.timeConstant)
+			target = nil
+		}
+		switch e.kind {
+		case setValue, linearRamp, exponentialRamp:
+			v = e.value
+		case setTarget:
+			target = e
+		}
+		vt = e.time
+	}
+	if target != nil {
+		return segment{
+			base:  target.value,
+			scale: v - target.value,
+			rate:  -1 / target.timeConstant,
+			start: vt,
+			end:   math.Inf(1),
+		}
+	}
+	return segment{base: v, start: vt, end: math.Inf(1)}
+}
+
+// fill writes the value of the parameter at times t0, t0+dt, t0+2*dt, etc.
+// to the buffer.
+func (p *param) fill(buf []float64, t0, dt float64) {
+	if len(p.events) == 0 {
+		for i := range buf {
+			buf[i] = p.value
+		}
+		return
+	}
+	for i := 0; i < len(buf); {
+		t := t0 + float64(i)*dt
+		s := p.segmentAt(t)
+		x := s.scale * math.Exp(s.rate*(t-s.start))
+		k := math.Exp(s.rate * dt)
+		y := s.base + s.slope*(t-s.start)
+		for ; i < len(buf) && t0+float64(i)*dt < s.end; i++ {
+			buf[i] = y + x
+			x *= k
+			y += s.slope * dt
+		}
+	}
+}
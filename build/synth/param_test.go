@@ -0,0 +1,96 @@
+package synth
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParamFill(t *testing.T) {
+	cases := []struct {
+		name   string
+		value  float64
+		events func(p *param)
+		expect func(t float64) float64
+	}{
+		{
+			name:  "setValue",
+			value: 1,
+			events: func(p *param) {
+				p.setValueAtTime(3, 0.5)
+				p.setValueAtTime(-2, 0.75)
+			},
+			expect: func(t float64) float64 {
+				switch {
+				case t < 0.5:
+					return 1
+				case t < 0.75:
+					return 3
+				default:
+					return -2
+				}
+			},
+		},
+		{
+			name: "linearRamp",
+			events: func(p *param) {
+				p.setValueAtTime(2, 0.25)
+				p.linearRampToValueAtTime(4, 0.75)
+			},
+			expect: func(t float64) float64 {
+				switch {
+				case t < 0.25:
+					return 0
+				case t < 0.75:
+					return 2 + 4*(t-0.25)
+				default:
+					return 4
+				}
+			},
+		},
+		{
+			name: "exponentialRamp",
+			events: func(p *param) {
+				p.setValueAtTime(1, 0)
+				p.exponentialRampToValueAtTime(16, 1)
+			},
+			expect: func(t float64) float64 {
+				if t < 1 {
+					return math.Exp2(4 * t)
+				}
+				return 16
+			},
+		},
+		{
+			name:  "setTarget",
+			value: 1,
+			events: func(p *param) {
+				p.setTargetAtTime(3, 0.5, 0.25)
+				p.setValueAtTime(0, 1.5)
+			},
+			expect: func(t float64) float64 {
+				switch {
+				case t < 0.5:
+					return 1
+				case t < 1.5:
+					return 3 - 2*math.Exp(-(t-0.5)/0.25)
+				default:
+					return 0
+				}
+			},
+		},
+	}
+	const dt = 1.0 / 64
+	for _, c := range cases {
+		p := param{value: c.value}
+		c.events(&p)
+		buf := make([]float64, 128)
+		p.fill(buf, 0, dt)
+		for i, x := range buf {
+			tm := float64(i) * dt
+			if y := c.expect(tm); math.Abs(x-y) > 1e-9 {
+				t.Errorf("%s: value at %v is %v, expect %v", c.name, tm, x, y)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,587 @@
+package synth
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+
+	"moria.us/js13k/build/embed"
+)
+
+// Special note values, see compile.go in the song package.
+const (
+	trackEnd     = embed.NumValues - 1
+	restValue    = embed.NumValues - 6
+	initialValue = 60
+)
+
+// Layout flags, see compile.go in the song package.
+const (
+	layoutTrackBase        = 1
+	layoutInterleave       = 2
+	layoutTrackMajor       = 4
+	layoutUniformDurations = 8
+	layoutAutomation       = 16
+)
+
+// Automation point flags and ramps, see automation.go in the song package.
+const (
+	automationPanFlag   = 1
+	automationRampShift = 1
+
+	rampLinear      = 0
+	rampStep        = 1
+	rampExponential = 2
+)
+
+// Track flags, see compile.go in the song package.
+const (
+	constantDurationMask = 63
+	velocityFlag         = 64
+)
+
+// Note velocities, see song.go in the song package.
+const (
+	defaultVelocity = 100
+	maxVelocity     = 127
+)
+
+var errParse = errors.New("music parsing failed")
+
+// A Track is an instrument track in a song, decoded into voices.
+type Track struct {
+	// Voices contains the note values for each voice. Rests, and voices which
+	// are not playing, are -1.
+	Voices [][]int
+	// Durations contains the duration of each note, in ticks.
+	Durations []int
+
+	// Velocities contains the gain for each note, or nil if the track has
+	// no velocity values.
+	Velocities []float64
+
+	Instrument       int
+	Gain             float64
+	Pan              float64
+	ConstantDuration int
+
+	// Automation contains the automation points for the track's gain and
+	// pan, in the order they appear in the data.
+	Automation []AutomationPoint
+}
+
+// An AutomationPoint is a point where a track's gain or pan reaches a value.
+type AutomationPoint struct {
+	// Tick is the time of the point, in ticks.
+	Tick int
+	// Pan is true if the point is for the track's pan, and false if it is for
+	// the track's gain.
+	Pan bool
+	// Ramp is the shape of the change leading up to the point: linear, step,
+	// or exponential.
+	Ramp  int
+	Value float64
+}
+
+// A TempoChange is a change in the length of a tick partway through a song.
+type TempoChange struct {
+	// Tick is the time of the change, in ticks.
+	Tick int
+	// TickDuration is the new length of a tick, in seconds.
+	TickDuration float64
+}
+
+// A Song is a song decoded from the compiled music data.
+type Song struct {
+	// TickDuration is the length of a tick at the start of the song, in
+	// seconds.
+	TickDuration float64
+	// Duration is the length of the song, in ticks, for looping.
+	Duration     int
+	TempoChanges []TempoChange
+	Tracks       []*Track
+}
+
+// TickTime returns the time when a tick starts, in seconds, relative to the
+// start of the song. This matches TickTime in audio.music.js.
+func (sn *Song) TickTime(tick int) float64 {
+	var t float64
+	var pos int
+	dur := sn.TickDuration
+	for _, c := range sn.TempoChanges {
+		if c.Tick >= tick {
+			break
+		}
+		t += float64(c.Tick-pos) * dur
+		pos = c.Tick
+		dur = c.TickDuration
+	}
+	return t + float64(tick-pos)*dur
+}
+
+// An SfxNote is a note or rest in a sound effect.
+type SfxNote struct {
+	// Value is the note value, or -1 for a rest.
+	Value int
+	// Duration is the length of the note, in ticks.
+	Duration int
+}
+
+// An Sfx is a sound effect decoded from the compiled music data.
+type Sfx struct {
+	Instrument int
+	Gain       float64
+	// TickDuration is the length of a tick, in seconds.
+	TickDuration float64
+	// Sweep is the change in pitch over each note, in semitones.
+	Sweep int
+	Notes []SfxNote
+}
+
+// Data is the decoded music data. This matches the data created by Load in
+// audio.data.js.
+type Data struct {
+	Sounds [][]byte
+	Songs  []*Song
+	Sfx    []*Sfx
+}
+
+// Load decodes compiled music data.
+func Load(data []byte) (*Data, error) {
+	if len(data) < 4 {
+		return nil, errParse
+	}
+	nsounds := int(data[0])
+	nsongs := int(data[1])
+	nsfx := int(data[2])
+	layout := int(data[3])
+	pos := 4
+	var d Data
+	var allTracks []*Track
+	for i := 0; i < nsounds; i++ {
+		if pos+1 > len(data) {
+			return nil, errParse
+		}
+		n := int(data[pos])
+		pos++
+		if pos+n > len(data) {
+			return nil, errParse
+		}
+		d.Sounds = append(d.Sounds, data[pos:pos+n])
+		pos += n
+	}
+	for i := 0; i < nsongs; i++ {
+		if pos+5 > len(data) {
+			return nil, errParse
+		}
+		h := data[pos : pos+5]
+		pos += 5
+		nchanges := int(h[4])
+		if pos+3*nchanges > len(data) {
+			return nil, errParse
+		}
+		sn := Song{
+			TickDuration: float64(h[1]) / 500,
+			Duration:     embed.NumValues*int(h[2]) + int(h[3]),
+		}
+		for j := 0; j < nchanges; j++ {
+			c := data[pos : pos+3]
+			pos += 3
+			sn.TempoChanges = append(sn.TempoChanges, TempoChange{
+				Tick:         embed.NumValues*int(c[0]) + int(c[1]),
+				TickDuration: float64(c[2]) / 500,
+			})
+		}
+		ntracks := int(h[0])
+		if pos+4*ntracks > len(data) {
+			return nil, errParse
+		}
+		for j := 0; j < ntracks; j++ {
+			t := data[pos : pos+4]
+			pos += 4
+			if int(t[0]) >= nsounds {
+				return nil, errors.New("invalid instrument")
+			}
+			sn.Tracks = append(sn.Tracks, &Track{
+				Instrument:       int(t[0]),
+				Gain:             math.Pow(exponent, float64(t[1])),
+				Pan:              float64(int(t[2])-zeroValue) / 60,
+				ConstantDuration: int(t[3]) & constantDurationMask,
+			})
+			if t[3]&velocityFlag != 0 {
+				sn.Tracks[j].Velocities = []float64{}
+			}
+		}
+		allTracks = append(allTracks, sn.Tracks...)
+		d.Songs = append(d.Songs, &sn)
+	}
+	order := allTracks
+	if layout&layoutTrackMajor != 0 {
+		order = nil
+		for i := 0; len(order) < len(allTracks); i++ {
+			for _, sn := range d.Songs {
+				if i < len(sn.Tracks) {
+					order = append(order, sn.Tracks[i])
+				}
+			}
+		}
+	}
+	// Each function decodes one part of the note data for a track.
+	values := func(tr *Track) error {
+		voices := [][]int{nil}
+		last := []int{initialValue}
+		if layout&layoutTrackBase != 0 {
+			if pos >= len(data) {
+				return errParse
+			}
+			last[0] = int(data[pos])
+			pos++
+		}
+		nvoices := 1
+		for {
+			if pos >= len(data) {
+				return errParse
+			}
+			b := int(data[pos])
+			switch {
+			case b < restValue:
+				for i := 0; i < nvoices; i++ {
+					if pos >= len(data) {
+						return errParse
+					}
+					if i == len(last) {
+						last = append(last, last[i-1])
+					}
+					last[i] = (last[i] + int(data[pos])) % restValue
+					voices[i] = append(voices[i], last[i])
+					pos++
+				}
+				for i := nvoices; i < len(voices); i++ {
+					voices[i] = append(voices[i], -1)
+				}
+			case b == trackEnd:
+				pos++
+				tr.Voices = voices
+				return nil
+			case b == restValue:
+				pos++
+				for i := range voices {
+					voices[i] = append(voices[i], -1)
+				}
+			default:
+				pos++
+				nvoices = b - restValue
+				for len(voices) < nvoices {
+					v := make([]int, len(voices[0]))
+					for i := range v {
+						v[i] = -1
+					}
+					voices = append(voices, v)
+				}
+			}
+		}
+	}
+	durations := func(tr *Track) error {
+		n := len(tr.Voices[0])
+		tr.Durations = make([]int, n)
+		if layout&layoutUniformDurations != 0 {
+			if pos >= len(data) {
+				return errParse
+			}
+			x := int(data[pos])
+			pos++
+			if x != 0 {
+				for i := range tr.Durations {
+					tr.Durations[i] = x
+				}
+				return nil
+			}
+		}
+		if pos+n > len(data) {
+			return errParse
+		}
+		for i, x := range data[pos : pos+n] {
+			tr.Durations[i] = int(x)
+		}
+		pos += n
+		return nil
+	}
+	velocities := func(tr *Track) error {
+		if tr.Velocities == nil {
+			return nil
+		}
+		n := len(tr.Durations)
+		if pos+n > len(data) {
+			return errParse
+		}
+		tr.Velocities = make([]float64, n)
+		for i, x := range data[pos : pos+n] {
+			v := float64(maxVelocity-int(x)) / defaultVelocity
+			tr.Velocities[i] = v * v
+		}
+		pos += n
+		return nil
+	}
+	if layout&layoutInterleave != 0 {
+		for _, tr := range order {
+			for _, f := range [...]func(*Track) error{values, durations, velocities} {
+				if err := f(tr); err != nil {
+					return nil, err
+				}
+			}
+		}
+	} else {
+		for _, f := range [...]func(*Track) error{values, durations, velocities} {
+			for _, tr := range order {
+				if err := f(tr); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if layout&layoutAutomation != 0 {
+		for _, tr := range order {
+			if pos >= len(data) {
+				return nil, errParse
+			}
+			n := int(data[pos])
+			pos++
+			if pos+4*n > len(data) {
+				return nil, errParse
+			}
+			for j := 0; j < n; j++ {
+				a := data[pos : pos+4]
+				pos += 4
+				p := AutomationPoint{
+					Tick: embed.NumValues*int(a[0]) + int(a[1]),
+					Pan:  a[2]&automationPanFlag != 0,
+					Ramp: int(a[2] >> automationRampShift),
+				}
+				if p.Pan {
+					p.Value = float64(int(a[3])-zeroValue) / 60
+				} else {
+					p.Value = math.Pow(exponent, float64(a[3]))
+				}
+				tr.Automation = append(tr.Automation, p)
+			}
+		}
+	}
+	for i := 0; i < nsfx; i++ {
+		if pos+5 > len(data) {
+			return nil, errParse
+		}
+		h := data[pos : pos+5]
+		pos += 5
+		if int(h[0]) >= nsounds {
+			return nil, errors.New("invalid instrument")
+		}
+		x := Sfx{
+			Instrument:   int(h[0]),
+			Gain:         math.Pow(exponent, float64(h[1])),
+			TickDuration: float64(h[2]) / 500,
+			Sweep:        int(h[3]) - zeroValue,
+		}
+		n := int(h[4])
+		if pos+2*n > len(data) {
+			return nil, errParse
+		}
+		for j := 0; j < n; j++ {
+			v := int(data[pos])
+			if v == restValue {
+				v = -1
+			}
+			x.Notes = append(x.Notes, SfxNote{v, int(data[pos+1])})
+			pos += 2
+		}
+		d.Sfx = append(d.Sfx, &x)
+	}
+	return &d, nil
+}
+
+// A Renderer renders songs to audio buffers.
+type Renderer struct {
+	// SampleRate is the sample rate of the output, in Hz.
+	SampleRate int
+	// Head is the delay before the song starts, in seconds.
+	Head float64
+	// Tail is the amount of time to continue rendering after the last note is
+	// released, in seconds.
+	Tail float64
+	// Rand is the source of random values for instruments.
+	Rand *rand.Rand
+}
+
+// NewRenderer returns a renderer with the same settings that the game uses,
+// in audio.game.js. The random number generator is seeded with a fixed value
+// so the output is reproducible.
+func NewRenderer() *Renderer {
+	return &Renderer{
+		SampleRate: 44100,
+		Head:       0.1,
+		Tail:       2,
+		Rand:       rand.New(rand.NewSource(1)),
+	}
+}
+
+// A Buffer contains rendered stereo audio.
+type Buffer struct {
+	SampleRate int
+	Channels   [2][]float32
+}
+
+// Length returns the length of the song, in ticks. This is the length of the
+// longest track, which is not necessarily the same as the song's duration.
+func (sn *Song) Length() int {
+	var end int
+	for _, tr := range sn.Tracks {
+		var n int
+		for _, d := range tr.Durations {
+			n += d
+		}
+		if n > end {
+			end = n
+		}
+	}
+	return end
+}
+
+// RenderSong renders a song to an audio buffer. This does the same thing as
+// PlaySong in audio.music.js, inside an offline audio context created by
+// Render in audio.game.js.
+func (r *Renderer) RenderSong(d *Data, sn *Song) (*Buffer, error) {
+	end := r.Head + sn.TickTime(sn.Length()) + r.Tail
+	size := int(end * float64(r.SampleRate))
+	var mix, tbuf [2][]float64
+	for c := range mix {
+		mix[c] = make([]float64, size)
+		tbuf[c] = make([]float64, size)
+	}
+	for _, tr := range sn.Tracks {
+		if tr.Instrument >= len(d.Sounds) {
+			return nil, errors.New("invalid instrument")
+		}
+		program := d.Sounds[tr.Instrument]
+		for c := range tbuf {
+			for i := range tbuf[c] {
+				tbuf[c][i] = 0
+			}
+		}
+		// The graph structure does not depend on the note, so either all
+		// notes in a track are stereo, or none of them are.
+		var stereo bool
+		for _, v := range tr.Voices {
+			var tick int
+			for i, value := range v {
+				dur := tr.Durations[i]
+				if value > 0 {
+					gate := tr.ConstantDuration
+					if gate == 0 {
+						gate = dur
+					}
+					t := sn.TickTime(tick)
+					n, err := NewNote(program, r.Head+t, sn.TickTime(tick+gate)-t, value, 0, r.Rand)
+					if err != nil {
+						return nil, err
+					}
+					if tr.Velocities != nil {
+						n.Gain = tr.Velocities[i]
+					}
+					stereo = n.Stereo()
+					n.Render(tbuf, r.SampleRate)
+				}
+				tick += dur
+			}
+		}
+		gain := param{value: tr.Gain}
+		pp := param{value: tr.Pan}
+		if tr.Automation != nil {
+			gain.setValueAtTime(tr.Gain, r.Head)
+			pp.setValueAtTime(tr.Pan, r.Head)
+			for _, a := range tr.Automation {
+				p := &gain
+				if a.Pan {
+					p = &pp
+				}
+				t := r.Head + sn.TickTime(a.Tick)
+				switch a.Ramp {
+				case rampStep:
+					p.setValueAtTime(a.Value, t)
+				case rampExponential:
+					p.exponentialRampToValueAtTime(a.Value, t)
+				default:
+					p.linearRampToValueAtTime(a.Value, t)
+				}
+			}
+		}
+		dt := 1 / float64(r.SampleRate)
+		gains := make([]float64, size)
+		gain.fill(gains, 0, dt)
+		pans := make([]float64, size)
+		pp.fill(pans, 0, dt)
+		pan(tbuf[0], tbuf[1], stereo, pans)
+		for c := range mix {
+			for i, x := range tbuf[c] {
+				mix[c][i] += x * gains[i]
+			}
+		}
+	}
+	b := Buffer{SampleRate: r.SampleRate}
+	for c := range mix {
+		out := make([]float32, size)
+		for i, x := range mix[c] {
+			out[i] = float32(x)
+		}
+		b.Channels[c] = out
+	}
+	return &b, nil
+}
+
+// RenderSfx renders a sound effect to an audio buffer. This does the same
+// thing as PlaySfx in audio.music.js. The effect starts after the renderer's
+// head delay.
+func (r *Renderer) RenderSfx(d *Data, x *Sfx) (*Buffer, error) {
+	if x.Instrument >= len(d.Sounds) {
+		return nil, errors.New("invalid instrument")
+	}
+	program := d.Sounds[x.Instrument]
+	var notes []*Note
+	var end float64
+	var tick int
+	for _, sn := range x.Notes {
+		if sn.Value > 0 {
+			n, err := NewNote(program, r.Head+float64(tick)*x.TickDuration,
+				float64(sn.Duration)*x.TickDuration, sn.Value, x.Sweep, r.Rand)
+			if err != nil {
+				return nil, err
+			}
+			n.Gain = x.Gain
+			notes = append(notes, n)
+			if n.End > end {
+				end = n.End
+			}
+		}
+		tick += sn.Duration
+	}
+	size := int((end + r.Tail) * float64(r.SampleRate))
+	var mix [2][]float64
+	for c := range mix {
+		mix[c] = make([]float64, size)
+	}
+	var stereo bool
+	for _, n := range notes {
+		stereo = n.Stereo()
+		n.Render(mix, r.SampleRate)
+	}
+	if !stereo {
+		copy(mix[1], mix[0])
+	}
+	b := Buffer{SampleRate: r.SampleRate}
+	for c := range mix {
+		out := make([]float32, size)
+		for i, x := range mix[c] {
+			out[i] = float32(x)
+		}
+		b.Channels[c] = out
+	}
+	return &b, nil
+}
@@ -0,0 +1,47 @@
+package synth
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestRenderSongTail(t *testing.T) {
+	// Square wave with a 41 ms release, see TestNoteEnvelope.
+	program := []byte{
+		opGain, paramGainADSR, 100, 100, 64, 100,
+		opSquare, paramNote, zeroValue, paramDefault,
+	}
+	d := Data{Sounds: [][]byte{program}}
+	sn := Song{
+		TickDuration: 0.1,
+		Duration:     4,
+		Tracks: []*Track{{
+			Voices:    [][]int{{57}},
+			Durations: []int{4},
+			Gain:      1,
+		}},
+	}
+	// The head is longer than the tail, so the note's release is lost if the
+	// head is not included in the length of the buffer.
+	r := Renderer{SampleRate: 48000, Head: 0.5, Tail: 0.1, Rand: rand.New(rand.NewSource(1))}
+	b, err := r.RenderSong(&d, &sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := r.Head + 0.4
+	release := timeScale * math.Pow(exponent, 100)
+	for c, samples := range b.Channels {
+		if n, expect := len(samples), int((end+r.Tail)*48000); n != expect {
+			t.Errorf("channel %d: got %d samples, expect %d", c, n, expect)
+			continue
+		}
+		var level float64
+		for i := int(end * 48000); i < int((end+release/2)*48000); i++ {
+			level = math.Max(level, math.Abs(float64(samples[i])))
+		}
+		if level == 0 {
+			t.Errorf("channel %d: release is silent", c)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+// Package synth renders music offline, without a browser. It interprets the
+// instrument bytecode and song data the same way that the game does, in
+// audio.synth.js and audio.music.js.
+package synth
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"moria.us/js13k/build/embed"
+)
+
+const (
+	// Exponent for calculating parameter values. Numbers encoded as N are
+	// decoded as exponent**N, multiplied by a scale factor.
+	exponent = 0.94
+
+	// Scale applied to frequency parameters, in Hertz.
+	frequencyScale = 20e3
+
+	// Scale applied to time parameters, in seconds.
+	timeScale = 20
+
+	// Encoded value for zero, for values which can be negative.
+	zeroValue = (embed.NumValues - 1) >> 1
+)
+
+// Instruction opcodes.
+const (
+	opRepeat = iota
+	opEndRepeat
+	opPop
+	opGain
+	opPan
+	opLowpass
+	opHighpass
+	opBandpass
+	opSquare
+	opSawtooth
+	opTriangle
+)
+
+// Parameter opcodes.
+const (
+	paramDefault = iota
+	paramGainConst
+	paramTimeConst
+	paramFrequencyConst
+	paramIntConst
+	paramPanConst
+	paramGainADSR
+	paramFrequencyADSR
+	paramNote
+	paramRandomBipolar
+)
+
+var (
+	errOverrun   = errors.New("program overrun")
+	errEndRepeat = errors.New("unexpected end repeat")
+	errPop       = errors.New("cannot pop node")
+)
+
+// A voice is the state of a program being run to play a single note.
+type voice struct {
+	program []byte
+	pos     int
+	rand    *rand.Rand
+
+	t0       float64
+	tgate    float64
+	note     int
+	sweep    int
+	duration float64
+
+	out     *node
+	stack   []*node
+	sources []*node
+}
+
+func (v *voice) read(n int) ([]byte, error) {
+	if len(v.program)-v.pos < n {
+		return nil, errOverrun
+	}
+	d := v.program[v.pos : v.pos+n]
+	v.pos += n
+	return d, nil
+}
+
+func (v *voice) adsr(p *param, x0, x1 float64) error {
+	d, err := v.read(4)
+	if err != nil {
+		return err
+	}
+	ta := timeScale * math.Pow(exponent, float64(d[0]))
+	tr := timeScale * math.Pow(exponent, float64(d[3]))
+	p.setValueAtTime(x0, v.t0)
+	p.exponentialRampToValueAtTime(x1, v.t0+ta)
+	if tdgate := v.tgate - ta; tdgate > 0 {
+		tk := timeScale * math.Pow(exponent, float64(d[1]))
+		xs := x1 * math.Pow(x0/x1, float64(d[2])/(embed.NumValues-1))
+		p.setTargetAtTime(xs, v.t0+ta, tk)
+		p.setValueAtTime(xs+(x1-xs)/math.Exp(tdgate/tk), v.t0+v.tgate)
+		p.exponentialRampToValueAtTime(x0, v.t0+v.tgate+tr)
+		v.duration = math.Max(v.duration, v.tgate+tr)
+	} else {
+		p.exponentialRampToValueAtTime(x0, v.t0+ta+tr)
+		v.duration = math.Max(v.duration, ta+tr)
+	}
+	return nil
+}
+
+func (v *voice) param(p *param) error {
+	d, err := v.read(1)
+	if err != nil {
+		return err
+	}
+	switch op := d[0]; op {
+	case paramDefault:
+		return nil
+	case paramGainConst, paramTimeConst, paramFrequencyConst:
+		d, err := v.read(1)
+		if err != nil {
+			return err
+		}
+		scale := [...]float64{1, timeScale, frequencyScale}[op-paramGainConst]
+		p.value = scale * math.Pow(exponent, float64(d[0]))
+		return nil
+	case paramIntConst:
+		d, err := v.read(1)
+		if err != nil {
+			return err
+		}
+		p.value = float64(int(d[0]) - zeroValue)
+		return nil
+	case paramPanConst:
+		d, err := v.read(1)
+		if err != nil {
+			return err
+		}
+		p.value = float64(int(d[0])-zeroValue) / 60
+		return nil
+	case paramGainADSR:
+		return v.adsr(p, math.Pow(exponent, embed.NumValues-1), 1)
+	case paramFrequencyADSR:
+		d, err := v.read(2)
+		if err != nil {
+			return err
+		}
+		return v.adsr(p,
+			frequencyScale*math.Pow(exponent, float64(d[0])),
+			frequencyScale*math.Pow(exponent, float64(d[1])))
+	case paramNote:
+		d, err := v.read(1)
+		if err != nil {
+			return err
+		}
+		p.value = 440 * math.Exp2(float64(v.note+int(d[0])-69-zeroValue)/12)
+		if v.sweep != 0 {
+			p.setValueAtTime(p.value, v.t0)
+			p.exponentialRampToValueAtTime(p.value*math.Exp2(float64(v.sweep)/12), v.t0+v.tgate)
+		}
+		return nil
+	case paramRandomBipolar:
+		d, err := v.read(1)
+		if err != nil {
+			return err
+		}
+		p.value = (v.rand.Float64() - 0.5) * 99 * math.Pow(exponent, float64(d[0]))
+		return nil
+	default:
+		return fmt.Errorf("invalid param opcode: %d", op)
+	}
+}
+
+func (v *voice) addNode(kind nodeKind) error {
+	n := newNode(kind)
+	for _, p := range n.params {
+		if err := v.param(p); err != nil {
+			return err
+		}
+	}
+	v.out.inputs = append(v.out.inputs, n)
+	if kind.isSource() {
+		v.sources = append(v.sources, n)
+	} else {
+		v.stack = append(v.stack, v.out)
+		v.out = n
+	}
+	return nil
+}
+
+// run runs the program, constructing the audio graph.
+func (v *voice) run() error {
+	var (
+		inRepeat    bool
+		repeatCount int
+		repeatPos   int
+		repeatOut   *node
+		repeatStack []*node
+	)
+	for v.pos < len(v.program) {
+		op := v.program[v.pos]
+		v.pos++
+		switch op {
+		case opRepeat:
+			d, err := v.read(1)
+			if err != nil {
+				return err
+			}
+			inRepeat = true
+			repeatCount = int(d[0])
+			repeatPos = v.pos
+			repeatOut = v.out
+			repeatStack = append([]*node(nil), v.stack...)
+		case opEndRepeat:
+			if !inRepeat {
+				return errEndRepeat
+			}
+			v.out = repeatOut
+			v.stack = append(v.stack[:0:0], repeatStack...)
+			if repeatCount > 0 {
+				repeatCount--
+				v.pos = repeatPos
+			} else {
+				inRepeat = false
+			}
+		case opPop:
+			if len(v.stack) == 0 {
+				return errPop
+			}
+			v.out = v.stack[len(v.stack)-1]
+			v.stack = v.stack[:len(v.stack)-1]
+		case opGain:
+			if err := v.addNode(gainNode); err != nil {
+				return err
+			}
+		case opPan:
+			if err := v.addNode(pannerNode); err != nil {
+				return err
+			}
+		case opLowpass, opHighpass, opBandpass:
+			if err := v.addNode(lowpassNode + nodeKind(op-opLowpass)); err != nil {
+				return err
+			}
+		case opSquare, opSawtooth, opTriangle:
+			if err := v.addNode(squareNode + nodeKind(op-opSquare)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid opcode: %d", op)
+		}
+	}
+	return nil
+}
+
+// A Note is an instance of an instrument playing a single note.
+type Note struct {
+	root *node
+
+	// Gain is the gain applied to the note's output. This is 1 unless the
+	// note has a velocity.
+	Gain float64
+
+	// Start is the start time of the note, in seconds.
+	Start float64
+	// End is the time when the note finishes sounding, including the release.
+	End float64
+}
+
+// NewNote creates the audio graph for an instrument program playing a single
+// note. This is equivalent to PlaySynth in audio.synth.js. The start time and
+// gate length are measured in seconds, and the note is a MIDI note value. The
+// pitch of the note changes by sweep semitones over the gate length.
+func NewNote(program []byte, start, gate float64, note, sweep int, r *rand.Rand) (*Note, error) {
+	root := newNode(gainNode)
+	v := voice{
+		program:  program,
+		rand:     r,
+		t0:       start,
+		tgate:    gate,
+		note:     note,
+		sweep:    sweep,
+		duration: gate,
+		out:      root,
+	}
+	if err := v.run(); err != nil {
+		return nil, err
+	}
+	for _, s := range v.sources {
+		s.start = start
+		s.stop = start + v.duration
+	}
+	root.finish()
+	return &Note{
+		root:  root,
+		Gain:  1,
+		Start: start,
+		End:   start + v.duration,
+	}, nil
+}
+
+// Stereo returns true if the note's output has two channels.
+func (n *Note) Stereo() bool {
+	return n.root.stereo
+}
+
+// Render adds the note's audio to the buffer, which starts at time 0. If the
+// note's output is not stereo, only the left channel is written.
+func (n *Note) Render(out [2][]float64, sampleRate int) {
+	dt := 1 / float64(sampleRate)
+	s0 := int(math.Floor(n.Start * float64(sampleRate)))
+	s1 := int(math.Ceil(n.End * float64(sampleRate)))
+	if s0 < 0 {
+		s0 = 0
+	}
+	if s1 > len(out[0]) {
+		s1 = len(out[0])
+	}
+	root := n.root
+	for pos := s0; pos < s1; pos += blockSize {
+		size := s1 - pos
+		if size > blockSize {
+			size = blockSize
+		}
+		root.process(size, float64(pos)*dt, dt)
+		for c := 0; c < 2; c++ {
+			if c == 1 && !root.stereo {
+				break
+			}
+			dest := out[c][pos : pos+size]
+			for i, x := range root.out[c][:size] {
+				dest[i] += x * n.Gain
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package synth
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// renderNote renders a single note to a buffer one second long.
+func renderNote(t *testing.T, program []byte, start, gate float64, note int) (*Note, []float64) {
+	t.Helper()
+	const sampleRate = 48000
+	n, err := NewNote(program, start, gate, note, 0, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := [2][]float64{make([]float64, sampleRate), make([]float64, sampleRate)}
+	n.Render(out, sampleRate)
+	if n.Stereo() {
+		t.Error("note is stereo")
+	}
+	for i, x := range out[1] {
+		if x != 0 {
+			t.Fatalf("right channel has sample %d = %v", i, x)
+		}
+	}
+	return n, out[0]
+}
+
+func TestNoteTriangle(t *testing.T) {
+	// Triangle wave at the note's pitch, with no envelope.
+	program := []byte{opTriangle, paramNote, zeroValue, paramDefault}
+	const start, gate = 0.25, 0.5
+	n, samples := renderNote(t, program, start, gate, 69)
+	if n.End != start+gate {
+		t.Errorf("end is %v, expect %v", n.End, start+gate)
+	}
+	var crossings int
+	var energy float64
+	for i, x := range samples {
+		tm := float64(i) / 48000
+		if (tm < start || tm >= n.End) && x != 0 {
+			t.Fatalf("sample %d = %v, outside the note", i, x)
+		}
+		if math.Abs(x) > 1 {
+			t.Fatalf("sample %d = %v, out of range", i, x)
+		}
+		if i > 0 && (samples[i-1] < 0) != (x < 0) {
+			crossings++
+		}
+		energy += x * x
+	}
+	// A triangle wave has two zero crossings per cycle and a mean square of 1/3.
+	if expect := 2 * 440 * gate; math.Abs(float64(crossings)-expect) > 2 {
+		t.Errorf("got %d zero crossings, expect %v", crossings, expect)
+	}
+	if rms, expect := math.Sqrt(energy/(gate*48000)), 1/math.Sqrt(3); math.Abs(rms-expect) > 0.01 {
+		t.Errorf("RMS is %v, expect %v", rms, expect)
+	}
+}
+
+func TestNoteEnvelope(t *testing.T) {
+	// Square wave inside a gain envelope, with attack, decay, and release
+	// times of 20*0.94^100 = 41 ms.
+	program := []byte{
+		opGain, paramGainADSR, 100, 100, 64, 100,
+		opSquare, paramNote, zeroValue, paramDefault,
+	}
+	const start, gate = 0.25, 0.5
+	release := timeScale * math.Pow(exponent, 100)
+	n, samples := renderNote(t, program, start, gate, 57)
+	if math.Abs(n.End-(start+gate+release)) > 1e-9 {
+		t.Errorf("end is %v, expect %v", n.End, start+gate+release)
+	}
+	var peak, tail float64
+	for i, x := range samples {
+		tm := float64(i) / 48000
+		if (tm < start || tm >= n.End) && x != 0 {
+			t.Fatalf("sample %d = %v, outside the note", i, x)
+		}
+		peak = math.Max(peak, math.Abs(x))
+		if tm > n.End-0.005 {
+			tail = math.Max(tail, math.Abs(x))
+		}
+	}
+	if peak < 0.5 || peak > 1.1 {
+		t.Errorf("peak is %v, expect about 1", peak)
+	}
+	if tail > 0.05 {
+		t.Errorf("release ends with level %v", tail)
+	}
+	// Rendering is deterministic.
+	_, samples2 := renderNote(t, program, start, gate, 57)
+	for i := range samples {
+		if samples[i] != samples2[i] {
+			t.Fatalf("sample %d differs: %v, %v", i, samples[i], samples2[i])
+		}
+	}
+}
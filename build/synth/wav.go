@@ -0,0 +1,61 @@
+package synth
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// WriteWAV writes the buffer to a 16-bit stereo WAV file. Samples outside the
+// range -1..+1 are clipped.
+func (b *Buffer) WriteWAV(w io.Writer) error {
+	const (
+		channels      = 2
+		bitsPerSample = 16
+		frameSize     = channels * bitsPerSample / 8
+	)
+	l, r := b.Channels[0], b.Channels[1]
+	if len(l) != len(r) {
+		return errors.New("channel lengths differ")
+	}
+	dataSize := int64(len(l)) * frameSize
+	if dataSize > math.MaxUint32-36 {
+		return errors.New("audio too long for WAV file")
+	}
+	var h [44]byte
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+dataSize))
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], channels)
+	binary.LittleEndian.PutUint32(h[24:], uint32(b.SampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(b.SampleRate*frameSize))
+	binary.LittleEndian.PutUint16(h[32:], frameSize)
+	binary.LittleEndian.PutUint16(h[34:], bitsPerSample)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(dataSize))
+	bw := bufio.NewWriter(w)
+	bw.Write(h[:])
+	var frame [frameSize]byte
+	for i := range l {
+		binary.LittleEndian.PutUint16(frame[0:], uint16(toInt16(l[i])))
+		binary.LittleEndian.PutUint16(frame[2:], uint16(toInt16(r[i])))
+		bw.Write(frame[:])
+	}
+	return bw.Flush()
+}
+
+func toInt16(x float32) int16 {
+	y := math.Round(float64(x) * 32767)
+	if y > 32767 {
+		return 32767
+	}
+	if y < -32768 {
+		return -32768
+	}
+	return int16(y)
+}
@@ -71,8 +71,18 @@ func buildsong(ctx context.Context, songDir string, songout chan<- *SongState, s
 func doBuildSong(ctx context.Context, spath string, out chan<- *SongState) {
 	defer close(out)
 	cd, err := song.Compile(ctx, spath)
+	if err == nil {
+		// Changes to the module are picked up by the source directory watcher.
+		err = cd.WriteJS()
+	}
 	if err != nil {
-		logrus.Errorln("Music:", err)
+		if errs, ok := err.(song.ErrorList); ok {
+			for _, e := range errs {
+				logrus.Errorln("Music:", e)
+			}
+		} else {
+			logrus.Errorln("Music:", err)
+		}
 		out <- &SongState{Err: err}
 	} else {
 		out <- &SongState{Compiled: cd}
@@ -110,8 +110,9 @@ func (w *watcher) watch(ctx context.Context, codesrc chan<- *CodeState, songsrc
 			}
 			if dir == w.songdir &&
 				(strings.HasSuffix(base, ".txt") ||
+					strings.HasSuffix(base, ".sfx") ||
 					base == songList ||
-					base == song.CodeFile) {
+					base == song.InstrumentsFile) {
 				songsrc <- struct{}{}
 			}
 		case err, ok := <-fw.Errors:
@@ -0,0 +1,91 @@
+// Code generated by the music compiler from songs.json. DO NOT EDIT.
+
+/**
+ * Index of song "The Light of Creation (Intro)".
+ * @const {number}
+ */
+export const SongTheLightOfCreationIntro = 0;
+
+/**
+ * Index of song "After Dark (Intro)".
+ * @const {number}
+ */
+export const SongAfterDarkIntro = 1;
+
+/**
+ * Index of song "The Light of Creation".
+ * @const {number}
+ */
+export const SongTheLightOfCreation = 2;
+
+/**
+ * Index of song "After Dark".
+ * @const {number}
+ */
+export const SongAfterDark = 3;
+
+/**
+ * Number of songs.
+ * @const {number}
+ */
+export const NumSongs = 4;
+
+/**
+ * Index of instrument "Pluck".
+ * @const {number}
+ */
+export const InstrumentPluck = 0;
+
+/**
+ * Index of instrument "Dance Bass".
+ * @const {number}
+ */
+export const InstrumentDanceBass = 1;
+
+/**
+ * Index of instrument "Bass".
+ * @const {number}
+ */
+export const InstrumentBass = 2;
+
+/**
+ * Index of instrument "Soft Lead".
+ * @const {number}
+ */
+export const InstrumentSoftLead = 3;
+
+/**
+ * Index of instrument "Keys".
+ * @const {number}
+ */
+export const InstrumentKeys = 4;
+
+/**
+ * Number of instruments.
+ * @const {number}
+ */
+export const NumInstruments = 5;
+
+/**
+ * Index of sound effect "Pickup".
+ * @const {number}
+ */
+export const SfxPickup = 0;
+
+/**
+ * Index of sound effect "Download".
+ * @const {number}
+ */
+export const SfxDownload = 1;
+
+/**
+ * Index of sound effect "Device".
+ * @const {number}
+ */
+export const SfxDevice = 2;
+
+/**
+ * Number of sound effects.
+ * @const {number}
+ */
+export const NumSfx = 3;
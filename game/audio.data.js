@@ -8,10 +8,12 @@ export let Sounds;
  * @typedef {{
  *   Voices: !Array<!Array<number>>,
  *   Durations: !Array<number>,
+ *   Velocities: ?Array<number>,
  *   Instrument: number,
  *   Gain: number,
  *   Pan: number,
  *   ConstantDuration: number,
+ *   Automation: !Array<!Array<number>>,
  * }}
  */
 export var Track;
@@ -20,6 +22,7 @@ export var Track;
  * @typedef {{
  *   TickDuration: number,
  *   Duration: number,
+ *   TempoChanges: !Array<!Array<number>>,
  *   Tracks: Array<Track>!,
  * }}
  */
@@ -30,6 +33,23 @@ export var Song;
  */
 export let Songs;
 
+/**
+ * @typedef {{
+ *   Instrument: number,
+ *   Gain: number,
+ *   TickDuration: number,
+ *   Sweep: number,
+ *   Values: !Array<number>,
+ *   Durations: !Array<number>,
+ * }}
+ */
+export var SoundEffect;
+
+/**
+ * @type {Array<SoundEffect>}
+ */
+export let Effects;
+
 /**
  * Load all audio data from the raw binary data.
  * @param {!Array<number>} data
@@ -37,10 +57,11 @@ export let Songs;
 export function Load(data) {
   const initialValue = 60;
   /** @type {number} */
-  let pos = 2;
+  let pos = 4;
   /** @type {Array<Track!>!} */
   let allTracks = [];
-  let [nsounds, nsongs] = data;
+  // Layout flags, see compile.go in the song package.
+  let [nsounds, nsongs, nsfx, layout] = data;
   Sounds = [];
   Songs = [];
   while (nsounds--) {
@@ -54,78 +75,172 @@ export function Load(data) {
     Sounds.push(data.slice(pos, (pos += length)));
   }
   while (nsongs--) {
-    if (!COMPO && pos + 4 > data.length) {
+    if (!COMPO && pos + 5 > data.length) {
       throw new Error('music parsing failed');
     }
-    let [numtracks, tickduration, lengthHi, lengthLo] = data.slice(
-      pos,
-      (pos += 4),
-    );
+    let [numtracks, tickduration, lengthHi, lengthLo, numchanges] =
+      data.slice(pos, (pos += 5));
+    if (!COMPO && pos + 3 * numchanges > data.length) {
+      throw new Error('music parsing failed');
+    }
+    /** @type {!Array<!Array<number>>} */
+    const TempoChanges = Iterate(numchanges, () => {
+      let [tickHi, tickLo, duration] = data.slice(pos, (pos += 3));
+      return [NUM_VALUES * tickHi + tickLo, duration / 500];
+    });
     if (!COMPO && pos + 4 * numtracks > data.length) {
       throw new Error('music parsing failed');
     }
     /** @type {!Array<!Track>} */
     const Tracks = Iterate(numtracks, () => {
-      let [Instrument, gain, pan, ConstantDuration] = data.slice(
-        pos,
-        (pos += 4),
-      );
+      let [Instrument, gain, pan, flags] = data.slice(pos, (pos += 4));
       return /** @type {Track} */ ({
         Instrument,
         Gain: 0.94 ** gain,
         Pan: (pan - ((NUM_VALUES - 1) >> 1)) / 60,
-        ConstantDuration,
+        ConstantDuration: flags & 63,
+        Velocities: flags & 64 ? [] : null,
+        Automation: [],
       });
     });
     allTracks.push(...Tracks);
     Songs.push({
       TickDuration: tickduration / 500,
       Duration: NUM_VALUES * lengthHi + lengthLo,
+      TempoChanges,
       Tracks,
     });
   }
-  for (const track of allTracks) {
-    /** @type {!Array<!Array<number>>} */
-    let voices = [[]];
-    /** @type {!Array<number>} */
-    let last = [initialValue];
-    let nvoices = 1;
-    let i;
-    track.Voices = voices;
-    while (1) {
-      if (!COMPO && pos >= data.length) {
-        throw new Error('music parsing failed');
-      }
-      const byte = data[pos++];
-      if (byte < NUM_VALUES - 6) {
-        pos--;
-        for (i = 0; i < nvoices; i++) {
-          voices[i].push(
-            (last[i] =
-              ((last[i] ?? last[i - 1]) + data[pos++]) % (NUM_VALUES - 6)),
-          );
+  if (layout & 4) {
+    // Tracks are ordered by index within the song.
+    const order = [];
+    for (let i = 0; order.length < allTracks.length; i++) {
+      for (const { Tracks } of Songs) {
+        if (i < Tracks.length) {
+          order.push(Tracks[i]);
         }
-        for (; i < voices.length; i++) {
-          voices[i].push(-1);
-        }
-      } else if (byte == NUM_VALUES - 1) {
-        // End of track
-        break;
-      } else if (byte == NUM_VALUES - 6) {
-        for (i = 0; i < voices.length; i++) {
-          // Rest
-          voices[i].push(-1);
+      }
+    }
+    allTracks = order;
+  }
+  /**
+   * Functions which each decode one part of the note data for a track.
+   * @type {!Array<function(!Track)>}
+   */
+  const parts = [
+    (track) => {
+      /** @type {!Array<!Array<number>>} */
+      let voices = [[]];
+      /** @type {!Array<number>} */
+      let last = [layout & 1 ? data[pos++] : initialValue];
+      let nvoices = 1;
+      let i;
+      track.Voices = voices;
+      while (1) {
+        if (!COMPO && pos >= data.length) {
+          throw new Error('music parsing failed');
         }
-      } else {
-        // Polyphony change
-        nvoices = byte - (NUM_VALUES - 6);
-        while (voices.length < nvoices) {
-          voices.push(Array(voices[0].length).fill(-1));
+        const byte = data[pos++];
+        if (byte < NUM_VALUES - 6) {
+          pos--;
+          for (i = 0; i < nvoices; i++) {
+            voices[i].push(
+              (last[i] =
+                ((last[i] ?? last[i - 1]) + data[pos++]) % (NUM_VALUES - 6)),
+            );
+          }
+          for (; i < voices.length; i++) {
+            voices[i].push(-1);
+          }
+        } else if (byte == NUM_VALUES - 1) {
+          // End of track
+          break;
+        } else if (byte == NUM_VALUES - 6) {
+          for (i = 0; i < voices.length; i++) {
+            // Rest
+            voices[i].push(-1);
+          }
+        } else {
+          // Polyphony change
+          nvoices = byte - (NUM_VALUES - 6);
+          while (voices.length < nvoices) {
+            voices.push(Array(voices[0].length).fill(-1));
+          }
         }
       }
+    },
+    (track) => {
+      const n = track.Voices[0].length;
+      // With uniform durations, a nonzero byte is the duration of every note.
+      const uniform = layout & 8 && data[pos++];
+      track.Durations = uniform
+        ? Array(n).fill(uniform)
+        : data.slice(pos, (pos += n));
+    },
+    (track) => {
+      if (track.Velocities) {
+        track.Velocities = Array.from(
+          data.slice(pos, (pos += track.Durations.length)),
+          (x) => ((127 - x) / 100) ** 2,
+        );
+      }
+    },
+  ];
+  if (layout & 2) {
+    // Interleaved, all parts of each track together.
+    for (const track of allTracks) {
+      for (const part of parts) {
+        part(track);
+      }
+    }
+  } else {
+    for (const part of parts) {
+      allTracks.forEach(part);
     }
   }
-  for (const track of allTracks) {
-    track.Durations = data.slice(pos, (pos += track.Voices[0].length));
+  if (layout & 16) {
+    // Automation points for each track: [tick, isPan, ramp, value].
+    for (const track of allTracks) {
+      if (!COMPO && !(pos + 4 * data[pos] < data.length)) {
+        throw new Error('music parsing failed');
+      }
+      track.Automation = Iterate(data[pos++], () => {
+        let [tickHi, tickLo, flags, value] = data.slice(pos, (pos += 4));
+        return [
+          NUM_VALUES * tickHi + tickLo,
+          flags & 1,
+          flags >> 1,
+          flags & 1 ? (value - ((NUM_VALUES - 1) >> 1)) / 60 : 0.94 ** value,
+        ];
+      });
+    }
   }
+  Effects = Iterate(nsfx, () => {
+    if (!COMPO && pos + 5 > data.length) {
+      throw new Error('music parsing failed');
+    }
+    let [Instrument, gain, tickduration, sweep, nnotes] =
+      data.slice(pos, (pos += 5));
+    if (!COMPO && pos + 2 * nnotes > data.length) {
+      throw new Error('music parsing failed');
+    }
+    /** @type {!Array<number>} */
+    const Values = [];
+    /** @type {!Array<number>} */
+    const Durations = [];
+    while (nnotes--) {
+      const value = data[pos++];
+      // Rests are N-6, like in tracks.
+      Values.push(value == NUM_VALUES - 6 ? -1 : value);
+      Durations.push(data[pos++]);
+    }
+    return {
+      Instrument,
+      Gain: 0.94 ** gain,
+      TickDuration: tickduration / 500,
+      Sweep: sweep - ((NUM_VALUES - 1) >> 1),
+      Values,
+      Durations,
+    };
+  });
 }
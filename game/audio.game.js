@@ -1,11 +1,20 @@
 import { COMPO } from './common.js';
-import { Songs } from './audio.data.js';
-import { PlaySong } from './audio.music.js';
+import { Songs, Effects } from './audio.data.js';
+import { PlaySong, PlaySfx, TickTime } from './audio.music.js';
+import {
+  SongTheLightOfCreationIntro,
+  SongTheLightOfCreation,
+  SongAfterDarkIntro,
+} from './audio.const.js';
 
-export const MusicLightOfCreation = 0;
-export const MusicAfterDark = 1;
+export const MusicLightOfCreation = SongTheLightOfCreationIntro;
+export const MusicAfterDark = SongAfterDarkIntro;
 
-const NumSongs = 2;
+/**
+ * Offset from the index of a song's intro to the index of the full song.
+ * @const
+ */
+const FullSongOffset = SongTheLightOfCreation - SongTheLightOfCreationIntro;
 
 /**
  * Length of the audio tail for songs, in seconds. The amount of time after the
@@ -93,7 +102,7 @@ function PlayBuffer(buffer, startTime) {
  * @return {?RenderedTrack}
  */
 function GetTrack(index) {
-  return Tracks[index + NumSongs] ?? Tracks[index];
+  return Tracks[index + FullSongOffset] ?? Tracks[index];
 }
 
 /**
@@ -169,7 +178,7 @@ export async function Render() {
         end = tlen;
       }
     }
-    end = end * song.TickDuration + MusicTail;
+    end = MusicHead + TickTime(song, end) + MusicTail;
     var ctx = new constructor(
       2,
       (end * OfflineSampleRate) | 0,
@@ -201,6 +210,17 @@ export function PlayTrack(index) {
   }
 }
 
+/**
+ * Play a sound effect immediately. Does nothing if audio is not running.
+ * @param {number} index Index of the sound effect, one of the Sfx constants
+ *   in audio.const.js.
+ */
+export function PlayEffect(index) {
+  if (Ctx) {
+    PlaySfx(Effects[index], Ctx, Ctx.destination, Ctx.currentTime);
+  }
+}
+
 /**
  * Start the audio system. This must be called while handling a UI event.
  * @return {boolean} True if successful.
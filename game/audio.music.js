@@ -1,6 +1,27 @@
-import { Sounds, Song } from './audio.data.js';
+import { Sounds, Song, SoundEffect } from './audio.data.js';
 import { PlaySynth } from './audio.synth.js';
 
+/**
+ * Get the time when a tick starts, relative to the start of the song.
+ * @param {!Song} song
+ * @param {number} tick
+ * @returns {number}
+ */
+export function TickTime(song, tick) {
+  let time = 0;
+  let pos = 0;
+  let duration = song.TickDuration;
+  for (const [start, newDuration] of song.TempoChanges) {
+    if (start >= tick) {
+      break;
+    }
+    time += (start - pos) * duration;
+    pos = start;
+    duration = newDuration;
+  }
+  return time + (tick - pos) * duration;
+}
+
 /**
  * Render a song to an audio buffer.
  * @param {!Song} song The song to render.
@@ -14,29 +35,48 @@ import { PlaySynth } from './audio.synth.js';
  * when playback finishes.
  */
 export function PlaySong(song, ctx, destination, startTime) {
-  const { TickDuration, Duration, Tracks } = song;
+  const { Duration, Tracks } = song;
   let EndTime = startTime;
   for (const track of Tracks) {
-    const { Voices, Durations, Instrument, ConstantDuration } = track;
+    const { Voices, Durations, Velocities, Instrument, ConstantDuration } =
+      track;
     const gain = ctx.createGain();
-    gain.gain.value = track.Gain;
+    gain.gain.setValueAtTime(track.Gain, startTime);
     gain.connect(destination);
     const pan = ctx.createStereoPanner();
     pan.connect(gain);
-    pan.pan.value = track.Pan;
+    pan.pan.setValueAtTime(track.Pan, startTime);
+    for (const [tick, isPan, ramp, value] of track.Automation) {
+      const param = isPan ? pan.pan : gain.gain;
+      const t = startTime + TickTime(song, tick);
+      if (ramp == 1) {
+        param.setValueAtTime(value, t);
+      } else if (ramp == 2) {
+        param.exponentialRampToValueAtTime(value, t);
+      } else {
+        param.linearRampToValueAtTime(value, t);
+      }
+    }
     for (let voice of Voices) {
-      let t = startTime;
+      let tick = 0;
       for (let i = 0; i < voice.length; i++) {
         const noteValue = voice[i];
         const noteDuration = Durations[i];
 
         if (noteValue > 0) {
+          const t = TickTime(song, tick);
+          let out = pan;
+          if (Velocities) {
+            out = ctx.createGain();
+            out.gain.value = Velocities[i];
+            out.connect(pan);
+          }
           let end = PlaySynth(
             Sounds[Instrument],
             ctx,
-            pan,
-            t,
-            (ConstantDuration || noteDuration) * TickDuration,
+            out,
+            startTime + t,
+            TickTime(song, tick + (ConstantDuration || noteDuration)) - t,
             noteValue,
           );
           if (end > EndTime) {
@@ -44,13 +84,49 @@ export function PlaySong(song, ctx, destination, startTime) {
           }
         }
 
-        t += noteDuration * TickDuration;
+        tick += noteDuration;
       }
     }
   }
 
   return {
-    LoopTime: TickDuration * Duration,
+    LoopTime: TickTime(song, Duration),
     EndTime,
   };
 }
+
+/**
+ * Play a sound effect.
+ * @param {!SoundEffect} sfx The sound effect to play.
+ * @param {!BaseAudioContext} ctx The web audio context.
+ * @param {!AudioNode} destination The destination node to send audio to.
+ * @param {number} startTime Audio context timestamp at which to start.
+ * @returns {number} The time when playback finishes.
+ */
+export function PlaySfx(sfx, ctx, destination, startTime) {
+  const { Instrument, TickDuration, Sweep, Values, Durations } = sfx;
+  const gain = ctx.createGain();
+  gain.gain.value = sfx.Gain;
+  gain.connect(destination);
+  let EndTime = startTime;
+  let t = startTime;
+  for (let i = 0; i < Values.length; i++) {
+    const duration = Durations[i] * TickDuration;
+    if (Values[i] > 0) {
+      const end = PlaySynth(
+        Sounds[Instrument],
+        ctx,
+        gain,
+        t,
+        duration,
+        Values[i],
+        Sweep,
+      );
+      if (end > EndTime) {
+        EndTime = end;
+      }
+    }
+    t += duration;
+  }
+  return EndTime;
+}
@@ -8,9 +8,11 @@ import { COMPO, NUM_VALUES } from './common.js';
  * @param {number} t0 The program start time, seconds since start
  * @param {number} tgate The length of the note, in seconds
  * @param {number} note The MIDI note value to play
+ * @param {number=} sweep Change in pitch over the length of the note, in
+ *   semitones
  * @return {number} The ending timestamp of the note
  */
-export function PlaySynth(program, ctx, out, t0, tgate, note) {
+export function PlaySynth(program, ctx, out, t0, tgate, note, sweep) {
   /**
    * Duration of the sound, in seconds.
    * @type {number}
@@ -146,9 +148,17 @@ export function PlaySynth(program, ctx, out, t0, tgate, note) {
     },
     // Note value.
     (/** !AudioParam */ param) => {
-      param.value =
+      const value =
         440 *
         2 ** ((note + program[pos++] - 69 - ((NUM_VALUES - 1) >> 1)) / 12);
+      param.value = value;
+      if (sweep) {
+        param.setValueAtTime(value, t0);
+        param.exponentialRampToValueAtTime(
+          value * 2 ** (sweep / 12),
+          t0 + tgate,
+        );
+      }
     },
     // Random bipolar value.
     (/** !AudioParam */ param) => {
@@ -36,11 +36,23 @@ var JS13K = {};
  */
 JS13K.BuildStatus;
 
+/**
+ * An error in a song file.
+ * @typedef {{
+ *   file: ?string,
+ *   line: ?number,
+ *   column: ?number,
+ *   message: string,
+ * }}
+ */
+JS13K.MusicError;
+
 /**
  * A devserver music status.
  * @typedef {{
  *   data: ?string,
  *   error: ?string,
+ *   errors: ?Array<!JS13K.MusicError>,
  * }}
  */
 JS13K.MusicStatus;
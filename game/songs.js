@@ -4,7 +4,7 @@
 
 import { GetMain, PutErrorMessage, NewErrorMessage } from './ui.standard.js';
 import * as audiodata from './audio.data.js';
-import { PlaySong } from './audio.music.js';
+import { PlaySong, TickTime } from './audio.music.js';
 import * as icons from './icons.js';
 
 /** @type {HTMLElement} */
@@ -272,7 +272,7 @@ class Song {
       }
       end = Math.max(end, tlen);
     }
-    const length = end * this.song.TickDuration + tailLength;
+    const length = TickTime(this.song, end) + tailLength;
     const ctx = new constructor(2, (sampleRate * length) | 0, sampleRate);
     const t0 = performance.now();
     PlaySong(this.song, ctx, ctx.destination, 0.25);
@@ -378,6 +378,26 @@ function SetSongNames(songNames) {
   }
 }
 
+/**
+ * Format an error in a song file as file:line:column: message.
+ * @param {!JS13K.MusicError} error
+ * @returns {string}
+ */
+function FormatMusicError(error) {
+  const { file, line, column, message } = error;
+  let pos = '';
+  if (file) {
+    pos += `${file}:`;
+  }
+  if (line) {
+    pos += `${line}:`;
+    if (column) {
+      pos += `${column}:`;
+    }
+  }
+  return pos ? `${pos} ${message}` : message;
+}
+
 /**
  * @param {JS13K.DevEvent} event
  */
@@ -386,7 +406,11 @@ function HandleDevEvent(event) {
   if (music == null) {
     return;
   }
-  const { error, data, songNames } = music;
+  const { error, errors, data, songNames } = music;
+  if (errors != null && errors.length) {
+    SetError(errors.map(FormatMusicError).join('\n'));
+    return;
+  }
   if (error != null) {
     SetError(error);
     return;